@@ -18,6 +18,7 @@ package main
 import (
 	"bytes"
 	// "fmt"
+	"hash/fnv"
 	"time"
 
 	"github.com/msteffen/golang-time-tracker/client"
@@ -35,7 +36,7 @@ const setFGColor = "38;5"
 const setBGColor = "48;5"
 
 // BG color for 6-hour marks (chosen to look good on white or black BG)
-const markColor = "247" // light gray
+const defaultMarkColor = "247" // light gray
 
 // barColor is the ANSI terminal code such that "\e[38;5;" + barColor + "m" sets
 // the FG to be the color we use for the interval bar
@@ -49,6 +50,33 @@ const barDarkColor = "178" // slightly lighter than 220
 const shortColor = "69"     // purple, for intervals that don't count
 const shortDarkColor = "27" // darker purple
 
+// barColors is a pair of FG colors used to render part of a bar: 'normal' is
+// used for most characters, and 'dark' is used for characters on a 6-hour mark
+type barColors struct {
+	normal, dark string
+}
+
+// The colors actually used to render bars. The constants above are their
+// defaults, which may be overridden in the config file (see config.go)
+var (
+	defaultColors = barColors{barColor, barDarkColor}
+	shortColors   = barColors{shortColor, shortDarkColor}
+	markColor     = defaultMarkColor
+)
+
+// labelPalette contains the colors that 'LabeledBar' uses for each label's
+// intervals. Labels are assigned a color by hashing them (see labelColors()), so
+// a label has the same color on every day and in every invocation of 't'. None
+// of these are purple, which is reserved for intervals that don't count.
+var labelPalette = [...]barColors{
+	{barColor, barDarkColor}, // yellow
+	{"43", "36"},             // teal
+	{"205", "162"},           // pink
+	{"208", "166"},           // orange
+	{"118", "70"},            // green
+	{"159", "116"},           // light blue
+}
+
 // like barColor, but also has an SGR code for "bold"
 const boldBarColor = "1;" + barColor
 
@@ -162,9 +190,9 @@ type barBuf struct {
 	// whether the buffer has set the terminal to be inverted
 	inverted bool
 
-	// whether the buffer is using the short color (currently purple) as FG or the
-	// regular color (currently yellow)
-	short bool
+	// the FG colors that the buffer is currently using (e.g. the short color
+	// (currently purple) or the regular color (currently yellow))
+	colors barColors
 
 	// whether the buffer is on a 6-h mark character or not
 	// (6-hour marks are highlighted so that bars are easier to read)
@@ -203,7 +231,7 @@ func sgr(codes ...string) []byte {
 }
 
 func newBarBuf() *barBuf {
-	op := &barBuf{}
+	op := &barBuf{colors: defaultColors}
 	op.buf.WriteByte('[')
 	return op
 }
@@ -239,12 +267,12 @@ func (b *barBuf) finish() string {
 	return b.buf.String()
 }
 
-func (b *barBuf) put(i int, short bool) {
+func (b *barBuf) put(i int, colors barColors) {
 	// Determine FG and BG color changes needed
 	onMark := b.size > 0 && b.size%15 == 0
 	enableMark, disableMark := !b.onMark && onMark, !onMark && b.onMark
-	enableShort := i > 0 && !b.short && short // don't set short if i == 0 (empty)
-	disableShort := i > 0 && b.short && !short
+	// don't change colors if i == 0 (empty)
+	changeColors := i > 0 && b.colors != colors
 
 	if enableMark {
 		b.buf.Write(sgr(setBGColor, markColor))
@@ -255,22 +283,16 @@ func (b *barBuf) put(i int, short bool) {
 		b.inverted = false
 	}
 	// for {en,dis}ableMark, we always need to set the FG color
-	// Otherwise, we only set the FG color if {en,dis}ableShort is set
-	changeFG := enableMark || disableMark || enableShort || disableShort
+	// Otherwise, we only set the FG color if changeColors is set
+	changeFG := enableMark || disableMark || changeColors
 	if changeFG {
-		switch {
-		case b.onMark && short:
-			b.buf.Write(sgr(setFGColor, shortDarkColor))
-			b.short = true
-		case b.onMark && !short:
-			b.buf.Write(sgr(setFGColor, barDarkColor))
-			b.short = false
-		case !b.onMark && short:
-			b.buf.Write(sgr(setFGColor, shortColor))
-			b.short = true
-		case !b.onMark && !short:
-			b.buf.Write(sgr(setFGColor, barColor))
-			b.short = false
+		if i > 0 {
+			b.colors = colors
+		}
+		if b.onMark {
+			b.buf.Write(sgr(setFGColor, b.colors.dark))
+		} else {
+			b.buf.Write(sgr(setFGColor, b.colors.normal))
 		}
 	}
 
@@ -307,13 +329,64 @@ func (b *barBuf) put(i int, short bool) {
 var emptyBar = func() string {
 	buf := newBarBuf()
 	for i := 0; i < 60; i++ {
-		buf.put(0, false)
+		buf.put(0, defaultColors)
 	}
 	return buf.finish()
 }()
 
-// Bar generates a bar containing a day's worth of intervals (for raw 't' cmd)
-func Bar(morning time.Time, intervals []client.Interval) (res string) {
+// Bar generates a bar containing a day's worth of intervals (for raw 't' cmd).
+// Intervals for which 'counts' returns false are too short to count as work,
+// and are rendered in the short color
+func Bar(morning time.Time, intervals []client.Interval, counts func(client.Interval) bool) string {
+	return bar(morning, intervals, counts, func(_, _ time.Time) barColors {
+		return defaultColors
+	})
+}
+
+// LabeledBar is like Bar, but colors each character of the bar according to
+// the label that was most active during that character's 24 minutes (using the
+// intervals in 'labeled', which maps each label to its intervals, as returned
+// by GetLabeledIntervals)
+func LabeledBar(morning time.Time, intervals []client.Interval, labeled map[string][]client.Interval, counts func(client.Interval) bool) string {
+	return bar(morning, intervals, counts, func(l, r time.Time) barColors {
+		var (
+			best     string
+			bestTime time.Duration
+		)
+		for label, is := range labeled {
+			var t time.Duration
+			for _, i := range is {
+				il, ir := time.Unix(i.Start, 0), time.Unix(i.End, 0)
+				if timecmp.Leq(il, r) && timecmp.Leq(l, ir) {
+					t += timecmp.Min(r, ir).Sub(timecmp.Max(l, il))
+				}
+			}
+			// break ties by name, so that the result doesn't depend on map order
+			if t > bestTime || (t == bestTime && t > 0 && label < best) {
+				best, bestTime = label, t
+			}
+		}
+		if bestTime == 0 {
+			return defaultColors
+		}
+		return labelColors(best)
+	})
+}
+
+// labelColors returns the colors used to render intervals with the label
+// 'label' in LabeledBar (and in the label summary printed by dayRow)
+func labelColors(label string) barColors {
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	return labelPalette[h.Sum32()%uint32(len(labelPalette))]
+}
+
+// bar contains the implementation of Bar and LabeledBar. 'colorsFor' is called
+// once for each character of the bar (with that character's left and right
+// boundary) to choose the character's FG colors, unless the character contains
+// an interval that is too short to count (i.e. for which 'counts' returns
+// false), which is rendered in the short color
+func bar(morning time.Time, intervals []client.Interval, counts func(client.Interval) bool, colorsFor func(l, r time.Time) barColors) string {
 	if len(intervals) == 0 {
 		return emptyBar // special case; no intervals
 	}
@@ -334,9 +407,11 @@ func Bar(morning time.Time, intervals []client.Interval) (res string) {
 		n      = 0
 		il, ir = time.Unix(intervals[0].Start, 0), time.Unix(intervals[0].End, 0)
 
-		// The current "character" (24-minute window)
+		// The current "character" (24-minute window), and its left boundary
 		window byte
-		// true if the first interval overlapping this character is short (<1h)
+		wl     time.Time
+		// true if the first interval overlapping this character is too short to
+		// count
 		short             bool
 		firstIntersection = true
 	)
@@ -344,6 +419,9 @@ func Bar(morning time.Time, intervals []client.Interval) (res string) {
 		// each loop: render the i'th bit
 		cl = cr
 		cr = cl.Add(3 * time.Minute)
+		if i%8 == 0 {
+			wl = cl
+		}
 
 		// Determine amount of interval in [cl, cr]
 		var duration time.Duration
@@ -360,7 +438,7 @@ func Bar(morning time.Time, intervals []client.Interval) (res string) {
 
 				if firstIntersection {
 					firstIntersection = false
-					if ir.Sub(il) < time.Hour {
+					if !counts(intervals[n]) {
 						short = true
 					}
 				}
@@ -383,9 +461,13 @@ func Bar(morning time.Time, intervals []client.Interval) (res string) {
 		if i%8 == 7 {
 			// Window is filled out -- append to bar
 			// fmt.Printf("window: %s\n", bin(window))
+			colors := shortColors
+			if !short {
+				colors = colorsFor(wl, cr)
+			}
 			if window == 0 || window == 0xff {
 				// minor hack--calls put(0) (window == 0) or put(1) (window == 0xff)
-				buf.put(int(window>>7), short)
+				buf.put(int(window>>7), colors)
 			} else {
 				best := -1
 				bestCount := byte(8)
@@ -401,7 +483,7 @@ func Bar(morning time.Time, intervals []client.Interval) (res string) {
 						break
 					}
 				}
-				buf.put(best, short)
+				buf.put(best, colors)
 			}
 			window, short, firstIntersection = 0, false, true
 		}
@@ -15,6 +15,12 @@ var ts = time.Date(
 	/* time */ 9, 0, 0,
 	/* nsec, location */ 0, time.UTC)
 
+// countsIfHourLong is the 'counts' argument to Bar used by most tests
+// (intervals count if they're at least an hour long, the server's default)
+func countsIfHourLong(i client.Interval) bool {
+	return (&client.Config{MinCountedInterval: s_Hour}).Counts(i, nil)
+}
+
 func TestBits(t *testing.T) {
 	expected := []byte{
 		1, 1, 1, 1, 1, 1, 1, 1,
@@ -54,7 +60,7 @@ func StripCtlChars(s string) string {
 }
 
 func TestEmptyBar(t *testing.T) {
-	barStr := Bar(ts, []client.Interval{})
+	barStr := Bar(ts, []client.Interval{}, countsIfHourLong)
 	check.T(t, check.Eq(StripCtlChars(barStr),
 		"[████████████████████████████████████████████████████████████]"))
 }
@@ -73,7 +79,7 @@ func TestBarBasic(t *testing.T) {
 			Start: ts.Add(270 * time.Minute).Unix(),
 			End:   ts.Add(306 * time.Minute).Unix(),
 		},
-	}))
+	}, countsIfHourLong))
 
 	check.T(t,
 		check.HasPrefix(StripCtlChars(barStr), "[┃█▌████████▎▊███"),
@@ -87,7 +93,7 @@ func TestBarIntervalFitsInChar(t *testing.T) {
 			Start: ts.Add(4 * time.Minute).Unix(),
 			End:   ts.Add(20 * time.Minute).Unix(),
 		},
-	}))
+	}, countsIfHourLong))
 	check.T(t,
 		check.HasPrefix(barStr, "[┃███"),
 		check.HasSuffix(barStr, "████████████████████████████████████████████████████████]"),
@@ -101,3 +107,55 @@ func TestSGR(t *testing.T) {
 		check.Eq(sgr(""), []byte("\x1b[m")),
 	)
 }
+
+// TestLabeledBar checks that LabeledBar renders the same bar as Bar, but with
+// each label's characters in that label's color
+func TestLabeledBar(t *testing.T) {
+	intervals := []client.Interval{
+		{
+			Start: ts.Unix(),
+			End:   ts.Add(4 * time.Hour).Unix(),
+		},
+	}
+	labeled := map[string][]client.Interval{
+		"a": {{Start: ts.Unix(), End: ts.Add(2 * time.Hour).Unix(), Label: "a"}},
+		"b": {{Start: ts.Add(2 * time.Hour).Unix(), End: ts.Add(4 * time.Hour).Unix(), Label: "b"}},
+	}
+	barStr := LabeledBar(ts, intervals, labeled, countsIfHourLong)
+	check.T(t,
+		check.Eq(StripCtlChars(barStr), StripCtlChars(Bar(ts, intervals, countsIfHourLong))),
+		check.True(strings.Contains(barStr, string(sgr(setFGColor, labelColors("a").normal)))),
+		check.True(strings.Contains(barStr, string(sgr(setFGColor, labelColors("b").normal)))),
+	)
+}
+
+// TestBarShortColor checks that intervals are rendered in the short color iff
+// they're too short to count, according to the server's config
+func TestBarShortColor(t *testing.T) {
+	intervals := []client.Interval{
+		{
+			Start: ts.Unix(),
+			End:   ts.Add(30 * time.Minute).Unix(),
+		},
+	}
+	labeled := map[string][]client.Interval{
+		"a": {{Start: ts.Unix(), End: ts.Add(30 * time.Minute).Unix(), Label: "a"}},
+	}
+	shortFG := string(sgr(setFGColor, shortColor))
+	config := &client.Config{
+		MinCountedInterval: s_Hour,
+		Labels: map[string]*client.LabelConfig{
+			"a": {MinCountedInterval: 20 * s_Minute},
+		},
+	}
+	check.T(t,
+		// 30m interval doesn't count by default
+		check.True(strings.Contains(Bar(ts, intervals, func(i client.Interval) bool {
+			return config.Counts(i, nil)
+		}), shortFG)),
+		// ...but "a" was active during it, and "a" intervals count after 20m
+		check.False(strings.Contains(Bar(ts, intervals, func(i client.Interval) bool {
+			return config.Counts(i, labeled)
+		}), shortFG)),
+	)
+}
@@ -0,0 +1,290 @@
+// config.go loads the settings of 't' (and of the watch daemon that 't serve'
+// starts). Each setting's value comes from, in increasing order of precedence:
+// 1. its built-in default
+// 2. the config file (a YAML file mapping setting names to values)
+// 3. an environment variable (TIME_TRACKER_ + the setting's name, upper-cased,
+//    with '-' replaced by '_', e.g. TIME_TRACKER_MAX_EVENT_GAP)
+// 4. a command-line flag (if the setting has one for the command being run)
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// envPrefix is the prefix of every environment variable that overrides a
+// setting
+const envPrefix = "TIME_TRACKER_"
+
+// configEnvVar is the environment variable that overrides the location of the
+// config file (--config takes precedence over it)
+const configEnvVar = envPrefix + "CONFIG"
+
+var (
+	// settings contains a flag for every setting that may be set in the config
+	// file. Commands that also accept a setting as a command-line flag add the
+	// setting's flag to their own flags (see settingFlag()), so that loadConfig
+	// can tell whether the setting was set on the command line
+	settings = pflag.NewFlagSet("settings", pflag.ContinueOnError)
+
+	// settingSources maps each setting's name to a description of where its
+	// value came from (e.g. "default" or "flag --endpoint"). Set by loadConfig
+	settingSources = make(map[string]string)
+
+	// configFile is the path of the config file. It's set by --config, or by
+	// loadConfig if --config isn't set ("" if there's no config file)
+	configFile string
+
+	// Daemon settings (only used by 't serve')
+	vizAddress                            string
+	maxEventGap, minCountedInterval       time.Duration
+	labelMins                             map[string]string
+	maxWatches                            int
+	evictionPolicy                        string
+	watchExpiryDays                       int
+	pollInterval                          time.Duration
+	activityDetail                        bool
+	activityRetentionDays                 int
+	burstThreshold                        int
+	tickSyncFrequency, watchSyncFrequency time.Duration
+)
+
+func init() {
+	settings.StringVar(&dataDir, "data-dir", defaultDataDir(), "Directory containing the time tracker's DB and logs")
+	settings.StringVar(&address, "endpoint", "", "The address of a currently running time-tracker server: a TCP hostport, or a unix socket of the form unix:///path (default unix://<data-dir>/sock)")
+	settings.StringVar(&vizAddress, "viz-address", "localhost:9091", "The TCP hostport on which 't serve' serves /viz (the control API is only served on --endpoint, which must be a unix socket). If empty, /viz isn't served over TCP")
+	settings.DurationVar(&maxEventGap, "max-event-gap", 23*time.Minute, "Events (e.g. file writes) further apart than this are in separate intervals of work. Changing it only affects events recorded afterwards, as existing intervals aren't re-split or re-merged")
+	settings.DurationVar(&minCountedInterval, "min-counted-interval", time.Hour, "Intervals of work shorter than this aren't counted towards the time worked")
+	settings.StringToStringVar(&labelMins, "label-min-counted-interval", nil, "Per-label overrides of --min-counted-interval, e.g. --label-min-counted-interval=email=10m")
+	settings.IntVar(&maxWatches, "max-watches", 4, "The maximum number of directories that may be watched at once (0 means no limit, other than the kernel's inotify limits)")
+	settings.StringVar(&evictionPolicy, "eviction-policy", client.EvictLRU, "Which watches the watch daemon removes automatically: 'lru' (the least recently written watches, beyond --max-watches), 'never' (new watches beyond --max-watches are rejected instead), or 'expire' (watches with no writes for --watch-expiry-days; new watches beyond --max-watches are rejected)")
+	settings.IntVar(&watchExpiryDays, "watch-expiry-days", 30, "With --eviction-policy=expire, how many days a watch may go without writes before it's evicted")
+	settings.DurationVar(&pollInterval, "poll-interval", 10*time.Second, "How often watches that poll (see 't watch --backend') walk their directories")
+	settings.BoolVar(&activityDetail, "activity-detail", false, "If set, the watch daemon records which files are written (and not just which projects are active), for 't files'")
+	settings.IntVar(&activityRetentionDays, "activity-retention-days", 14, "With --activity-detail, how many days the watch daemon keeps its records of which files were written")
+	settings.IntVar(&burstThreshold, "burst-threshold", 20, "If more than this many writes per second arrive from one top-level subdirectory of a watched dir (e.g. during 'git checkout'), they're tool activity rather than human edits, and aren't counted (0 counts every write). 't watch --burst-threshold' overrides this for one watch")
+	settings.DurationVar(&tickSyncFrequency, "tick-sync-frequency", 3*time.Second, "How often each watch records the writes it has observed")
+	settings.DurationVar(&watchSyncFrequency, "watch-sync-frequency", 3*time.Second, "How often the watch daemon aligns its watches with its DB")
+	settings.StringVar(&defaultColors.normal, "bar-color", barColor, "8-bit terminal color of the bar")
+	settings.StringVar(&defaultColors.dark, "bar-dark-color", barDarkColor, "8-bit terminal color of the bar on 6-hour marks")
+	settings.StringVar(&shortColors.normal, "short-color", shortColor, "8-bit terminal color of intervals that don't count")
+	settings.StringVar(&shortColors.dark, "short-dark-color", shortDarkColor, "8-bit terminal color of intervals that don't count on 6-hour marks")
+	settings.StringVar(&markColor, "mark-color", defaultMarkColor, "8-bit terminal background color of 6-hour marks")
+}
+
+// settingFlag returns the flag corresponding to the setting 'name', so that a
+// command can accept the setting as a command-line flag
+func settingFlag(name string) *pflag.Flag {
+	f := settings.Lookup(name)
+	if f == nil {
+		panic(fmt.Sprintf("no setting named %q", name))
+	}
+	return f
+}
+
+// defaultDataDir returns the default value of the data-dir setting: the legacy
+// data dir ($HOME/.time-tracker) if it exists, and otherwise
+// $XDG_DATA_HOME/time-tracker if $XDG_DATA_HOME is set
+func defaultDataDir() string {
+	legacy := path.Join(os.Getenv("HOME"), ".time-tracker")
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	if xdg := os.Getenv("XDG_DATA_HOME"); xdg != "" {
+		return path.Join(xdg, "time-tracker")
+	}
+	return legacy
+}
+
+// findConfigFile returns the path of the config file to read if neither
+// --config nor $TIME_TRACKER_CONFIG is set: $XDG_CONFIG_HOME/time-tracker/
+// config.yaml ($XDG_CONFIG_HOME defaults to $HOME/.config) or, if that doesn't
+// exist, $HOME/.time-tracker/config.yaml. Returns "" if neither exists.
+func findConfigFile() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = path.Join(os.Getenv("HOME"), ".config")
+	}
+	for _, f := range []string{
+		path.Join(configHome, "time-tracker", "config.yaml"),
+		path.Join(os.Getenv("HOME"), ".time-tracker", "config.yaml"),
+	} {
+		if _, err := os.Stat(f); err == nil {
+			return f
+		}
+	}
+	return ""
+}
+
+// envVar returns the name of the environment variable that overrides the
+// setting 'name'
+func envVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// readConfigFile reads the config file at 'file' and returns the value of each
+// setting in it, formatted so that it can be passed to the setting's flag's
+// Set() method
+func readConfigFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+	var contents map[string]interface{}
+	if err := yaml.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", file, err)
+	}
+	result := make(map[string]string, len(contents))
+	for name, value := range contents {
+		if settings.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown setting %q in config file %s", name, file)
+		}
+		switch v := value.(type) {
+		case map[interface{}]interface{}:
+			// maps (e.g. label-min-counted-interval) are passed to Set() as
+			// "k1=v1,k2=v2"
+			var pairs []string
+			for k, kv := range v {
+				pairs = append(pairs, fmt.Sprintf("%v=%v", k, kv))
+			}
+			sort.Strings(pairs)
+			result[name] = strings.Join(pairs, ",")
+		case nil:
+			return nil, fmt.Errorf("setting %q in config file %s has no value", name, file)
+		default:
+			result[name] = fmt.Sprint(v)
+		}
+	}
+	return result, nil
+}
+
+// loadConfig sets every setting that wasn't set on the command line from the
+// environment or the config file (see the comment at the top of this file),
+// and records where each setting's value came from in 'settingSources'
+func loadConfig() error {
+	if configFile == "" {
+		configFile = os.Getenv(configEnvVar)
+	}
+	if configFile == "" {
+		configFile = findConfigFile()
+	}
+	var fromFile map[string]string
+	if configFile != "" {
+		var err error
+		if fromFile, err = readConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	settings.VisitAll(func(f *pflag.Flag) {
+		if err != nil {
+			return
+		}
+		// Only the source with the highest precedence is applied, as Set() merges
+		// values into some types of settings (e.g. maps) rather than replacing them
+		env := envVar(f.Name)
+		switch envValue, ok := os.LookupEnv(env); {
+		case f.Changed:
+			settingSources[f.Name] = "flag --" + f.Name
+		case ok:
+			if err = f.Value.Set(envValue); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", envValue, env, err)
+			}
+			settingSources[f.Name] = "env " + env
+		case fromFile[f.Name] != "":
+			if err = f.Value.Set(fromFile[f.Name]); err != nil {
+				err = fmt.Errorf("invalid value %q for %q in config file %s: %v",
+					fromFile[f.Name], f.Name, configFile, err)
+			}
+			settingSources[f.Name] = "file " + configFile
+		default:
+			settingSources[f.Name] = "default"
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if address == "" {
+		address = client.UnixPrefix + path.Join(dataDir, "sock")
+	}
+	dbFile = path.Join(dataDir, "db")
+	logFile = path.Join(dataDir, "watchd.stdout")
+	errFile = path.Join(dataDir, "watchd.stderr")
+	tokenFile = path.Join(dataDir, "token")
+	return nil
+}
+
+// serverConfig converts the daemon settings into the client.Config used by
+// 't serve' (whose durations are in seconds)
+func serverConfig() (*client.Config, error) {
+	config := &client.Config{
+		MaxEventGap:        int64(maxEventGap / time.Second),
+		MinCountedInterval: int64(minCountedInterval / time.Second),
+		MaxWatches:         maxWatches,
+		EvictionPolicy:     evictionPolicy,
+		WatchExpiry:        int64(watchExpiryDays) * s_Day,
+		PollInterval:       int64(pollInterval / time.Second),
+		ActivityDetail:     activityDetail,
+		ActivityRetention:  int64(activityRetentionDays) * s_Day,
+		BurstThreshold:     burstThreshold,
+		TickSyncFrequency:  int64(tickSyncFrequency / time.Second),
+		WatchSyncFrequency: int64(watchSyncFrequency / time.Second),
+	}
+	for label, min := range labelMins {
+		d, err := time.ParseDuration(min)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min counted interval %q for label %q: %v",
+				min, label, err)
+		}
+		if config.Labels == nil {
+			config.Labels = make(map[string]*client.LabelConfig)
+		}
+		config.Labels[label] = &client.LabelConfig{
+			MinCountedInterval: int64(d / time.Second),
+		}
+	}
+	return config, nil
+}
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the time tracker's configuration",
+		Long:  "Inspect the time tracker's configuration",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration, and where each value came from",
+		Long: "Print the effective configuration, and where each value came from " +
+			"(a flag, an environment variable, the config file, or the default)",
+		Run: BoundedCommand(0, 0, func(_ []string) error {
+			if configFile != "" {
+				fmt.Printf("config file: %s\n", configFile)
+			} else {
+				fmt.Printf("config file: none\n")
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(w, "SETTING\tVALUE\tSOURCE\n")
+			settings.VisitAll(func(f *pflag.Flag) {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", f.Name, f.Value, settingSources[f.Name])
+			})
+			return w.Flush()
+		}),
+	})
+	return cmd
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/msteffen/golang-time-tracker/client"
+	"github.com/msteffen/golang-time-tracker/pkg/check"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "time-tracker-config")
+	check.T(t, check.Nil(err))
+	defer os.RemoveAll(dir)
+	configFile = path.Join(dir, "config.yaml")
+	check.T(t, check.Nil(ioutil.WriteFile(configFile, []byte(`
+max-event-gap: 10m
+min-counted-interval: 30m
+max-watches: 8
+label-min-counted-interval:
+  email: 10m
+  chat: 5m
+`), 0644)))
+	os.Setenv("TIME_TRACKER_MIN_COUNTED_INTERVAL", "45m")
+	os.Setenv("TIME_TRACKER_MAX_WATCHES", "6")
+	check.T(t, check.Nil(settings.Set("max-watches", "2")))
+	defer func() {
+		os.Unsetenv("TIME_TRACKER_MIN_COUNTED_INTERVAL")
+		os.Unsetenv("TIME_TRACKER_MAX_WATCHES")
+		settings.Lookup("max-watches").Changed = false
+		configFile = ""
+	}()
+
+	check.T(t, check.Nil(loadConfig()))
+	check.T(t,
+		check.Eq(maxEventGap, 10*time.Minute),
+		check.Eq(minCountedInterval, 45*time.Minute),
+		check.Eq(maxWatches, 2),
+		check.Eq(labelMins, map[string]string{"email": "10m", "chat": "5m"}),
+		check.Eq(settingSources["max-event-gap"], "file "+configFile),
+		check.Eq(settingSources["min-counted-interval"], "env TIME_TRACKER_MIN_COUNTED_INTERVAL"),
+		check.Eq(settingSources["max-watches"], "flag --max-watches"),
+		check.Eq(settingSources["tick-sync-frequency"], "default"))
+
+	config, err := serverConfig()
+	check.T(t,
+		check.Nil(err),
+		check.Eq(config.MaxEventGap, int64(10*s_Minute)),
+		check.Eq(config.EvictionPolicy, client.EvictLRU),
+		check.Eq(config.WatchExpiry, int64(30*s_Day)),
+		check.Eq(config.PollInterval, int64(10)),
+		check.False(config.ActivityDetail),
+		check.Eq(config.ActivityRetention, int64(14*s_Day)),
+		check.Eq(config.BurstThreshold, 20),
+		check.Eq(config.Labels["chat"].MinCountedInterval, int64(5*s_Minute)))
+}
+
+func TestUnknownSetting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "time-tracker-config")
+	check.T(t, check.Nil(err))
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "config.yaml")
+	check.T(t, check.Nil(ioutil.WriteFile(file, []byte("max-gap: 10m\n"), 0644)))
+	_, err = readConfigFile(file)
+	check.T(t, check.NotNil(err))
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	p "path"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,16 +22,22 @@ import (
 const (
 	s_Minute = 60
 	s_Hour   = 60 * s_Minute
+	s_Day    = 24 * s_Hour
 )
 
 var (
-	/* const */ dataDir = os.Getenv("HOME") + "/.time-tracker"
-	/* const */ dbFile = dataDir + "/db"
-	/* const */ logFile = dataDir + "/watchd.stdout"
-	/* const */ errFile = dataDir + "/watchd.stderr"
+	dataDir string // set by loadConfig (the data-dir setting)
+	dbFile  string // set by loadConfig (<dataDir>/db)
+	logFile string // set by loadConfig (<dataDir>/watchd.stdout)
+	errFile string // set by loadConfig (<dataDir>/watchd.stderr)
+
+	// tokenFile contains the secret that authenticates the CLI to the watch
+	// daemon (created by 't serve'). Set by loadConfig (<dataDir>/token)
+	tokenFile string
 
 	binaryName string // populated by main(), used by by getCLIClient()
-	address    string // set by flag
+	address    string // set by loadConfig (the endpoint setting)
+	byLabel    bool   // set by flag (on 't today' and 't week')
 )
 
 type couldNotConnectErr struct {
@@ -41,9 +51,15 @@ func (e couldNotConnectErr) Error() string {
 func getCLIClient(addr string) (*client.Client, error) {
 	var err error
 	for retry := 0; retry < 2; retry++ {
-		// Try to connect naively
+		// Try to connect naively (/status doesn't require the token, which is
+		// created by the watch daemon and may not exist until it has started)
 		c := &client.Client{Address: addr}
 		if _, err = c.Status(); err == nil {
+			token, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read watch daemon's token: %v", err)
+			}
+			c.Token = strings.TrimSpace(string(token))
 			return c, nil
 		} else if retry > 0 {
 			break
@@ -51,7 +67,12 @@ func getCLIClient(addr string) (*client.Client, error) {
 
 		// Try to connect to watchd, or start it if it's not running
 		fmt.Printf("could not connect to server: %v\nAttempting to start it...\n", err)
-		cmd := exec.Command(binaryName, "serve") // run "t serve" in another process
+		// run "t serve" in another process, with the same config as this one
+		serveArgs := []string{"serve", "--endpoint", addr}
+		if configFile != "" {
+			serveArgs = append(serveArgs, "--config", configFile)
+		}
+		cmd := exec.Command(binaryName, serveArgs...)
 		cmd.Stdout, err = os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			return nil, fmt.Errorf("could not create stdout log for watchd: %v", err)
@@ -75,20 +96,129 @@ func morning(now time.Time) time.Time {
 	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
 }
 
-// dayRow reads the intervals for the day starting at 'morning', renders those
-// intervals, and returns a bar for the day
-func dayRow(c *client.Client, morning time.Time, includeEndGap bool) (string, error) {
-	resp, err := c.GetIntervals(morning, morning.Add(24*time.Hour))
+// formatDuration renders 'd' as "{H}h{M}m" (can't use go duration.String()
+// since we don't want seconds)
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%dh%dm", d/time.Hour, d%time.Hour/time.Minute)
+}
+
+// labelSummary renders the amount of time spent on each label in 'labeled'
+// (e.g. "golang-time-tracker 2h10m, infra 1h5m"), sorted by time spent. Only
+// time inside of 'counted' (the union intervals that are long enough to count)
+// is included. Returns "" if no label has any counted time.
+func labelSummary(counted []client.Interval, labeled map[string][]client.Interval) string {
+	type labelTime struct {
+		label    string
+		duration time.Duration
+	}
+	var times []labelTime
+	for label, intervals := range labeled {
+		var total int64
+		for _, i := range intervals {
+			for _, c := range counted {
+				if l, r := max(i.Start, c.Start), min(i.End, c.End); l < r {
+					total += r - l
+				}
+			}
+		}
+		if total >= s_Minute {
+			times = append(times, labelTime{label, time.Duration(total) * time.Second})
+		}
+	}
+	sort.Slice(times, func(i, j int) bool {
+		if times[i].duration != times[j].duration {
+			return times[i].duration > times[j].duration
+		}
+		return times[i].label < times[j].label
+	})
+	var buf bytes.Buffer
+	for i, t := range times {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.Write(sgr(setFGColor, labelColors(t.label).normal))
+		buf.WriteString(t.label)
+		buf.Write(sgr(resetAll))
+		buf.WriteString(" " + formatDuration(t.duration))
+	}
+	return buf.String()
+}
+
+// dayIntervals holds the intervals that watchd returned for one day, so that
+// the day can be re-rendered every second without re-reading them
+type dayIntervals struct {
+	morning time.Time
+	resp    *client.GetIntervalsResponse
+	fetched int64 // the time at which 'resp' was read (unix seconds)
+}
+
+// getDay reads the intervals for the day starting at 'morning' from watchd
+func getDay(c *client.Client, config *client.Config, morning time.Time, byLabel bool) (*dayIntervals, error) {
+	var resp *client.GetIntervalsResponse
+	var err error
+	// per-label settings in 'config' require labeled intervals
+	if byLabel || len(config.Labels) > 0 {
+		resp, err = c.GetLabeledIntervals(morning, morning.Add(24*time.Hour))
+	} else {
+		resp, err = c.GetIntervals(morning, morning.Add(24*time.Hour))
+	}
 	if err != nil {
-		return "", fmt.Errorf("could not retrieve today's intervals: %v", err)
+		return nil, fmt.Errorf("could not retrieve the intervals for %s: %v", morning.Format("01/02"), err)
+	}
+	return &dayIntervals{morning: morning, resp: resp, fetched: time.Now().Unix()}, nil
+}
+
+// expired returns true if, at 'now', the in-progress interval in 'd' (if any)
+// has ended, so that 'd' must be re-read to render it correctly
+func (d *dayIntervals) expired(now time.Time, config *client.Config) bool {
+	return d.resp.EndGap > 0 && d.resp.EndGap+(now.Unix()-d.fetched) >= config.MaxEventGap
+}
+
+// at returns a copy of the response in 'd' in which the in-progress interval
+// (if any) is extended to 'now' (as watchd would have extended it, had 'd'
+// been read at 'now')
+func (d *dayIntervals) at(now time.Time) *client.GetIntervalsResponse {
+	resp := &client.GetIntervalsResponse{
+		Intervals: append([]client.Interval(nil), d.resp.Intervals...),
+		EndGap:    d.resp.EndGap,
+	}
+	if d.resp.Labeled != nil {
+		resp.Labeled = make(map[string][]client.Interval)
+		for label, intervals := range d.resp.Labeled {
+			resp.Labeled[label] = append([]client.Interval(nil), intervals...)
+		}
+	}
+	elapsed := min(now.Unix(), d.morning.Add(24*time.Hour).Unix()) - d.fetched
+	if resp.EndGap == 0 || elapsed <= 0 {
+		return resp
 	}
+	i := &resp.Intervals[len(resp.Intervals)-1]
+	for _, intervals := range resp.Labeled {
+		if last := &intervals[len(intervals)-1]; last.End == i.End {
+			last.End += elapsed
+		}
+	}
+	i.End += elapsed
+	resp.EndGap += elapsed
+	return resp
+}
+
+// dayRow renders the intervals in 'd' (as of 'now') and returns a bar for the
+// day. 'config' is the server's config, which determines which intervals count
+// as work. If 'byLabel' is set, the bar is colored by label, and a summary of
+// the time spent on each label is added on a second line (so the result may
+// contain a newline)
+func dayRow(d *dayIntervals, config *client.Config, now time.Time, includeEndGap, byLabel bool) string {
+	morning, resp := d.morning, d.at(now)
+	var counted []client.Interval
 	workDuration := time.Duration(0)
 	for idx, i := range resp.Intervals {
 		// don't count intervals that are too short
-		if i.End-i.Start < s_Hour {
+		if !config.Counts(i, resp.Labeled) {
 			continue
 		}
 		workDuration += time.Duration(i.End-i.Start) * time.Second
+		counted = append(counted, i)
 		// remove resp.EndGap (but add it below the "too short" check above, so that
 		// resp.EndGap is only removed if the in-progress interval was long enough
 		// to be added to the total)
@@ -104,30 +234,133 @@ func dayRow(c *client.Client, morning time.Time, includeEndGap bool) (string, er
 	// TODO get rid of EndGap!
 	// Also, show how much time is remaining until the in-progress interval counts
 	// (EndGap > 0 => last interval is in-progress)
-	durationStr := fmt.Sprintf(
-		"%dh%dm", workDuration/time.Hour, workDuration%time.Hour/time.Minute)
+	durationStr := formatDuration(workDuration)
 	if resp.EndGap > 0 {
 		i := &resp.Intervals[len(resp.Intervals)-1]
-		if remaining := s_Hour - (i.End - i.Start) + resp.EndGap; remaining > 0 {
+		minCounted := config.MinCountedIntervalIn(*i, resp.Labeled)
+		if remaining := minCounted - (i.End - i.Start) + resp.EndGap; remaining > 0 {
 			durationStr += fmt.Sprintf(" (%dm to go)", remaining/s_Minute)
 		}
+		// The in-progress label's last interval is extended along with the union
+		// interval. Label totals shouldn't include EndGap (just like
+		// 'workDuration') so always remove it there
+		for _, intervals := range resp.Labeled {
+			if last := &intervals[len(intervals)-1]; last.End == i.End {
+				last.End -= resp.EndGap
+			}
+		}
 		if !includeEndGap {
 			i.End -= resp.EndGap
 		}
 	}
 
 	// Return string of form "Mon 02/01 [...bar...] 4h20m"
-	// Can't use go duration.String() since we don't want seconds
-	return fmt.Sprintf("%[1]s%[2]s%[3]s %[4]s %[1]s%[5]s%[3]s",
-		sgr(boldText, setFGColor, barColor),
-		morning.Format("Mon 01/02:"),
+	dayStr := morning.Format("Mon 01/02:")
+	counts := func(i client.Interval) bool {
+		return config.Counts(i, resp.Labeled)
+	}
+	var bar string
+	if byLabel {
+		bar = LabeledBar(morning, resp.Intervals, resp.Labeled, counts)
+	} else {
+		bar = Bar(morning, resp.Intervals, counts)
+	}
+	row := fmt.Sprintf("%[1]s%[2]s%[3]s %[4]s %[1]s%[5]s%[3]s",
+		sgr(boldText, setFGColor, defaultColors.normal),
+		dayStr,
 		string(sgr(resetAll)),
-		Bar(morning, resp.Intervals),
-		durationStr), nil
+		bar,
+		durationStr)
+	if byLabel {
+		// print summary on the next line, aligned with the start of the bar
+		if summary := labelSummary(counted, resp.Labeled); summary != "" {
+			row += "\n" + strings.Repeat(" ", len(dayStr)+1) + summary
+		}
+	}
+	return row
+}
+
+// showDays prints bars for the last 'numDays' days (ending today), and then
+// re-renders them every second until an error occurs. 'layout' arranges the
+// days' bars for printing. Rather than polling watchd, the days' intervals are
+// re-read when watchd reports (via /events) that they changed, when the
+// in-progress interval ends, or when the day changes.
+func showDays(c *client.Client, config *client.Config, numDays int, layout func(rows []string) string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.Subscribe(ctx)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to watchd's events: %v", err)
+	}
+	second := time.NewTicker(time.Second)
+	defer second.Stop()
+
+	var days []*dayIntervals
+	stale := true // set if 'days' must be re-read
+	var lines int // lines printed in the previous iteration
+	for tick := 0; ; tick = 2 - ((tick + 1) % 2) {
+		// Note: Now() sets local time, which is necessary for watchd (which
+		// assumes Local time for all ticks). See
+		// https://github.com/msteffen/golang-time-tracker/issues/2)
+		now := time.Now()
+		start := morning(now).Add(-time.Duration(numDays-1) * 24 * time.Hour)
+		if stale || !days[0].morning.Equal(start) || days[numDays-1].expired(now, config) {
+			days = days[:0]
+			for day := 0; day < numDays; day++ {
+				d, err := getDay(c, config, start.Add(time.Duration(day)*24*time.Hour), byLabel)
+				if err != nil {
+					return err
+				}
+				days = append(days, d)
+			}
+			stale = false
+		}
+		rows := make([]string, numDays)
+		for i, d := range days {
+			rows[i] = dayRow(d, config, now, tick == 1, byLabel)
+		}
+		if tick > 0 { // tick starts at 0 and then alternates between 1 and 2
+			// jump up 'lines' lines & clear the rest of the screen
+			fmt.Printf("\x1b[%dF\x1b[J", lines)
+		}
+		out := layout(rows)
+		fmt.Print(out)
+		lines = strings.Count(out, "\n")
+
+		// wait for the next second, noting whether any intervals changed
+	wait:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return fmt.Errorf("lost connection to watchd's events")
+				}
+				if e.Type == client.EventTick || e.Type == client.EventInterval {
+					stale = true
+				}
+			case <-second.C:
+				break wait
+			}
+		}
+	}
+}
+
+func min(l, r int64) int64 {
+	if l < r {
+		return l
+	}
+	return r
+}
+
+func max(l, r int64) int64 {
+	if l > r {
+		return l
+	}
+	return r
 }
 
 func weekCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "week",
 		Short: "Show this week's activity",
 		Long:  "Show this week's activity",
@@ -136,43 +369,25 @@ func weekCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-
-			for tick := 0; ; tick = 2 - ((tick + 1) % 2) {
-				// Get time worked on the day of 'start'
-				// Note: Now() sets local time, which is necessary for watchd (which
-				// assumes Local time for all ticks). See
-				// https://github.com/msteffen/golang-time-tracker/issues/2)
-				start := morning(time.Now()).Add(-6 * 24 * time.Hour)
-				if tick > 0 { // tick starts at 0 and then alternates between 1 and 2
-					fmt.Printf("\x1b[9F\x1b[J") // up nine lines & clear rest of screen
-				}
-				for day := 0; day < 7; day++ {
-					// print upper border
-					if day+1 == 7 {
-						fmt.Println(strings.Repeat("-", 80))
-					}
-					// print bar itself
-					bar, err := dayRow(c, start, tick == 1)
-					if err != nil {
-						return err
-					}
-					fmt.Println(bar)
-					// print lower border
-					if day+1 == 7 {
-						fmt.Println(strings.Repeat("-", 80))
-					}
-					// advance to next day
-					start = start.Add(24 * time.Hour)
-				}
-				time.Sleep(time.Second)
+			config, err := c.GetConfig()
+			if err != nil {
+				return fmt.Errorf("could not retrieve server config: %v", err)
 			}
-			return nil
+
+			return showDays(c, config, 7, func(rows []string) string {
+				// put a border around today's bar
+				border := strings.Repeat("-", 80) + "\n"
+				last := len(rows) - 1
+				return strings.Join(rows[:last], "\n") + "\n" + border + rows[last] + "\n" + border
+			})
 		}),
 	}
+	cmd.Flags().BoolVar(&byLabel, "labels", false, "If set, color each day's bar by label, and print the time spent on each label")
+	return cmd
 }
 
 func todayCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "today",
 		Short: "Show today's activity",
 		Long:  "Show today's activity",
@@ -181,34 +396,50 @@ func todayCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			config, err := c.GetConfig()
+			if err != nil {
+				return fmt.Errorf("could not retrieve server config: %v", err)
+			}
 
 			// Get today's time worked and print a bar
-			morning := morning(time.Now())
-			for tick := 0; ; tick = 2 - ((tick + 1) % 2) {
-				// Note: Now() sets local time, which is necessary for watchd (which
-				// assumes Local time for all ticks). See
-				// https://github.com/msteffen/golang-time-tracker/issues/2)
-				if tick > 0 { // tick starts at 0 and then alternates between 1 and 2
-					fmt.Printf("\x1b[1F\x1b[K") // jump up one line & clear it
-				}
-				bar, err := dayRow(c, morning, tick == 1)
-				if err != nil {
-					return err
-				}
-				fmt.Println(bar)
-				time.Sleep(time.Second)
-			}
-			return nil
+			return showDays(c, config, 1, func(rows []string) string {
+				return rows[0] + "\n"
+			})
 		}),
 	}
+	cmd.Flags().BoolVar(&byLabel, "labels", false, "If set, color today's bar by label, and print the time spent on each label")
+	return cmd
+}
+
+// absDir converts the directory argument 'dir' into the clean absolute path
+// that watchd expects
+func absDir(dir string) (string, error) {
+	dir = p.Clean(dir)
+	if !p.IsAbs(dir) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("watch dir %q is relative, but could not get current working dir: %v", dir, err)
+		}
+		dir = p.Join(wd, dir)
+	}
+	return dir, nil
 }
 
 func watchCmd() *cobra.Command {
 	var label string
+	var relabel, override bool
+	var backend string
+	var burstThreshold int
+	var rules, removeRules []string
 	cmd := &cobra.Command{
 		Use:   "watch <directory>",
 		Short: "Start watching the given project directory for writes",
-		Long:  "Start watching the given project directory for writes",
+		Long: "Start watching the given project directory for writes (or, with " +
+			"--relabel, change the label of an existing watch). Existing watches " +
+			"on subdirectories of the directory are merged into the new watch, and " +
+			"keep their labels. --rule and --remove-rule manage the watch's label " +
+			"rules, which label writes to parts of the directory differently, e.g. " +
+			"--rule 'services/billing/**=billing'.",
 		Run: BoundedCommand(1, 1, func(args []string) error {
 			c, err := getCLIClient(address)
 			if err != nil {
@@ -216,63 +447,300 @@ func watchCmd() *cobra.Command {
 			}
 
 			// Construct dir to send to watchd (must be clean absolute path)
-			dir := p.Clean(args[0])
-			if !p.IsAbs(dir) {
-				wd, err := os.Getwd()
-				if err != nil {
-					return fmt.Errorf("watch dir %q is relative, but could not get current working dir: %v", dir, err)
+			dir, err := absDir(args[0])
+			if err != nil {
+				return err
+			}
+			if relabel {
+				if label == "" {
+					return fmt.Errorf("must provide a new label with --label when using --relabel")
+				}
+				err = c.UpdateWatch(dir, label)
+			} else {
+				err = c.WatchWithRequest(&client.WatchRequest{
+					Dir:      dir,
+					Label:    label,
+					Override: override,
+					Backend:  backend,
+
+					BurstThreshold: burstThreshold,
+				})
+			}
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				// split at the last '=', as labels are less likely than paths to
+				// contain '='
+				i := strings.LastIndex(rule, "=")
+				if i < 0 {
+					return fmt.Errorf("label rule must have the form <path>=<label>: %q", rule)
+				}
+				if err := c.AddLabelRule(dir, rule[:i], rule[i+1:]); err != nil {
+					return fmt.Errorf("could not add label rule %q: %v", rule, err)
 				}
-				dir = p.Join(wd, dir)
 			}
-			return c.Watch(dir, label)
+			for _, rulePath := range removeRules {
+				if err := c.RemoveLabelRule(dir, rulePath); err != nil {
+					return fmt.Errorf("could not remove label rule %q: %v", rulePath, err)
+				}
+			}
+			return nil
 		}),
 	}
 	cmd.Flags().StringVarP(&label, "label", "l", "", "project label associated with the watched dir")
+	cmd.Flags().BoolVar(&relabel, "relabel", false, "If set, change the label of an existing watch on the given dir to --label (previously recorded writes keep their label)")
+	cmd.Flags().StringArrayVar(&rules, "rule", nil, "A label rule to add to the watch, of the form <path>=<label>: writes to files under the watched dir matching <path> (which may contain globs, including '**') are labeled <label>. May be repeated; the most specific matching rule wins")
+	cmd.Flags().StringArrayVar(&removeRules, "remove-rule", nil, "The <path> of a label rule to remove from the watch. May be repeated")
+	cmd.Flags().StringVar(&backend, "backend", client.BackendAuto, "How the new watch observes writes: 'inotify', 'poll' (periodically walk the dir; works on network and FUSE filesystems, which inotify doesn't), 'fanotify' (watch the dir's whole filesystem, so that huge dirs don't exhaust inotify watches; needs CAP_SYS_ADMIN, and falls back to inotify without it), or 'auto' (poll dirs on network and FUSE filesystems, and use inotify otherwise)")
+	cmd.Flags().IntVar(&burstThreshold, "burst-threshold", 0, "If more than this many writes per second arrive from one top-level subdirectory of the new watch's dir (e.g. during 'git checkout'), they're tool activity rather than human edits, and aren't counted. 0 uses the daemon's --burst-threshold, and a negative value counts every write")
+	cmd.Flags().BoolVar(&override, "override", false, "If set, and the given dir is inside an existing watch, label writes under the given dir with --label instead of failing")
 	return cmd
 }
 
-func tickCmd() *cobra.Command {
+func unwatchCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:   "tick <label>",
-		Short: "Append a tick (work event) with the given label, or print the "+
-		"server's current time",
-		Long:  "Append a tick (work event) with the given label, or print the "+
-		"server's current time",
+		Use:   "unwatch <directory>",
+		Short: "Stop watching the given project directory for writes",
+		Long: "Stop watching the given project directory for writes (writes that " +
+			"have already been recorded are kept)",
 		Run: BoundedCommand(1, 1, func(args []string) error {
 			c, err := getCLIClient(address)
 			if err != nil {
 				return err
 			}
-			now, err := c.Tick(args[0])
+			dir, err := absDir(args[0])
 			if err != nil {
 				return err
-			} else if args[0] == "" {
-				fmt.Printf("
 			}
+			return c.Unwatch(dir)
 		}),
 	}
 }
 
-func getWatchedCmd() *cobra.Command {
+func tickCmd() *cobra.Command {
 	return &cobra.Command{
+		Use: "tick [<label>]",
+		Short: "Append a tick (work event) with the given label, or print the " +
+			"server's current time",
+		Long: "Append a tick (work event) with the given label, or print the " +
+			"server's current time",
+		Run: BoundedCommand(0, 1, func(args []string) error {
+			c, err := getCLIClient(address)
+			if err != nil {
+				return err
+			}
+			var label string
+			if len(args) > 0 {
+				label = args[0]
+			}
+			now, err := c.Tick(label)
+			if err != nil {
+				return err
+			} else if label == "" {
+				fmt.Println(time.Unix(now, 0))
+			}
+			return nil
+		}),
+	}
+}
+
+func getWatchedCmd() *cobra.Command {
+	var evicted bool
+	cmd := &cobra.Command{
 		Use:   "watched",
 		Short: "Print the directories being watched currently by the watch daemon",
-		Long:  "Print the directories being watched currently by the watch daemon",
+		Long: "Print the directories being watched currently by the watch daemon " +
+			"(or, with --evicted, the watches that it has evicted)",
 		Run: BoundedCommand(0, 0, func(args []string) error {
 			c, err := getCLIClient(address)
 			if err != nil {
 				return err
 			}
+			if evicted {
+				resp, err := c.GetEvictions()
+				if err != nil {
+					return fmt.Errorf("could not retrieve evictions: %v", err)
+				}
+				for _, e := range resp.Evictions {
+					fmt.Printf("%s\t%s (%s)\t%s\n", time.Unix(e.Time, 0).Format(time.RFC3339),
+						e.Dir, e.Label, e.Reason)
+				}
+				return nil
+			}
 			resp, err := c.GetWatches()
 			if err != nil {
 				return fmt.Errorf("could not retrieve watches: %v", err)
 			}
 			for _, wi := range resp.Watches {
-				fmt.Printf("%s (%s)\n", wi.Dir, wi.Label)
+				fmt.Printf("%s (%s)", wi.Dir, wi.Label)
+				switch wi.ActiveBackend {
+				case client.BackendPoll:
+					fmt.Printf(" [polling]")
+				case client.BackendFanotify:
+					fmt.Printf(" [fanotify]")
+				}
+				switch {
+				case wi.BurstThreshold < 0:
+					fmt.Printf(" [counts all writes]")
+				case wi.BurstThreshold > 0:
+					fmt.Printf(" [burst threshold: %d]", wi.BurstThreshold)
+				}
+				if wi.Status != "" && wi.Status != client.WatchHealthy {
+					fmt.Printf(" [%s: %s]", wi.Status, wi.StatusReason)
+				}
+				fmt.Println()
+				for _, r := range wi.Rules {
+					fmt.Printf("  %s -> %s\n", r.Path, r.Label)
+				}
 			}
 			return nil
 		}),
 	}
+	cmd.Flags().BoolVar(&evicted, "evicted", false, "If set, print the watches that the watch daemon has evicted (most recent first), and why")
+	return cmd
+}
+
+func projectsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "projects",
+		Short: "Print the projects (labels) known to the watch daemon",
+		Long:  "Print the projects (labels) known to the watch daemon",
+		Run: BoundedCommand(0, 0, func(args []string) error {
+			c, err := getCLIClient(address)
+			if err != nil {
+				return err
+			}
+			resp, err := c.GetProjects()
+			if err != nil {
+				return fmt.Errorf("could not retrieve projects: %v", err)
+			}
+			for _, pi := range resp.Projects {
+				fmt.Printf("%d\t%s\n", pi.ID, pi.Name)
+			}
+			return nil
+		}),
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rename <old name> <new name>",
+		Short: "Rename a project, preserving its history",
+		Long:  "Rename a project, preserving its history",
+		Run: BoundedCommand(2, 2, func(args []string) error {
+			c, err := getCLIClient(address)
+			if err != nil {
+				return err
+			}
+			return c.RenameProject(args[0], args[1])
+		}),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "merge <from> <into>",
+		Short: "Merge the history and watches of one project into another",
+		Long: "Merge the history and watches of the project <from> into the " +
+			"project <into>, and delete <from>",
+		Run: BoundedCommand(2, 2, func(args []string) error {
+			c, err := getCLIClient(address)
+			if err != nil {
+				return err
+			}
+			return c.MergeProjects(args[0], args[1])
+		}),
+	})
+	return cmd
+}
+
+func filesCmd() *cobra.Command {
+	var today bool
+	var limit int
+	cmd := &cobra.Command{
+		Use:   "files",
+		Short: "Print the most-edited files in each project",
+		Long: "Print the most-edited files in each project (requires the " +
+			"activity-detail setting). A file counts as edited once per " +
+			"tick-sync-frequency in which it was written",
+		Run: BoundedCommand(0, 0, func(args []string) error {
+			c, err := getCLIClient(address)
+			if err != nil {
+				return err
+			}
+			config, err := c.GetConfig()
+			if err != nil {
+				return fmt.Errorf("could not retrieve server config: %v", err)
+			}
+			if !config.ActivityDetail {
+				return fmt.Errorf("the watch daemon isn't recording which files " +
+					"are written; restart it with --activity-detail")
+			}
+			start := time.Unix(0, 0)
+			if today {
+				start = morning(time.Now())
+			}
+			resp, err := c.GetActivity(start, time.Now())
+			if err != nil {
+				return fmt.Errorf("could not retrieve activity: %v", err)
+			}
+			// resp.Files is sorted by label, and then by edits
+			var label string
+			var n int // files printed for 'label'
+			for i, f := range resp.Files {
+				if i == 0 || f.Label != label {
+					label, n = f.Label, 0
+					fmt.Println(label)
+				}
+				if limit > 0 && n >= limit {
+					continue
+				}
+				n++
+				fmt.Printf("  %4d  %s  (last %s)\n", f.Edits, f.Path,
+					time.Unix(f.LastEdit, 0).Format("Jan 2 15:04"))
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().BoolVar(&today, "today", false, "If set, only include files edited today (otherwise, all recorded edits are included)")
+	cmd.Flags().IntVar(&limit, "limit", 10, "The maximum number of files to print per project (0 means no limit)")
+	return cmd
+}
+
+func dbCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the time-tracker database",
+		Long:  "Manage the time-tracker database",
+	}
+	var dryRun bool
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Bring the time-tracker database's schema up to date",
+		Long: "Bring the time-tracker database's schema up to date. 't serve' " +
+			"does this automatically on startup. Ticks stored by old versions of " +
+			"the time tracker are folded into intervals using --max-event-gap",
+		Run: BoundedCommand(0, 0, func(args []string) error {
+			// Legacy ticks are folded into intervals with the daemon's max-event-gap
+			plan, err := watchd.MigrateDB(dbFile, int64(maxEventGap/time.Second), dryRun)
+			if err != nil {
+				return err
+			}
+			verb := "applied"
+			if dryRun {
+				verb = "would apply"
+			}
+			if len(plan.Steps) == 0 {
+				fmt.Printf("schema is up to date (version %d)\n", plan.From)
+				return nil
+			}
+			fmt.Printf("%s %d migrations (schema version %d -> %d):\n",
+				verb, len(plan.Steps), plan.From, plan.To)
+			for _, step := range plan.Steps {
+				fmt.Printf("  %s\n", step)
+			}
+			return nil
+		}),
+	}
+	migrateCmd.Flags().BoolVar(&dryRun, "dry-run", false, "If set, print and validate the migrations that would be applied, without modifying the database")
+	migrateCmd.Flags().AddFlag(settingFlag("max-event-gap"))
+	cmd.AddCommand(migrateCmd)
+	return cmd
 }
 
 func serveCmd() *cobra.Command {
@@ -296,14 +764,42 @@ func serveCmd() *cobra.Command {
 				return fmt.Errorf("must have rwx permissions on %s but only have %s (%0d vs 0700)",
 					dataDir, info.Mode(), info.Mode().Perm()&0700)
 			}
-			apiServer, err := watchd.NewServer(watchd.SystemClock, dbFile)
+			config, err := serverConfig()
+			if err != nil {
+				return err
+			}
+			apiServer, err := watchd.NewServer(watchd.SystemClock, dbFile, config)
 			if err != nil {
 				return fmt.Errorf("could not create APIServer: %v", err)
 			}
-			return watchd.ServeOverHTTP(address, watchd.SystemClock, apiServer)
+			socket, ok := client.SocketPath(address)
+			if !ok {
+				return fmt.Errorf("'t serve' must serve on a unix socket (of the "+
+					"form %s/path), but --endpoint was %q", client.UnixPrefix, address)
+			}
+			token, err := watchd.LoadOrCreateToken(tokenFile)
+			if err != nil {
+				return err
+			}
+			return watchd.Serve(socket, vizAddress, watchd.SystemClock, apiServer, token)
 		}),
 	}
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "If set, increase the logging verbosity to include every request/response")
+	for _, name := range []string{
+		"max-event-gap",
+		"min-counted-interval",
+		"label-min-counted-interval",
+		"max-watches",
+		"eviction-policy",
+		"watch-expiry-days",
+		"poll-interval",
+		"activity-detail",
+		"activity-retention-days",
+		"burst-threshold",
+		"viz-address",
+	} {
+		cmd.Flags().AddFlag(settingFlag(name))
+	}
 	return cmd
 }
 
@@ -338,8 +834,16 @@ func main() {
 			"distractable people use their time more mindfully",
 		Run: weekCmd().Run, // default cmd is 't week'
 	}
-	rootCmd.PersistentFlags().StringVar(&address, "endpoint", "localhost:9091",
-		"the address of a currently running time-tracker server")
+	rootCmd.Flags().BoolVar(&byLabel, "labels", false, "If set, color each day's bar by label, and print the time spent on each label")
+	rootCmd.PersistentFlags().AddFlag(settingFlag("endpoint"))
+	rootCmd.PersistentFlags().AddFlag(settingFlag("data-dir"))
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "",
+		"the config file to read (default: $"+configEnvVar+", or "+
+			"$XDG_CONFIG_HOME/time-tracker/config.yaml, or "+
+			"$HOME/.time-tracker/config.yaml)")
+	rootCmd.PersistentPreRunE = func(_ *cobra.Command, _ []string) error {
+		return loadConfig()
+	}
 	rootCmd.AddCommand(serveCmd())
 	rootCmd.AddCommand(statusCmd())
 	rootCmd.AddCommand(tickCmd())
@@ -347,6 +851,11 @@ func main() {
 	rootCmd.AddCommand(weekCmd())
 	rootCmd.AddCommand(todayCmd())
 	rootCmd.AddCommand(watchCmd())
+	rootCmd.AddCommand(unwatchCmd())
+	rootCmd.AddCommand(projectsCmd())
+	rootCmd.AddCommand(filesCmd())
+	rootCmd.AddCommand(dbCmd())
+	rootCmd.AddCommand(configCmd())
 
 	binaryName = os.Args[0]
 	if err := rootCmd.Execute(); err != nil {
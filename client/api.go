@@ -21,8 +21,89 @@ type WatchRequest struct {
 	// Label identifies the task associated with 'Dir'
 	Label string `json:"label"`
 
-	// Dir is the directory that the daemon should watch
+	// Dir is the directory that the daemon should watch. If 'Dir' contains
+	// existing watches, the new watch replaces them, and their labels are kept
+	// as label rules of the new watch.
 	Dir string `json:"dir"`
+
+	// Override determines what happens if 'Dir' is inside an existing watch: if
+	// true, a label rule is added to the existing watch, so that writes under
+	// 'Dir' are labeled 'Label'. Otherwise, the request fails.
+	Override bool `json:"override,omitempty"`
+
+	// Backend determines how 'Dir' is watched (one of BackendAuto,
+	// BackendInotify, BackendPoll, or BackendFanotify). "" is the same as
+	// BackendAuto
+	Backend string `json:"backend,omitempty"`
+
+	// BurstThreshold determines which writes under 'Dir' are counted as human
+	// edits: if more than BurstThreshold events arrive from one top-level
+	// subdirectory of 'Dir' within a second (e.g. because of 'git checkout'),
+	// they're tool activity, and aren't counted. If 0, the watch daemon's
+	// Config.BurstThreshold is used, and if negative, every event is counted
+	BurstThreshold int `json:"burst_threshold,omitempty"`
+}
+
+// The backends that may be set in WatchRequest.Backend
+const (
+	// BackendAuto polls directories on network and FUSE filesystems (on which
+	// inotify doesn't observe every write), and uses inotify otherwise
+	BackendAuto = "auto"
+
+	// BackendInotify watches directories with inotify
+	BackendInotify = "inotify"
+
+	// BackendPoll periodically walks the watched directory, and compares each
+	// file's size and modification time to those seen in the previous walk (see
+	// Config.PollInterval)
+	BackendPoll = "poll"
+
+	// BackendFanotify watches the whole filesystem containing the watched
+	// directory with fanotify, which (unlike inotify) doesn't need a watch per
+	// directory, so it can watch directory trees of any size. It requires the
+	// watch daemon to have CAP_SYS_ADMIN; if it doesn't, inotify is used
+	// instead (see WatchInfo.ActiveBackend)
+	BackendFanotify = "fanotify"
+)
+
+// UnwatchRequest is the request object sent to the /unwatch endpoint, to
+// indicate that the watch daemon should stop watching a directory
+type UnwatchRequest struct {
+	// Dir is the watched directory (exactly as it appears in WatchInfo.Dir)
+	Dir string `json:"dir"`
+}
+
+// UpdateWatchRequest is the request object sent to the /watch/update endpoint,
+// to change the label recorded with future writes to a watched directory.
+// Writes that have already been recorded keep their label.
+type UpdateWatchRequest struct {
+	// Dir is the watched directory (exactly as it appears in WatchInfo.Dir)
+	Dir string `json:"dir"`
+
+	// Label is the directory's new label
+	Label string `json:"label"`
+}
+
+// AddLabelRuleRequest is the request object sent to the /watch/rules/add
+// endpoint, to add a label rule to a watch (or replace the watch's existing
+// rule with the same path)
+type AddLabelRuleRequest struct {
+	// Dir is the watched directory (exactly as it appears in WatchInfo.Dir)
+	Dir string `json:"dir"`
+
+	// Rule is the label rule to add
+	Rule LabelRule `json:"rule"`
+}
+
+// RemoveLabelRuleRequest is the request object sent to the
+// /watch/rules/remove endpoint, to delete one of a watch's label rules
+type RemoveLabelRuleRequest struct {
+	// Dir is the watched directory (exactly as it appears in WatchInfo.Dir)
+	Dir string `json:"dir"`
+
+	// Path is the path of the rule to delete (exactly as it appears in
+	// LabelRule.Path)
+	Path string `json:"path"`
 }
 
 // GetIntervalsRequest is the object sent to the /intervals endpoint.
@@ -32,6 +113,11 @@ type GetIntervalsRequest struct {
 	// truncated.
 	Start int64 `json:"start"`
 	End   int64 `json:"end"`
+
+	// Labeled indicates that the caller also wants the intervals associated with
+	// each individual label (returned in GetIntervalsResponse.Labeled), and not
+	// just the union of all intervals
+	Labeled bool `json:"labeled"`
 }
 
 // Interval represents a time interval in which the caller was working. Used in
@@ -55,12 +141,34 @@ type GetIntervalsResponse struct {
 	// this range).
 	Intervals []Interval `json:"intervals"`
 
+	// Labeled maps each label that was active in [req.Start, req.End] to the
+	// intervals in which it was active (truncated the same way as 'Intervals').
+	// Intervals with different labels may overlap (when work switches from one
+	// label to another, the new label's interval starts at the previous label's
+	// last tick). Only set if req.Labeled is true.
+	Labeled map[string][]Interval `json:"labeled,omitempty"`
+
 	// EndGap is the amount of time (in seconds) added to the last interval in
 	// 'Intervals', reflecting where the interval would end if a tick were sent
 	// now.
 	EndGap int64 `json:"end_gap"`
 }
 
+// LabelRule overrides the label of writes in part of a watched directory
+type LabelRule struct {
+	// Path identifies the files to which the rule applies, relative to the
+	// watched directory. It may be a glob (as in path.Match, plus "**", which
+	// matches any number of directories, e.g. "services/billing/**" or
+	// "**/*.md"). A rule applies to every file that its path matches, and to
+	// every file under a directory that its path matches. If several of a
+	// watch's rules apply to a write, the most specific one (the one whose path
+	// has the most non-wildcard characters) wins.
+	Path string `json:"path"`
+
+	// Label is recorded with every write under 'Path'
+	Label string `json:"label"`
+}
+
 // GetWatchesRequest is the request object sent to the /watches endpoint.
 type GetWatchesRequest struct{}
 
@@ -75,19 +183,282 @@ type WatchInfo struct {
 
 	// Label is the label associated with this watch
 	Label string `json:"label"`
+
+	// Rules override 'Label' for parts of 'Dir', sorted by path
+	Rules []*LabelRule `json:"rules,omitempty"`
+
+	// Status is the health of the watch (one of WatchHealthy, WatchDegraded, or
+	// WatchFailed), and StatusReason explains why it isn't healthy, if it isn't
+	Status       string `json:"status"`
+	StatusReason string `json:"status_reason,omitempty"`
+
+	// Backend is the backend requested for the watch (see WatchRequest.Backend),
+	// and ActiveBackend is the one in use (BackendInotify, BackendPoll, or
+	// BackendFanotify)
+	Backend       string `json:"backend"`
+	ActiveBackend string `json:"active_backend,omitempty"`
+
+	// BurstThreshold is the burst threshold requested for the watch (see
+	// WatchRequest.BurstThreshold)
+	BurstThreshold int `json:"burst_threshold,omitempty"`
 }
 
+// The statuses that may be reported in WatchInfo.Status
+const (
+	// WatchHealthy indicates that every directory under WatchInfo.Dir is watched
+	WatchHealthy = "healthy"
+
+	// WatchDegraded indicates that some directories under WatchInfo.Dir couldn't
+	// be watched (e.g. because the inotify watch limit was reached). Writes to
+	// the directories that are watched are still recorded
+	WatchDegraded = "degraded"
+
+	// WatchFailed indicates that the watch stopped (e.g. because WatchInfo.Dir
+	// was deleted), so no writes under WatchInfo.Dir are being recorded
+	WatchFailed = "failed"
+)
+
 // GetWatchesResponse indicates all currently-watched directories
 type GetWatchesResponse struct {
 	// TODO(msteffen): should these be pointers or raw values?
 	Watches []*WatchInfo
 }
 
+// ProjectInfo describes a project (i.e. a label) known to the watch daemon
+type ProjectInfo struct {
+	// ID is the project's stable identifier, which doesn't change if the
+	// project is renamed
+	ID int64 `json:"id"`
+
+	// Name is the project's current name (the label attached to its ticks)
+	Name string `json:"name"`
+}
+
+// GetProjectsRequest is the request object sent to the /projects endpoint.
+type GetProjectsRequest struct{}
+
+// GetProjectsResponse lists all projects known to the watch daemon, sorted by
+// name
+type GetProjectsResponse struct {
+	Projects []*ProjectInfo `json:"projects"`
+}
+
+// RenameProjectRequest is the request object sent to the /projects/rename
+// endpoint, to change the name of a project (without changing its history)
+type RenameProjectRequest struct {
+	// From is the project's current name
+	From string `json:"from"`
+
+	// To is the project's new name. There must not be another project with this
+	// name already (use MergeProjects to combine two projects)
+	To string `json:"to"`
+}
+
+// MergeProjectsRequest is the request object sent to the /projects/merge
+// endpoint, to fold all of the history and watches of one project into another
+type MergeProjectsRequest struct {
+	// From is the name of the project being merged. It's deleted by the merge
+	From string `json:"from"`
+
+	// Into is the name of the project that will receive From's history
+	Into string `json:"into"`
+}
+
+// GetConfigRequest is the request object sent to the /config endpoint.
+type GetConfigRequest struct{}
+
+// LabelConfig contains settings that override the corresponding fields of
+// Config for a single label. Zero-valued fields are not overridden.
+type LabelConfig struct {
+	// MinCountedInterval overrides Config.MinCountedInterval for intervals in
+	// which this label was active
+	MinCountedInterval int64 `json:"min_counted_interval,omitempty"`
+}
+
+// Config contains the watch daemon's settings, including those that determine
+// what counts as work (so that all clients agree on it). It's returned by the
+// /config endpoint.
+type Config struct {
+	// MaxEventGap is the maximum amount of time (in seconds) that may elapse
+	// between two ticks for them to be part of the same interval. Ticks are
+	// folded into intervals as they arrive, so changing it only affects ticks
+	// recorded afterwards (existing intervals aren't re-split or re-merged)
+	MaxEventGap int64 `json:"max_event_gap"`
+
+	// MinCountedInterval is the minimum length (in seconds) of an interval for
+	// it to count as work (shorter intervals are displayed, but not counted)
+	MinCountedInterval int64 `json:"min_counted_interval"`
+
+	// Labels maps labels to settings that override the settings above for that
+	// label
+	Labels map[string]*LabelConfig `json:"labels,omitempty"`
+
+	// MaxWatches is the maximum number of watches that may exist concurrently.
+	// If 0, the number of watches is unlimited (though the kernel still limits
+	// the number of directories that may be watched; see
+	// /proc/sys/fs/inotify/max_user_watches)
+	MaxWatches int `json:"max_watches"`
+
+	// EvictionPolicy determines which watches the watch daemon removes
+	// automatically (one of EvictLRU, EvictNever, or EvictExpire)
+	EvictionPolicy string `json:"eviction_policy"`
+
+	// WatchExpiry is how long (in seconds) a watch may go without writes before
+	// it's evicted, if EvictionPolicy is EvictExpire
+	WatchExpiry int64 `json:"watch_expiry,omitempty"`
+
+	// PollInterval is how often (in seconds) watches using BackendPoll walk
+	// their directories
+	PollInterval int64 `json:"poll_interval"`
+
+	// ActivityDetail, if true, causes the watch daemon to record which files
+	// were written, and not just which labels were active (see GetActivity).
+	// ActivityRetention is how long (in seconds) those records are kept
+	ActivityDetail    bool  `json:"activity_detail"`
+	ActivityRetention int64 `json:"activity_retention,omitempty"`
+
+	// BurstThreshold is the number of events per second from one subdirectory
+	// of a watched dir beyond which the events are tool activity rather than
+	// human edits, and aren't counted, unless the watch sets its own (see
+	// WatchRequest.BurstThreshold). If 0, every event is counted
+	BurstThreshold int `json:"burst_threshold"`
+
+	// TickSyncFrequency is how often (in seconds) each watch records any writes
+	// it has observed as a tick, and WatchSyncFrequency is how often (in seconds)
+	// the watch daemon aligns its watches with the watches in its DB
+	TickSyncFrequency  int64 `json:"tick_sync_frequency"`
+	WatchSyncFrequency int64 `json:"watch_sync_frequency"`
+}
+
+// The eviction policies that may be set in Config.EvictionPolicy
+const (
+	// EvictLRU evicts the watches with the least recent writes whenever there
+	// are more than Config.MaxWatches watches
+	EvictLRU = "lru"
+
+	// EvictNever never evicts watches. Instead, requests to add watches beyond
+	// Config.MaxWatches fail
+	EvictNever = "never"
+
+	// EvictExpire evicts watches that have had no writes for
+	// Config.WatchExpiry seconds. As with EvictNever, requests to add watches
+	// beyond Config.MaxWatches fail
+	EvictExpire = "expire"
+)
+
+// Eviction records that the watch daemon removed a watch automatically (see
+// Config.EvictionPolicy)
+type Eviction struct {
+	// Dir is the directory that was being watched
+	Dir string `json:"dir"`
+
+	// Label is the label of the evicted watch
+	Label string `json:"label"`
+
+	// Time is when the watch was evicted, as seconds since epoch
+	Time int64 `json:"time"`
+
+	// Reason describes why the watch was evicted
+	Reason string `json:"reason"`
+}
+
+// GetEvictionsRequest is the request object sent to the /watches/evictions
+// endpoint
+type GetEvictionsRequest struct{}
+
+// GetEvictionsResponse lists the watches that the watch daemon has evicted,
+// most recent first
+type GetEvictionsResponse struct {
+	Evictions []*Eviction `json:"evictions"`
+}
+
+// GetActivityRequest is the request object sent to the /activity endpoint
+type GetActivityRequest struct {
+	// The time period (as seconds since epoch) in which the returned files were
+	// written
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// FileActivity describes the writes to a single file (recorded if
+// Config.ActivityDetail is set)
+type FileActivity struct {
+	// Label is the label with which the writes were recorded
+	Label string `json:"label"`
+
+	// Path is the absolute path of the file
+	Path string `json:"path"`
+
+	// Edits is the number of times that writes to the file were recorded (writes
+	// are recorded at most once every Config.TickSyncFrequency seconds, so a
+	// burst of writes counts as one edit), and LastEdit is the time of the most
+	// recent one (secs since Unix epoch)
+	Edits    int64 `json:"edits"`
+	LastEdit int64 `json:"last_edit"`
+}
+
+// GetActivityResponse lists the files written in the requested time period,
+// sorted by label and then by number of edits (most edited first)
+type GetActivityResponse struct {
+	Files []*FileActivity `json:"files"`
+}
+
+// The types of Event pushed by the /events endpoint
+const (
+	// EventTick is sent whenever a tick is recorded (by /tick, or by a watch
+	// that observed a write)
+	EventTick = "tick"
+
+	// EventInterval is sent whenever a tick extends the in-progress interval
+	// (i.e. the interval containing the tick started before it)
+	EventInterval = "interval"
+
+	// EventWatch is sent whenever a watch is added, removed (e.g. evicted), or
+	// changed (e.g. relabeled, or its status changed)
+	EventWatch = "watch"
+)
+
+// Event is pushed by the /events endpoint whenever the watch daemon's data
+// changes, so that clients can update what they display without polling
+type Event struct {
+	// Type is one of the Event* constants
+	Type string `json:"type"`
+
+	// Time is when the event occurred (for EventTick and EventInterval, when
+	// the tick was recorded), as secs since Unix epoch
+	Time int64 `json:"time"`
+
+	// Label is the label of the tick (EventTick and EventInterval) or of the
+	// watch (EventWatch)
+	Label string `json:"label,omitempty"`
+
+	// Dir is the watched directory (EventWatch only)
+	Dir string `json:"dir,omitempty"`
+
+	// Interval is the in-progress interval (of all labels), ending at the tick
+	// (EventInterval only)
+	Interval *Interval `json:"interval,omitempty"`
+}
+
 // TimeTrackerAPI is the interface exported by the watch daemon
 type TimeTrackerAPI interface {
 	Watch(req *WatchRequest) error
+	Unwatch(req *UnwatchRequest) error
+	UpdateWatch(req *UpdateWatchRequest) error
+	AddLabelRule(req *AddLabelRuleRequest) error
+	RemoveLabelRule(req *RemoveLabelRuleRequest) error
 	GetWatches(req *GetWatchesRequest) (*GetWatchesResponse, error)
+	GetEvictions(req *GetEvictionsRequest) (*GetEvictionsResponse, error)
 	Tick(req *TickRequest) (*TickResponse, error)
 	GetIntervals(req *GetIntervalsRequest) (*GetIntervalsResponse, error)
+	GetActivity(req *GetActivityRequest) (*GetActivityResponse, error)
+	GetProjects(req *GetProjectsRequest) (*GetProjectsResponse, error)
+	RenameProject(req *RenameProjectRequest) error
+	MergeProjects(req *MergeProjectsRequest) error
+	GetConfig(req *GetConfigRequest) (*Config, error)
 	Clear() error
+
+	// Subscribe returns a channel that receives every Event until 'done' is
+	// closed (at which point the channel is closed)
+	Subscribe(done <-chan struct{}) (<-chan *Event, error)
 }
@@ -1,13 +1,17 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,6 +23,43 @@ func (i Interval) String() string {
 	return fmt.Sprintf("[%s starting %s (%s)]", duration, start, i.Label)
 }
 
+// MinCountedIntervalFor returns the minimum length (in seconds) of an interval
+// in which 'label' was active for it to count as work (left out of api.go for
+// the same reason as Interval.String)
+func (c *Config) MinCountedIntervalFor(label string) int64 {
+	if lc, ok := c.Labels[label]; ok && lc.MinCountedInterval > 0 {
+		return lc.MinCountedInterval
+	}
+	return c.MinCountedInterval
+}
+
+// MinCountedIntervalIn returns the minimum length (in seconds) that the
+// interval 'i' (an element of GetIntervalsResponse.Intervals) must have to
+// count as work. 'labeled' is GetIntervalsResponse.Labeled (which may be nil,
+// in which case per-label settings are ignored). If several labels were active
+// during 'i', the smallest of their minimum counted intervals applies.
+func (c *Config) MinCountedIntervalIn(i Interval, labeled map[string][]Interval) int64 {
+	min, found := c.MinCountedInterval, false
+	for label, intervals := range labeled {
+		for _, li := range intervals {
+			if li.Start <= i.End && i.Start <= li.End {
+				if m := c.MinCountedIntervalFor(label); !found || m < min {
+					min, found = m, true
+				}
+				break
+			}
+		}
+	}
+	return min
+}
+
+// Counts returns true if the interval 'i' (an element of
+// GetIntervalsResponse.Intervals) is long enough to count as work (see
+// MinCountedIntervalIn)
+func (c *Config) Counts(i Interval, labeled map[string][]Interval) bool {
+	return i.End-i.Start >= c.MinCountedIntervalIn(i, labeled)
+}
+
 // HTTPError represents an error returned by an HTTP service
 type HTTPError struct {
 	StatusCode int
@@ -29,11 +70,62 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("(%d/%s) %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
 }
 
+// UnixPrefix is the prefix of Client addresses that identify a unix socket
+// (e.g. "unix:///home/user/.time-tracker/sock") rather than a TCP hostport
+const UnixPrefix = "unix://"
+
+// AuthScheme is the scheme of the Authorization header that clients use to
+// send the watch daemon's token (i.e. "Authorization: Bearer <token>")
+const AuthScheme = "Bearer"
+
 // Client is a an HTTP client wrapper, with convenience functions for Get and
 // Post requests sent to paths under a single destination. It also wraps non-200
 // http responses in an error.
 type Client struct {
+	// Address is either a TCP hostport (e.g. "localhost:9091") or a unix socket
+	// (e.g. "unix:///home/user/.time-tracker/sock")
 	Address string
+
+	// Token is the watch daemon's secret, which it requires for all requests
+	// except those to its public endpoints (e.g. /viz). It's sent in the
+	// Authorization header of every request
+	Token string
+
+	// httpClient sends all of this client's requests. It's initialized (based
+	// on 'Address') on first use, guarded by 'httpClientOnce'
+	httpClient     *http.Client
+	httpClientOnce sync.Once
+}
+
+// SocketPath returns the path of the unix socket identified by 'address', and
+// false if 'address' isn't a unix socket address
+func SocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, UnixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, UnixPrefix), true
+}
+
+// http returns the http.Client that sends this client's requests. If the
+// client's address is a unix socket, the http.Client connects to the socket
+// regardless of the URL being requested
+func (c *Client) http() *http.Client {
+	c.httpClientOnce.Do(func() {
+		socket, ok := SocketPath(c.Address)
+		if !ok {
+			c.httpClient = http.DefaultClient
+			return
+		}
+		c.httpClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	})
+	return c.httpClient
 }
 
 // url converts the API endpoint 'address' into a pseudo-URL that the golang
@@ -42,7 +134,11 @@ type Client struct {
 // ignored when communicating over a unix socket, so we provide a standard
 // throwaway domain of "socket"
 func (c *Client) url(path string) string {
-	return "http://" + c.Address + "/" + strings.TrimPrefix(path, "/")
+	host := c.Address
+	if _, ok := SocketPath(c.Address); ok {
+		host = "socket"
+	}
+	return "http://" + host + "/" + strings.TrimPrefix(path, "/")
 }
 
 func httpRespToError(resp *http.Response, err error) (*http.Response, error) {
@@ -63,25 +159,44 @@ func httpRespToError(resp *http.Response, err error) (*http.Response, error) {
 	return resp, err
 }
 
+// do sends a request with the method 'method' and the body 'body' (which may
+// be nil) to 'path', authenticated with the client's token
+func (c *Client) do(method, path string, body io.Reader) (*http.Response, error) {
+	return c.doWithContext(context.Background(), method, path, body)
+}
+
+// doWithContext is like do, but the request is cancelled if 'ctx' is
+func (c *Client) doWithContext(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", AuthScheme+" "+c.Token)
+	}
+	return httpRespToError(c.http().Do(req))
+}
+
 // Get is a convenience function for Get requests, that sends all such
 // requests to the client's socket path/URL.
 func (c *Client) Get(path string) (*http.Response, error) {
-	return httpRespToError(http.DefaultClient.Get(c.url(path)))
+	return c.do("GET", path, nil)
 }
 
 // PostString is a convenience function for Post requests, that sends all such
 // requests to the client's socket path/URL.
 func (c *Client) PostString(address string, body string) (*http.Response, error) {
-	r := strings.NewReader(body)
-	return httpRespToError(
-		http.DefaultClient.Post(c.url(address), "application/json", r))
+	return c.do("POST", address, strings.NewReader(body))
 }
 
 // Post is a convenience function for Post requests, that sends all such
 // requests to the client's socket path/URL.
 func (c *Client) Post(address string, body io.Reader) (*http.Response, error) {
-	return httpRespToError(
-		http.DefaultClient.Post(c.url(address), "application/json", body))
+	return c.do("POST", address, body)
 }
 
 func (c *Client) Status() (time.Duration, error) {
@@ -123,8 +238,18 @@ func (c *Client) Tick(label string) (int64, error) {
 
 // GetIntervals is a convenience function that wraps the /intervals URL endpoint
 func (c *Client) GetIntervals(start, end time.Time) (*GetIntervalsResponse, error) {
-	resp, err := c.Get(
-		fmt.Sprintf("/intervals?start=%d&end=%d", start.Unix(), end.Unix()))
+	return c.getIntervals(start, end, false)
+}
+
+// GetLabeledIntervals is like GetIntervals, but also retrieves the intervals
+// associated with each label (in GetIntervalsResponse.Labeled)
+func (c *Client) GetLabeledIntervals(start, end time.Time) (*GetIntervalsResponse, error) {
+	return c.getIntervals(start, end, true)
+}
+
+func (c *Client) getIntervals(start, end time.Time, labeled bool) (*GetIntervalsResponse, error) {
+	resp, err := c.Get(fmt.Sprintf("/intervals?start=%d&end=%d&labeled=%t",
+		start.Unix(), end.Unix(), labeled))
 	if err != nil {
 		return nil, err
 	}
@@ -137,12 +262,64 @@ func (c *Client) GetIntervals(start, end time.Time) (*GetIntervalsResponse, erro
 }
 
 func (c *Client) Watch(dir, label string) error {
+	return c.WatchWithOverride(dir, label, false)
+}
+
+// WatchWithOverride is like Watch, but if 'override' is set and 'dir' is inside
+// an existing watch, a label rule for 'dir' is added to the existing watch (see
+// WatchRequest.Override)
+func (c *Client) WatchWithOverride(dir, label string, override bool) error {
+	return c.WatchWithRequest(&WatchRequest{Dir: dir, Label: label, Override: override})
+}
+
+// WatchWithRequest POSTs 'req' to the /watch URL endpoint, for requests that
+// Watch and WatchWithOverride can't express (e.g. ones that set
+// WatchRequest.Backend)
+func (c *Client) WatchWithRequest(req *WatchRequest) error {
 	buf := bytes.Buffer{}
-	json.NewEncoder(&buf).Encode(WatchRequest{Dir: dir, Label: label})
+	json.NewEncoder(&buf).Encode(req)
 	_, err := c.Post("/watch", &buf)
 	return err
 }
 
+// Unwatch is a convenience function that POSTs to the /unwatch URL endpoint
+func (c *Client) Unwatch(dir string) error {
+	buf := bytes.Buffer{}
+	json.NewEncoder(&buf).Encode(UnwatchRequest{Dir: dir})
+	_, err := c.Post("/unwatch", &buf)
+	return err
+}
+
+// UpdateWatch is a convenience function that POSTs to the /watch/update URL
+// endpoint
+func (c *Client) UpdateWatch(dir, label string) error {
+	buf := bytes.Buffer{}
+	json.NewEncoder(&buf).Encode(UpdateWatchRequest{Dir: dir, Label: label})
+	_, err := c.Post("/watch/update", &buf)
+	return err
+}
+
+// AddLabelRule is a convenience function that POSTs to the /watch/rules/add
+// URL endpoint
+func (c *Client) AddLabelRule(dir, path, label string) error {
+	buf := bytes.Buffer{}
+	json.NewEncoder(&buf).Encode(AddLabelRuleRequest{
+		Dir:  dir,
+		Rule: LabelRule{Path: path, Label: label},
+	})
+	_, err := c.Post("/watch/rules/add", &buf)
+	return err
+}
+
+// RemoveLabelRule is a convenience function that POSTs to the
+// /watch/rules/remove URL endpoint
+func (c *Client) RemoveLabelRule(dir, path string) error {
+	buf := bytes.Buffer{}
+	json.NewEncoder(&buf).Encode(RemoveLabelRuleRequest{Dir: dir, Path: path})
+	_, err := c.Post("/watch/rules/remove", &buf)
+	return err
+}
+
 func (c *Client) GetWatches() (*GetWatchesResponse, error) {
 	resp, err := c.Get("/watches")
 	if err != nil {
@@ -156,7 +333,126 @@ func (c *Client) GetWatches() (*GetWatchesResponse, error) {
 	return &watches, nil
 }
 
+// GetEvictions is a convenience function that wraps the /watches/evictions URL
+// endpoint
+func (c *Client) GetEvictions() (*GetEvictionsResponse, error) {
+	resp, err := c.Get("/watches/evictions")
+	if err != nil {
+		return nil, err
+	}
+
+	var evictions GetEvictionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&evictions); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	return &evictions, nil
+}
+
+// GetActivity is a convenience function that wraps the /activity URL endpoint
+func (c *Client) GetActivity(start, end time.Time) (*GetActivityResponse, error) {
+	resp, err := c.Get(fmt.Sprintf("/activity?start=%d&end=%d", start.Unix(), end.Unix()))
+	if err != nil {
+		return nil, err
+	}
+
+	var activity GetActivityResponse
+	if err := json.NewDecoder(resp.Body).Decode(&activity); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	return &activity, nil
+}
+
+// GetProjects is a convenience function that wraps the /projects URL endpoint
+func (c *Client) GetProjects() (*GetProjectsResponse, error) {
+	resp, err := c.Get("/projects")
+	if err != nil {
+		return nil, err
+	}
+
+	var projects GetProjectsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&projects); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	return &projects, nil
+}
+
+// RenameProject is a convenience function that POSTs to the /projects/rename
+// URL endpoint
+func (c *Client) RenameProject(from, to string) error {
+	buf := bytes.Buffer{}
+	json.NewEncoder(&buf).Encode(RenameProjectRequest{From: from, To: to})
+	_, err := c.Post("/projects/rename", &buf)
+	return err
+}
+
+// MergeProjects is a convenience function that POSTs to the /projects/merge
+// URL endpoint
+func (c *Client) MergeProjects(from, into string) error {
+	buf := bytes.Buffer{}
+	json.NewEncoder(&buf).Encode(MergeProjectsRequest{From: from, Into: into})
+	_, err := c.Post("/projects/merge", &buf)
+	return err
+}
+
+// GetConfig is a convenience function that wraps the /config URL endpoint
+func (c *Client) GetConfig() (*Config, error) {
+	resp, err := c.Get("/config")
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	return &config, nil
+}
+
 func (c *Client) Clear() (retErr error) {
 	_, err := c.PostString("/clear", `{"confirm":"yes"}`)
 	return err
 }
+
+// Subscribe is a convenience function that wraps the /events URL endpoint. The
+// returned channel receives each event sent by the server, and is closed once
+// 'ctx' is cancelled or the connection to the server is lost
+func (c *Client) Subscribe(ctx context.Context) (<-chan *Event, error) {
+	resp, err := c.doWithContext(ctx, "GET", "/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		// Parse the server-sent event stream: each event is a block of
+		// "field: value" lines followed by a blank line. The server sends each
+		// event's JSON as its "data" field (and ignores the others)
+		var data bytes.Buffer
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line != "" {
+				if strings.HasPrefix(line, "data:") {
+					data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+				}
+				continue
+			}
+			if data.Len() == 0 {
+				continue
+			}
+			var e Event
+			err := json.Unmarshal(data.Bytes(), &e)
+			data.Reset()
+			if err != nil {
+				continue // not an event this client understands
+			}
+			select {
+			case events <- &e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
@@ -1,6 +1,7 @@
 // escape provides a generic way to encode sequences of strings as a single
-// string. The watch daemon happens to use it to encode each tick's labels in
-// single column in SQLite
+// string. Older versions of the watch daemon used it to encode each tick's
+// labels in single column in SQLite; the watch daemon now only uses it to
+// decode data written by those versions
 
 package escape
 
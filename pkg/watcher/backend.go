@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// The backends that may be set in Options.Backend
+const (
+	// BackendAuto uses BackendPoll for directories on filesystems that don't
+	// support inotify (see DetectBackend), and BackendInotify otherwise
+	BackendAuto = "auto"
+
+	// BackendInotify watches directories with inotify (see 'man 7 inotify')
+	BackendInotify = "inotify"
+
+	// BackendPoll periodically walks the watched tree, and compares each file's
+	// size and modification time to those seen in the previous walk. It works
+	// on any filesystem, but is slower to notice writes, and more expensive
+	BackendPoll = "poll"
+
+	// BackendFanotify watches the whole filesystem containing the watched tree
+	// with fanotify (see 'man 7 fanotify'), and ignores events outside of the
+	// tree. Unlike BackendInotify, it doesn't need a watch per directory, so
+	// it can watch trees of any size. It requires CAP_SYS_ADMIN (and Linux
+	// 5.1+); if it's unavailable, BackendInotify is used instead
+	BackendFanotify = "fanotify"
+)
+
+// pollFilesystems maps the magic numbers (see 'man 2 statfs') of filesystems
+// on which inotify doesn't observe all writes (i.e. network filesystems, whose
+// files may be written by other machines, and FUSE filesystems, which may not
+// generate inotify events at all) to their names
+var pollFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x73757245: "coda",
+	0x5346414f: "afs",
+	0x00c36400: "ceph",
+}
+
+// DetectBackend returns the backend that BackendAuto uses for 'path':
+// BackendPoll if 'path' is on a network or FUSE filesystem, and
+// BackendInotify otherwise
+func DetectBackend(path string) (string, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return "", fmt.Errorf("could not Statfs() %q: %v", path, err)
+	}
+	if _, ok := pollFilesystems[uint32(stat.Type)]; ok {
+		return BackendPoll, nil
+	}
+	return BackendInotify, nil
+}
@@ -0,0 +1,385 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	p "path"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fanotify constants that golang.org/x/sys/unix doesn't define yet (see
+// linux/fanotify.h)
+const (
+	fanReportDirFID          = 0x400
+	fanReportName            = 0x800
+	fanReportDFIDName        = fanReportDirFID | fanReportName
+	fanEventInfoTypeFID      = 1
+	fanEventInfoTypeDFIDName = 2
+
+	// fanEventInfoHeaderLen is the size of the fixed-length part of a struct
+	// fanotify_event_info_fid (header and fsid) plus that of the struct
+	// file_handle that follows it (handle_bytes and handle_type)
+	fanEventInfoHeaderLen = 4 + 8 + 4 + 4
+)
+
+const (
+	// fanotifyMask is the set of events that fanotifyWatcher listens for, if
+	// the kernel supports FAN_REPORT_DFID_NAME (Linux 5.9+)
+	fanotifyMask = unix.FAN_MODIFY | unix.FAN_CREATE | unix.FAN_DELETE |
+		unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO | unix.FAN_ONDIR
+
+	// fanotifyFIDMask is the set of events that fanotifyWatcher listens for
+	// with FAN_REPORT_FID alone (Linux 5.1+). Without names, directory entry
+	// events (create, delete, etc) only identify the directory that changed,
+	// so only writes to files are observed
+	fanotifyFIDMask = unix.FAN_MODIFY
+
+	// fanotifyBufSz is the size of the buffer that fanotify events are read
+	// into (fanotify never returns partial events, so it must be large enough
+	// to hold at least one event with a file handle and a name)
+	fanotifyBufSz = 64 * 1024
+)
+
+// fanotifyInit is unix.FanotifyInit (tests replace it to simulate missing
+// capabilities)
+var fanotifyInit = unix.FanotifyInit
+
+// fanotifyEvent is a single parsed fanotify event
+type fanotifyEvent struct {
+	// mask contains the event's type bits (FAN_MODIFY, FAN_ONDIR, etc)
+	mask uint64
+
+	// handle identifies the modified file (with FAN_REPORT_FID) or its parent
+	// directory (with FAN_REPORT_DFID_NAME), if hasHandle is true
+	handle    unix.FileHandle
+	hasHandle bool
+
+	// name is the name of the modified file within the directory identified by
+	// 'handle' ("" with FAN_REPORT_FID)
+	name string
+}
+
+// parseFanotifyEvents parses the fanotify events in 'buf'
+func parseFanotifyEvents(buf []byte) ([]fanotifyEvent, error) {
+	var result []fanotifyEvent
+	for len(buf) >= unix.FAN_EVENT_METADATA_LEN {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if meta.Vers != unix.FANOTIFY_METADATA_VERSION {
+			return nil, fmt.Errorf("unsupported fanotify metadata version %d", meta.Vers)
+		}
+		if int(meta.Event_len) > len(buf) || meta.Event_len < uint32(meta.Metadata_len) {
+			return nil, fmt.Errorf("malformed fanotify event (length %d of %d bytes)",
+				meta.Event_len, len(buf))
+		}
+		if meta.Fd >= 0 {
+			unix.Close(int(meta.Fd)) // only sent without FAN_REPORT_FID
+		}
+		e := fanotifyEvent{mask: meta.Mask}
+
+		// Per man 7 fanotify, with FAN_REPORT_FID (or FAN_REPORT_DFID_NAME), the
+		// metadata is followed by info records, each of which is a struct
+		// fanotify_event_info_fid: a header (type, padding, and length), the
+		// filesystem ID, and a struct file_handle. With FAN_REPORT_DFID_NAME, the
+		// handle is followed by the null-terminated name of the file within the
+		// directory identified by the handle
+		info := buf[meta.Metadata_len:meta.Event_len]
+		for len(info) >= fanEventInfoHeaderLen {
+			infoType := info[0]
+			infoLen := int(*(*uint16)(unsafe.Pointer(&info[2])))
+			if infoLen < fanEventInfoHeaderLen || infoLen > len(info) {
+				return nil, fmt.Errorf("malformed fanotify event info (length %d of %d bytes)",
+					infoLen, len(info))
+			}
+			if infoType == fanEventInfoTypeFID || infoType == fanEventInfoTypeDFIDName {
+				handleLen := int(*(*uint32)(unsafe.Pointer(&info[12])))
+				handleType := *(*int32)(unsafe.Pointer(&info[16]))
+				if fanEventInfoHeaderLen+handleLen > infoLen {
+					return nil, fmt.Errorf("malformed fanotify file handle (length %d of %d bytes)",
+						handleLen, infoLen-fanEventInfoHeaderLen)
+				}
+				handleEnd := fanEventInfoHeaderLen + handleLen
+				e.handle = unix.NewFileHandle(handleType, info[fanEventInfoHeaderLen:handleEnd])
+				e.hasHandle = true
+				if infoType == fanEventInfoTypeDFIDName {
+					name := info[handleEnd:infoLen]
+					for i, b := range name {
+						if b == 0 {
+							name = name[:i]
+							break
+						}
+					}
+					e.name = string(name)
+				}
+			}
+			info = info[infoLen:]
+		}
+		result = append(result, e)
+		buf = buf[meta.Event_len:]
+	}
+	return result, nil
+}
+
+// fanotifyWatcher implements BackendFanotify. Like fileWatcher, it's not a
+// concurrent data structure
+type fanotifyWatcher struct {
+	// rootDir is root directory being watched
+	rootDir string
+
+	// fanFD is the fanotify file descriptor from which events are read, and
+	// mountFD is an open file descriptor on the watched filesystem, which is
+	// needed to resolve the file handles in fanotify events
+	fanFD, mountFD int
+
+	// reportNames is true if fanFD was created with FAN_REPORT_DFID_NAME (and
+	// false if it was created with FAN_REPORT_FID)
+	reportNames bool
+
+	// cb is the callback that 'w' calls with every event
+	cb func(WatchEvent) error
+
+	// doneCtx, when cancelled, causes the watch to exit
+	doneCtx context.Context
+
+	// ignore and gitIgnore determine which files 'w' ignores (as in
+	// fileWatcher)
+	ignore    []Matcher
+	gitIgnore *GitIgnore
+
+	// onStatus, if set, is called once the watch has been established (a
+	// fanotify watch is never degraded)
+	onStatus func(Status)
+}
+
+// newFanotifyWatcher sets up a fanotify watch on the filesystem containing
+// 'path'. It returns an error if fanotify is unavailable (e.g. because the
+// process lacks CAP_SYS_ADMIN, or the kernel or filesystem doesn't support
+// FAN_MARK_FILESYSTEM)
+func newFanotifyWatcher(ctx context.Context, path string, opts Options, cb func(WatchEvent) error) (*fanotifyWatcher, error) {
+	const initFlags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_NONBLOCK
+	mask, reportNames := uint64(fanotifyMask), true
+	fd, err := fanotifyInit(initFlags|fanReportDFIDName, unix.O_RDONLY)
+	if err == unix.EINVAL {
+		// the kernel predates FAN_REPORT_DFID_NAME
+		mask, reportNames = fanotifyFIDMask, false
+		fd, err = fanotifyInit(initFlags|unix.FAN_REPORT_FID, unix.O_RDONLY)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize fanotify: %v", err)
+	}
+	if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM,
+		mask, unix.AT_FDCWD, path); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not watch filesystem containing %q: %v", path, err)
+	}
+	mountFD, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not open %q: %v", path, err)
+	}
+	w := &fanotifyWatcher{
+		rootDir:     path,
+		fanFD:       fd,
+		mountFD:     mountFD,
+		reportNames: reportNames,
+		cb:          cb,
+		doneCtx:     ctx,
+		ignore:      opts.Ignore,
+		onStatus:    opts.OnStatus,
+	}
+	if opts.GitIgnore {
+		w.gitIgnore = NewGitIgnore(path)
+	}
+	return w, nil
+}
+
+// ignored returns true if the file at 'path' (an absolute path under
+// w.rootDir), or any of its parents, is ignored. Unlike fileWatcher, which
+// never watches ignored directories, w sees events in them, so their
+// contents must be ignored explicitly
+func (w *fanotifyWatcher) ignored(path string, isDir bool) bool {
+	elems := strings.Split(strings.TrimPrefix(path, w.rootDir+"/"), "/")
+	for i := 1; i < len(elems); i++ {
+		parent := p.Join(w.rootDir, strings.Join(elems[:i], "/"))
+		if ignored(w.rootDir, w.ignore, w.gitIgnore, parent, true) {
+			return true
+		}
+	}
+	return ignored(w.rootDir, w.ignore, w.gitIgnore, path, isDir)
+}
+
+// scan calls w.cb with a Create event for every file and directory under
+// 'dir', loading any .gitignore files along the way. As with fileWatcher, it's
+// called on the watch root when the watch starts, and on every new directory
+func (w *fanotifyWatcher) scan(dir string) error {
+	if w.gitIgnore != nil {
+		w.gitIgnore.Load(dir)
+	}
+	childInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) && dir != w.rootDir {
+			return nil // deleted in the interim
+		}
+		return fmt.Errorf("could not read %q: %v", dir, err)
+	}
+	for _, childInfo := range childInfos {
+		childPath := p.Join(dir, childInfo.Name())
+		if ignored(w.rootDir, w.ignore, w.gitIgnore, childPath, childInfo.IsDir()) {
+			continue
+		}
+		if err := w.cb(WatchEvent{
+			Type:  Create,
+			IsDir: childInfo.IsDir(),
+			Path:  childPath,
+		}); err != nil {
+			return err
+		}
+		if childInfo.IsDir() {
+			if err := w.scan(childPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve returns the current path of the file identified by 'h'
+func (w *fanotifyWatcher) resolve(h unix.FileHandle) (string, error) {
+	fd, err := unix.OpenByHandleAt(w.mountFD, h, unix.O_PATH)
+	if err != nil {
+		return "", err // e.g. ESTALE, if the file has been deleted
+	}
+	defer unix.Close(fd)
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(path, " (deleted)") {
+		return "", os.ErrNotExist
+	}
+	return path, nil
+}
+
+// run scans w.rootDir and then reads w.fanFD in a loop, converting fanotify
+// events under w.rootDir into WatchEvents, until w.doneCtx is cancelled or the
+// watch root is deleted. It closes w's file descriptors before returning
+func (w *fanotifyWatcher) run() (retErr error) {
+	defer func() {
+		for _, fd := range []int{w.fanFD, w.mountFD} {
+			if err := unix.Close(fd); err != nil && retErr == nil {
+				retErr = err
+			}
+		}
+	}()
+	if err := w.scan(w.rootDir); err != nil {
+		return err
+	}
+	if w.onStatus != nil {
+		w.onStatus(Status{Backend: BackendFanotify})
+	}
+
+	buf := make([]byte, fanotifyBufSz)
+	fanFD := []unix.PollFd{{Fd: int32(w.fanFD), Events: unix.POLLIN}}
+	for {
+		if w.doneCtx != nil {
+			select {
+			case <-w.doneCtx.Done():
+				return nil // doneCtx has been cancelled
+			default:
+			}
+		}
+		// The watch root's parent may be outside of the watched filesystem (e.g.
+		// if the root is a mount point), so check for the root's deletion
+		// directly rather than relying on events
+		if _, err := os.Stat(w.rootDir); os.IsNotExist(err) {
+			return fmt.Errorf("watch root %q has been deleted", w.rootDir)
+		}
+
+		n, err := unix.Poll(fanFD, 1000) // return after 1s to check w.doneCtx
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return fmt.Errorf("poll() error: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		n, err = unix.Read(w.fanFD, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return fmt.Errorf("error reading fanotify FD: %v", err)
+		}
+		events, err := parseFanotifyEvents(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := w.apply(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply converts the fanotify event 'e' into WatchEvents (if it's under
+// w.rootDir and not ignored), and passes them to w.cb
+func (w *fanotifyWatcher) apply(e fanotifyEvent) error {
+	if e.mask&unix.FAN_Q_OVERFLOW > 0 {
+		// There are no per-directory watches to repair (unlike fileWatcher), so
+		// just report the overflow
+		return w.cb(WatchEvent{Type: Overflow, IsDir: true, Path: w.rootDir})
+	}
+	if !e.hasHandle {
+		return nil
+	}
+	path, err := w.resolve(e.handle)
+	if err != nil {
+		return nil // the file (or its parent) no longer exists
+	}
+	if e.name != "" && e.name != "." {
+		path = p.Join(path, e.name)
+	}
+	if path == w.rootDir || !strings.HasPrefix(path, w.rootDir+"/") {
+		return nil // not under the watched tree
+	}
+	isDir := e.mask&unix.FAN_ONDIR > 0
+
+	// If a .gitignore file changed, re-read it (as fileWatcher does)
+	if w.gitIgnore != nil && !isDir && p.Base(path) == gitIgnoreFile {
+		w.gitIgnore.Load(p.Dir(path))
+	}
+	if w.ignored(path, isDir) {
+		return nil
+	}
+
+	// fanotify may merge several events on the same file into one, so report
+	// each of them, in the order in which they must have happened
+	if e.mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) > 0 {
+		if err := w.cb(WatchEvent{Type: Create, IsDir: isDir, Path: path}); err != nil {
+			return err
+		}
+		if isDir {
+			if err := w.scan(path); err != nil {
+				return err
+			}
+		}
+	}
+	if e.mask&unix.FAN_MODIFY > 0 && !isDir {
+		if err := w.cb(WatchEvent{Type: Modify, Path: path}); err != nil {
+			return err
+		}
+	}
+	if e.mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) > 0 {
+		if err := w.cb(WatchEvent{Type: Delete, IsDir: isDir, Path: path}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
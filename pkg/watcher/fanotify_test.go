@@ -0,0 +1,138 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	p "path"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/msteffen/golang-time-tracker/pkg/check"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseFanotifyEvents(t *testing.T) {
+	// Construct a FAN_CREATE event with a FAN_EVENT_INFO_TYPE_DFID_NAME record
+	handle := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	name := "file.go\x00\x00\x00\x00\x00" // padded to a multiple of 4 bytes
+	infoLen := fanEventInfoHeaderLen + len(handle) + len(name)
+	buf := make([]byte, unix.FAN_EVENT_METADATA_LEN+infoLen)
+	meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+	meta.Event_len = uint32(len(buf))
+	meta.Vers = unix.FANOTIFY_METADATA_VERSION
+	meta.Metadata_len = unix.FAN_EVENT_METADATA_LEN
+	meta.Mask = unix.FAN_CREATE
+	meta.Fd = unix.FAN_NOFD
+	info := buf[unix.FAN_EVENT_METADATA_LEN:]
+	info[0] = fanEventInfoTypeDFIDName
+	*(*uint16)(unsafe.Pointer(&info[2])) = uint16(infoLen)
+	*(*uint32)(unsafe.Pointer(&info[12])) = uint32(len(handle))
+	*(*int32)(unsafe.Pointer(&info[16])) = 7
+	copy(info[fanEventInfoHeaderLen:], handle)
+	copy(info[fanEventInfoHeaderLen+len(handle):], name)
+
+	// Followed by an overflow event, which has no info records
+	overflow := make([]byte, unix.FAN_EVENT_METADATA_LEN)
+	meta = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&overflow[0]))
+	meta.Event_len = unix.FAN_EVENT_METADATA_LEN
+	meta.Vers = unix.FANOTIFY_METADATA_VERSION
+	meta.Metadata_len = unix.FAN_EVENT_METADATA_LEN
+	meta.Mask = unix.FAN_Q_OVERFLOW
+	meta.Fd = unix.FAN_NOFD
+	buf = append(buf, overflow...)
+
+	events, err := parseFanotifyEvents(buf)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(len(events), 2),
+		check.Eq(events[0].mask, uint64(unix.FAN_CREATE)),
+		check.True(events[0].hasHandle),
+		check.Eq(events[0].handle.Type(), int32(7)),
+		check.Eq(events[0].handle.Bytes(), handle),
+		check.Eq(events[0].name, "file.go"),
+		check.Eq(events[1].mask, uint64(unix.FAN_Q_OVERFLOW)),
+		check.False(events[1].hasHandle))
+
+	// Truncated events are rejected
+	_, err = parseFanotifyEvents(buf[:unix.FAN_EVENT_METADATA_LEN+4])
+	check.T(t, check.NotNil(err))
+}
+
+func TestFanotify(t *testing.T) {
+	dir, child := NewTestDir(t)
+	if w, err := newFanotifyWatcher(nil, dir, Options{}, nil); err != nil {
+		t.Skipf("fanotify is unavailable: %v", err)
+	} else {
+		unix.Close(w.fanFD)
+		unix.Close(w.mountFD)
+	}
+	check.T(t,
+		check.Nil(ioutil.WriteFile(p.Join(child, "a"), nil, 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(dir, ".gitignore"), []byte("build/\n"), 0644)))
+	MkdirT(t, p.Join(dir, "build"), 0755)
+	outside := dir + "-outside"
+	MkdirT(t, outside, 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DefaultOptions()
+	opts.Backend = BackendFanotify
+	var statuses []Status
+	opts.OnStatus = func(s Status) { statuses = append(statuses, s) }
+	events, errC := startWatch(ctx, dir, opts)
+	expectEvents(t, events, `Create "child/"`, `Create "child/a"`, `Create ".gitignore"`)
+
+	// Writes outside of 'dir', and to ignored files, aren't reported
+	check.T(t,
+		check.Nil(ioutil.WriteFile(p.Join(outside, "x"), []byte("x"), 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(dir, "build", "x"), []byte("x"), 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(child, "a.swp"), []byte("x"), 0644)))
+
+	// New dirs, writes, and deletions are reported
+	MkdirT(t, p.Join(dir, "new"), 0755)
+	expectEvents(t, events, `Create "new/"`)
+	check.T(t, check.Nil(ioutil.WriteFile(p.Join(dir, "new", "b"), nil, 0644)))
+	expectEvents(t, events, `Create "new/b"`)
+	f, err := os.OpenFile(p.Join(child, "a"), os.O_WRONLY, 0644)
+	check.T(t, check.Nil(err))
+	_, err = f.Write([]byte("data"))
+	check.T(t, check.Nil(err), check.Nil(f.Close()))
+	expectEvents(t, events, `Modify "child/a"`)
+	check.T(t, check.Nil(os.Remove(p.Join(dir, "new", "b"))))
+	expectEvents(t, events, `Delete "new/b"`)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event: %s", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	check.T(t,
+		check.Nil(<-errC),
+		check.Eq(statuses, []Status{{Backend: BackendFanotify}}))
+}
+
+// TestFanotifyFallback checks that watches requesting BackendFanotify use
+// inotify if fanotify is unavailable
+func TestFanotifyFallback(t *testing.T) {
+	dir, _ := NewTestDir(t)
+	defer func() { fanotifyInit = unix.FanotifyInit }()
+	fanotifyInit = func(uint, uint) (int, error) {
+		return -1, unix.EPERM
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DefaultOptions()
+	opts.Backend = BackendFanotify
+	var statuses []Status
+	opts.OnStatus = func(s Status) { statuses = append(statuses, s) }
+	events, errC := startWatch(ctx, dir, opts)
+	expectEvents(t, events, `Create "child/"`)
+	check.T(t, check.Nil(ioutil.WriteFile(p.Join(dir, "a"), nil, 0644)))
+	expectEvents(t, events, `Create "a"`)
+	cancel()
+	check.T(t,
+		check.Nil(<-errC),
+		check.Eq(statuses, []Status{{Backend: BackendInotify}}))
+}
@@ -0,0 +1,278 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	p "path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gitIgnoreFile is the name of the files that GitIgnore reads
+const gitIgnoreFile = ".gitignore"
+
+// A Matcher decides which files and directories a watcher ignores. Ignored
+// files don't generate WatchEvents, and ignored directories aren't watched at
+// all (so they don't consume inotify watches).
+type Matcher interface {
+	// Match returns true if the file at 'path' (relative to the watched dir,
+	// and never "" or ".") should be ignored. 'isDir' is true if 'path' is a
+	// directory
+	Match(path string, isDir bool) bool
+}
+
+// ignored returns true if the file at 'path' (an absolute path under 'root')
+// is ignored by any of 'ignore', or by 'gitIgnore' (if it's non-nil)
+func ignored(root string, ignore []Matcher, gitIgnore *GitIgnore, path string, isDir bool) bool {
+	if path == root {
+		return false
+	}
+	rel := strings.TrimPrefix(path, root+"/")
+	for _, m := range ignore {
+		if m.Match(rel, isDir) {
+			return true
+		}
+	}
+	return gitIgnore != nil && gitIgnore.Match(rel, isDir)
+}
+
+// ignorePattern is a single parsed line of a .gitignore file (see 'man 5
+// gitignore')
+type ignorePattern struct {
+	// elems contains the pattern's path elements (e.g. ["build", "*.o"])
+	elems []string
+
+	// negate is true if the pattern started with '!' (i.e. it re-includes
+	// files excluded by an earlier pattern)
+	negate bool
+
+	// dirOnly is true if the pattern ended with '/' (i.e. it only matches
+	// directories)
+	dirOnly bool
+
+	// anchored is true if the pattern contained a '/' other than a trailing
+	// one, in which case it matches paths relative to the .gitignore file's
+	// directory. Otherwise it matches the last element of any path
+	anchored bool
+}
+
+// parsePattern parses 'line' (a line of a .gitignore file). It returns false
+// if the line is blank or a comment
+func parsePattern(line string) (ignorePattern, bool, error) {
+	var result ignorePattern
+	// trailing spaces are ignored unless they're escaped
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return result, false, nil
+	}
+	if line[0] == '!' {
+		result.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		result.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		result.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return result, false, nil
+	}
+	result.elems = strings.Split(line, "/")
+	for _, elem := range result.elems {
+		if _, err := p.Match(elem, ""); err != nil {
+			return result, false, fmt.Errorf("invalid pattern %q: %v", line, err)
+		}
+	}
+	return result, true, nil
+}
+
+// match returns true if 'pat' matches 'path' (relative to the directory
+// containing the pattern)
+func (pat *ignorePattern) match(path string, isDir bool) bool {
+	if pat.dirOnly && !isDir {
+		return false
+	}
+	elems := strings.Split(path, "/")
+	if !pat.anchored {
+		return MatchElems(pat.elems, elems[len(elems)-1:])
+	}
+	// As in git, a trailing "**" matches everything inside a directory, but
+	// not the directory itself (so "foo/**" doesn't stop 'foo' from being
+	// watched, and "!foo/keep" can re-include files in it)
+	if n := len(pat.elems); pat.elems[n-1] == "**" {
+		for i := len(elems) - 1; i >= 0; i-- {
+			if MatchElems(pat.elems[:n-1], elems[:i]) {
+				return true
+			}
+		}
+		return false
+	}
+	return MatchElems(pat.elems, elems)
+}
+
+// MatchElems returns true if the path elements 'path' match the pattern
+// elements 'pattern' exactly. Each element of 'pattern' matches one element of
+// 'path' (as in path.Match), except for "**", which matches any number of
+// elements (including none). Besides ignore patterns, the watch daemon uses it
+// to match label rules
+func MatchElems(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if MatchElems(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := p.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return MatchElems(pattern[1:], path[1:])
+}
+
+// patternList is a Matcher for a list of gitignore-style patterns, in which the
+// last matching pattern decides whether a path is ignored
+type patternList []ignorePattern
+
+// ParsePatterns returns a Matcher that ignores files matching 'patterns',
+// which use the syntax of .gitignore files (relative to the watched dir)
+func ParsePatterns(patterns ...string) (Matcher, error) {
+	var result patternList
+	for _, line := range patterns {
+		pat, ok, err := parsePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, pat)
+		}
+	}
+	return result, nil
+}
+
+// MustParsePatterns is like ParsePatterns, but panics if any of 'patterns' is
+// invalid
+func MustParsePatterns(patterns ...string) Matcher {
+	m, err := ParsePatterns(patterns...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// decide returns whether the last pattern in 'l' that matches 'path' ignores
+// it, and false if no pattern matches 'path'
+func (l patternList) decide(path string, isDir bool) (ignored, matched bool) {
+	for i := len(l) - 1; i >= 0; i-- {
+		if l[i].match(path, isDir) {
+			return !l[i].negate, true
+		}
+	}
+	return false, false
+}
+
+// Match implements the Matcher interface
+func (l patternList) Match(path string, isDir bool) bool {
+	ignored, _ := l.decide(path, isDir)
+	return ignored
+}
+
+// GitIgnore is a Matcher that ignores the files ignored by the .gitignore
+// files in a directory tree. As in git, patterns in a .gitignore file apply
+// to paths relative to the file's directory, patterns in deeper files take
+// precedence over those in their parents, and within a file, later patterns
+// take precedence over earlier ones (so "!pattern" re-includes files ignored
+// by an earlier pattern). Files in an ignored directory can't be re-included,
+// as the watcher never descends into ignored directories.
+type GitIgnore struct {
+	// root is the directory tree's root (an absolute path)
+	root string
+
+	// patterns maps each directory (relative to 'root', or "" for 'root'
+	// itself) to the patterns in its .gitignore file, if any
+	patterns map[string]patternList
+}
+
+// NewGitIgnore returns a GitIgnore for the directory tree at 'root'. It
+// doesn't read any .gitignore files (see Load)
+func NewGitIgnore(root string) *GitIgnore {
+	return &GitIgnore{
+		root:     p.Clean(root),
+		patterns: make(map[string]patternList),
+	}
+}
+
+// Load reads the .gitignore file in 'dir' (an absolute path under the tree's
+// root), replacing any patterns previously read from it. If 'dir' has no
+// .gitignore file, any previously read patterns are discarded. Invalid
+// patterns are skipped, as in git, and so are .gitignore files that can't be
+// read (e.g. because of their permissions), which are logged rather than
+// failing the whole watch.
+func (g *GitIgnore) Load(dir string) {
+	rel := g.rel(dir)
+	data, err := ioutil.ReadFile(p.Join(dir, gitIgnoreFile))
+	if err != nil {
+		delete(g.patterns, rel)
+		if !os.IsNotExist(err) {
+			log.Warnf("skipping %s in %q, which could not be read: %v", gitIgnoreFile, dir, err)
+		}
+		return
+	}
+	var patterns patternList
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if pat, ok, err := parsePattern(scanner.Text()); err == nil && ok {
+			patterns = append(patterns, pat)
+		}
+	}
+	if len(patterns) == 0 {
+		delete(g.patterns, rel)
+	} else {
+		g.patterns[rel] = patterns
+	}
+}
+
+// rel returns 'path' relative to g.root ("" for g.root itself)
+func (g *GitIgnore) rel(path string) string {
+	path = p.Clean(path)
+	if path == g.root {
+		return ""
+	}
+	return strings.TrimPrefix(path, g.root+"/")
+}
+
+// Match implements the Matcher interface
+func (g *GitIgnore) Match(path string, isDir bool) bool {
+	// check the .gitignore file of each of 'path's parents, from the root down
+	ignored := false
+	elems := strings.Split(path, "/")
+	for i := 0; i < len(elems); i++ {
+		dir := strings.Join(elems[:i], "/")
+		patterns, ok := g.patterns[dir]
+		if !ok {
+			continue
+		}
+		if dirIgnored, matched := patterns.decide(strings.Join(elems[i:], "/"), isDir); matched {
+			ignored = dirIgnored
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,97 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	p "path"
+	"testing"
+
+	"github.com/msteffen/golang-time-tracker/pkg/check"
+)
+
+func TestParsePatterns(t *testing.T) {
+	m, err := ParsePatterns(
+		"# build output",
+		"build/",
+		"*.log",
+		"!keep.log",
+		"/TODO",
+		"docs/**/*.pdf",
+		"cache/**",
+		"!cache/keep",
+		`\#notes`,
+		"node_modules",
+	)
+	check.T(t, check.Nil(err))
+	for _, c := range []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false}, // "build/" only matches dirs
+		{"a.log", false, true},
+		{"src/a.log", false, true},
+		{"keep.log", false, false},
+		{"src/keep.log", false, false},
+		{"TODO", false, true},
+		{"src/TODO", false, false}, // "/TODO" is anchored
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"src/docs/a.pdf", false, false},
+		{"cache", true, false}, // a trailing "**" only matches cache's contents
+		{"cache/a", false, true},
+		{"cache/x/a", false, true},
+		{"cache/keep", false, false},
+		{"#notes", false, true},
+		{"node_modules", true, true},
+		{".github", true, false},
+		{"vendorize.go", false, false},
+	} {
+		t.Logf("checking %q", c.path)
+		check.T(t, check.Eq(m.Match(c.path, c.isDir), c.expected))
+	}
+
+	_, err = ParsePatterns("a[")
+	check.T(t, check.NotNil(err))
+}
+
+func TestDefaultIgnorePatterns(t *testing.T) {
+	m := MustParsePatterns(DefaultIgnorePatterns...)
+	check.T(t,
+		check.True(m.Match(".git", true)),
+		check.True(m.Match("vendor", true)),
+		check.True(m.Match("src/.main.go.swp", false)),
+		check.False(m.Match(".github", true)),
+		check.False(m.Match(".gitignore", false)),
+		check.False(m.Match("vendorize.go", false)))
+}
+
+func TestGitIgnore(t *testing.T) {
+	dir, child := NewTestDir(t)
+	check.T(t,
+		check.Nil(ioutil.WriteFile(p.Join(dir, ".gitignore"), []byte("*.o\nout/\n"), 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(child, ".gitignore"), []byte("!keep.o\n/local\n"), 0644)))
+	g := NewGitIgnore(dir)
+	g.Load(dir)
+	g.Load(child)
+	check.T(t,
+		check.True(g.Match("a.o", false)),
+		check.True(g.Match("child/a.o", false)),
+		check.True(g.Match("keep.o", false)),
+		check.False(g.Match("child/keep.o", false)), // negated in child/.gitignore
+		check.True(g.Match("child/out", true)),
+		check.True(g.Match("child/local", false)),
+		check.False(g.Match("local", false)), // anchored to child/
+		check.False(g.Match("child/x/local", false)),
+		check.False(g.Match("child", true)))
+
+	// .gitignore files that can't be read are skipped, rather than failing
+	unreadable := p.Join(child, "unreadable")
+	check.T(t, check.Nil(os.MkdirAll(p.Join(unreadable, ".gitignore"), 0755)))
+	g.Load(unreadable)
+	check.T(t,
+		check.True(g.Match("child/unreadable/a.o", false)),
+		check.False(g.Match("child/unreadable/b", false)))
+}
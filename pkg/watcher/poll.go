@@ -0,0 +1,212 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	p "path"
+	"sort"
+	"time"
+)
+
+// DefaultPollInterval is how often BackendPoll walks the watched tree, if
+// Options.PollInterval isn't set
+const DefaultPollInterval = 10 * time.Second
+
+// fileState is the state of a file or directory that pollWatcher compares
+// between walks
+type fileState struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// pollWatcher implements BackendPoll. Like fileWatcher, it's not a concurrent
+// data structure
+type pollWatcher struct {
+	// rootDir is root directory being watched
+	rootDir string
+
+	// interval is how often the watched tree is walked
+	interval time.Duration
+
+	// cb is the callback that 'w' calls with every event
+	cb func(WatchEvent) error
+
+	// doneCtx, when cancelled, causes the watch to exit
+	doneCtx context.Context
+
+	// ignore and gitIgnore determine which files 'w' ignores (as in
+	// fileWatcher)
+	ignore    []Matcher
+	gitIgnore *GitIgnore
+
+	// onStatus, if set, is called once the watch has been established (a
+	// polling watch is never degraded)
+	onStatus func(Status)
+
+	// files contains the state of every (non-ignored) file and directory under
+	// rootDir seen in the most recent walk, keyed by path, and walked is true
+	// once the first walk has finished
+	files  map[string]fileState
+	walked bool
+}
+
+// poll implements WatchWithOptions for BackendPoll
+func poll(ctx context.Context, path string, opts Options, cb func(WatchEvent) error) error {
+	w := &pollWatcher{
+		rootDir:  path,
+		interval: opts.PollInterval,
+		cb:       cb,
+		doneCtx:  ctx,
+		ignore:   opts.Ignore,
+		onStatus: opts.OnStatus,
+		files:    make(map[string]fileState),
+	}
+	if w.interval <= 0 {
+		w.interval = DefaultPollInterval
+	}
+	if opts.GitIgnore {
+		w.gitIgnore = NewGitIgnore(path)
+	}
+	// As with fileWatcher, the initial walk generates a Create event for every
+	// file and directory under 'path' (but not 'path' itself)
+	if err := w.walk(); err != nil {
+		return err
+	}
+	if w.onStatus != nil {
+		w.onStatus(Status{Backend: BackendPoll})
+	}
+	for {
+		if w.doneCtx != nil {
+			select {
+			case <-w.doneCtx.Done():
+				return nil // doneCtx has been cancelled
+			case <-time.After(w.interval):
+			}
+		} else {
+			time.Sleep(w.interval)
+		}
+		if err := w.walk(); err != nil {
+			return err
+		}
+	}
+}
+
+// walk walks w.rootDir, calls w.cb with an event for every file that was
+// created, modified, or deleted since the previous walk, and updates w.files
+func (w *pollWatcher) walk() error {
+	rootInfo, err := os.Stat(w.rootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("watch root %q has been deleted", w.rootDir)
+		}
+		return fmt.Errorf("could not Stat() watch root %q: %v", w.rootDir, err)
+	}
+	seen := make(map[string]fileState)
+	if rootInfo.IsDir() {
+		if err := w.walkDir(w.rootDir, seen); err != nil {
+			return err
+		}
+	} else {
+		// the watch root is a file; report modifications to it
+		if err := w.compare(w.rootDir, rootInfo, seen); err != nil {
+			return err
+		}
+	}
+
+	// Anything that wasn't seen has been deleted. Report children before their
+	// parents, as inotify does
+	var deleted []string
+	for path := range w.files {
+		if _, ok := seen[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+	for _, path := range deleted {
+		if err := w.cb(WatchEvent{
+			Type:  Delete,
+			IsDir: w.files[path].isDir,
+			Path:  path,
+		}); err != nil {
+			return err
+		}
+	}
+	w.files, w.walked = seen, true
+	return nil
+}
+
+// walkDir compares the state of every file and directory under 'dir' to its
+// state in the previous walk, recording it in 'seen'
+func (w *pollWatcher) walkDir(dir string, seen map[string]fileState) error {
+	childInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) && dir != w.rootDir {
+			return nil // deleted during walk; will be reported next time
+		}
+		return fmt.Errorf("could not read %q: %v", dir, err)
+	}
+	// (re)load dir's .gitignore before deciding which children are ignored, if
+	// it's new or has changed
+	if w.gitIgnore != nil {
+		gitIgnorePath := p.Join(dir, gitIgnoreFile)
+		var current fileState
+		for _, childInfo := range childInfos {
+			if childInfo.Name() == gitIgnoreFile {
+				current = stateOf(childInfo)
+			}
+		}
+		_, known := w.files[dir]
+		if dir == w.rootDir {
+			known = w.walked
+		}
+		if !known || w.files[gitIgnorePath] != current {
+			w.gitIgnore.Load(dir)
+		}
+	}
+	for _, childInfo := range childInfos {
+		childPath := p.Join(dir, childInfo.Name())
+		if ignored(w.rootDir, w.ignore, w.gitIgnore, childPath, childInfo.IsDir()) {
+			continue
+		}
+		if err := w.compare(childPath, childInfo, seen); err != nil {
+			return err
+		}
+		if childInfo.IsDir() {
+			if err := w.walkDir(childPath, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compare calls w.cb with a Create or Modify event for 'path' if it's new or
+// has changed since the previous walk, and records its state in 'seen'
+func (w *pollWatcher) compare(path string, info os.FileInfo, seen map[string]fileState) error {
+	current := stateOf(info)
+	seen[path] = current
+	previous, ok := w.files[path]
+	switch {
+	case !ok && path == w.rootDir:
+		return nil // the root isn't reported, as with fileWatcher
+	case !ok || previous.isDir != current.isDir:
+		return w.cb(WatchEvent{Type: Create, IsDir: current.isDir, Path: path})
+	case !current.isDir && previous != current:
+		// directories' mtimes change whenever their children do, so only
+		// changes to files are reported
+		return w.cb(WatchEvent{Type: Modify, Path: path})
+	}
+	return nil
+}
+
+// stateOf returns the fileState of the file described by 'info'
+func stateOf(info os.FileInfo) fileState {
+	return fileState{
+		isDir:   info.IsDir(),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+}
@@ -0,0 +1,119 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	p "path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msteffen/golang-time-tracker/pkg/check"
+)
+
+const testPollInterval = 50 * time.Millisecond
+
+// startPoll starts a polling watch on 'dir' (see startWatch)
+func startPoll(ctx context.Context, dir string) (chan string, chan error) {
+	opts := DefaultOptions()
+	opts.Backend = BackendPoll
+	opts.PollInterval = testPollInterval
+	return startWatch(ctx, dir, opts)
+}
+
+// startWatch starts a watch on 'dir' and returns a channel that receives its
+// events (with paths relative to 'dir'), and a channel that receives the
+// watch's result once it exits
+func startWatch(ctx context.Context, dir string, opts Options) (chan string, chan error) {
+	events, errC := make(chan string, 100), make(chan error, 1)
+	go func() {
+		errC <- WatchWithOptions(ctx, dir, opts, func(e WatchEvent) error {
+			e.Path = strings.TrimPrefix(e.Path, dir+"/")
+			events <- e.String()
+			return nil
+		})
+	}()
+	return events, errC
+}
+
+// expectEvents reads len(expected) events from 'events' and checks that they
+// match 'expected' (in any order)
+func expectEvents(t *testing.T, events chan string, expected ...string) {
+	t.Helper()
+	actual := make(paths)
+	for range expected {
+		select {
+		case e := <-events:
+			actual.Add(e)
+		case <-time.After(10 * testPollInterval):
+			t.Fatalf("timed out waiting for events; got: %v", actual)
+		}
+	}
+	exp := make(paths)
+	for _, e := range expected {
+		exp.Add(e)
+	}
+	check.T(t, check.Nil(exp.ConfirmEq(actual)))
+}
+
+func TestPoll(t *testing.T) {
+	dir, child := NewTestDir(t)
+	check.T(t, check.Nil(ioutil.WriteFile(p.Join(child, "a"), nil, 0644)))
+	ctx, cancel := context.WithCancel(context.Background())
+	events, errC := startPoll(ctx, dir)
+
+	// The initial walk reports everything under 'dir'
+	expectEvents(t, events, `Create "child/"`, `Create "child/a"`)
+
+	// Creates, modifications, and deletions are reported
+	check.T(t,
+		check.Nil(os.Mkdir(p.Join(dir, "new"), 0755)),
+		check.Nil(ioutil.WriteFile(p.Join(dir, "new", "b"), nil, 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(child, "a"), []byte("data"), 0644)))
+	expectEvents(t, events, `Create "new/"`, `Create "new/b"`, `Modify "child/a"`)
+	check.T(t, check.Nil(os.RemoveAll(child)))
+	expectEvents(t, events, `Delete "child/"`, `Delete "child/a"`)
+
+	// Ignored files aren't reported, including those ignored by a new
+	// .gitignore file
+	check.T(t,
+		check.Nil(ioutil.WriteFile(p.Join(dir, ".gitignore"), []byte("*.log\n"), 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(dir, "c.swp"), nil, 0644)),
+		check.Nil(ioutil.WriteFile(p.Join(dir, "d.log"), nil, 0644)))
+	expectEvents(t, events, `Create ".gitignore"`)
+	time.Sleep(3 * testPollInterval)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event: %s", e)
+	default:
+	}
+
+	cancel()
+	check.T(t, check.Nil(<-errC))
+}
+
+func TestPollRootDeleted(t *testing.T) {
+	dir, _ := NewTestDir(t)
+	events, errC := startPoll(context.Background(), dir)
+	expectEvents(t, events, `Create "child/"`)
+	check.T(t, check.Nil(os.RemoveAll(dir)))
+	err := <-errC
+	check.T(t,
+		check.NotNil(err),
+		check.True(strings.Contains(err.Error(), "deleted")))
+}
+
+func TestDetectBackend(t *testing.T) {
+	// testDir is on /dev/shm (tmpfs), which supports inotify
+	backend, err := DetectBackend(testDir)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(backend, BackendInotify))
+	_, err = DetectBackend(p.Join(testDir, "does-not-exist"))
+	check.T(t, check.NotNil(err))
+
+	err = WatchWithOptions(context.Background(), testDir,
+		Options{Backend: "carrier-pigeon"}, func(WatchEvent) error { return nil })
+	check.T(t, check.NotNil(err))
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"os"
 	p "path"
-	"strings"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -21,8 +21,16 @@ const (
 	//  Specifying a buffer of size 'sizeof(struct inotify_event) + NAME_MAX + 1'
 	//  will be sufficient to read at least one event.
 	inotifyBufSz = unix.SizeofInotifyEvent + unix.NAME_MAX + 1
+
+	// retryInterval is how often a degraded watcher retries watching the
+	// directories that it couldn't watch (see Status)
+	retryInterval = 30 * time.Second
 )
 
+// inotifyAddWatch is unix.InotifyAddWatch (tests replace it to simulate
+// errors, e.g. reaching the inotify watch limit)
+var inotifyAddWatch = unix.InotifyAddWatch
+
 // WatchEventType is the type associated with each WatchEvent returned by a
 // watcher
 type WatchEventType uint8
@@ -33,6 +41,12 @@ const (
 	Delete
 	Modify
 	Ignore
+
+	// Overflow indicates that the kernel's event queue overflowed, so some
+	// events were lost. The watcher rescans the watched tree (setting up
+	// watches on any new directories) before passing an Overflow event for the
+	// watched dir to the callback
+	Overflow
 )
 
 // A WatchEvent is passed to a callback by a watcher to indicate some
@@ -52,6 +66,8 @@ func (e WatchEvent) String() string {
 		verb = "Delete"
 	case Modify:
 		verb = "Modify"
+	case Overflow:
+		verb = "Overflow"
 	}
 	var prettyPath string
 	if e.IsDir {
@@ -62,18 +78,110 @@ func (e WatchEvent) String() string {
 	return verb + " \"" + prettyPath + "\""
 }
 
+// Status describes the health of a running watch. A watch is degraded if some
+// directories in the watched tree couldn't be watched (e.g. because the
+// inotify watch limit, /proc/sys/fs/inotify/max_user_watches, was reached).
+// A degraded watcher keeps watching the directories it could watch, and
+// periodically retries the others.
+type Status struct {
+	// Unwatched is the number of directories that couldn't be watched
+	Unwatched int
+
+	// Reason describes why the directories couldn't be watched ("" if
+	// Unwatched is 0)
+	Reason string
+
+	// Backend is the backend watching the tree (BackendInotify, BackendPoll, or
+	// BackendFanotify). If BackendFanotify was requested but is unavailable,
+	// this is BackendInotify, which is used instead
+	Backend string
+}
+
+// Degraded returns true if some directories couldn't be watched
+func (s Status) Degraded() bool {
+	return s.Unwatched > 0
+}
+
+// Options configures WatchWithOptions
+type Options struct {
+	// Ignore contains matchers for files that the watcher ignores. A file is
+	// ignored if any matcher matches it
+	Ignore []Matcher
+
+	// OnStatus, if set, is called once the watch has been established, and
+	// then whenever its Status changes (it's called from the same goroutine as
+	// the watch callback)
+	OnStatus func(Status)
+
+	// GitIgnore, if true, causes the watcher to also ignore the files ignored
+	// by any .gitignore files in the watched tree (see GitIgnore)
+	GitIgnore bool
+
+	// Backend determines how the watched tree is watched (one of BackendAuto,
+	// BackendInotify, BackendPoll, or BackendFanotify). "" is the same as
+	// BackendAuto
+	Backend string
+
+	// PollInterval is how often BackendPoll walks the watched tree (if 0,
+	// DefaultPollInterval is used)
+	PollInterval time.Duration
+}
+
+// DefaultIgnorePatterns are the patterns ignored by DefaultOptions: git's
+// metadata dir, golang vendor dirs, and vim swap files
+var DefaultIgnorePatterns = []string{".git/", "vendor/", "*.swp", "*.swo"}
+
+// DefaultOptions returns the Options used by Watch
+func DefaultOptions() Options {
+	return Options{
+		Ignore:    []Matcher{MustParsePatterns(DefaultIgnorePatterns...)},
+		GitIgnore: true,
+	}
+}
+
 // Watch begins watching all directories under 'dir', calling 'cb' with every
-// event
-func Watch(ctx context.Context, path string, cb func(WatchEvent) error) (retErr error) {
+// event. It ignores the files ignored by DefaultOptions(), and picks a backend
+// automatically
+func Watch(ctx context.Context, path string, cb func(WatchEvent) error) error {
+	return WatchWithOptions(ctx, path, DefaultOptions(), cb)
+}
+
+// WatchWithOptions is like Watch, but ignores the files ignored by 'opts'
+// rather than by DefaultOptions(), and uses the backend set in 'opts'
+func WatchWithOptions(ctx context.Context, path string, opts Options, cb func(WatchEvent) error) (retErr error) {
 	path = p.Clean(path)
 	pathInfo, err := os.Stat(path)
 	if err != nil {
 		return fmt.Errorf("could not Stat() watch target %q: %v", path, err)
 	}
+	backend := opts.Backend
+	switch backend {
+	case "", BackendAuto:
+		if backend, err = DetectBackend(path); err != nil {
+			return err
+		}
+	case BackendInotify, BackendPoll, BackendFanotify:
+	default:
+		return fmt.Errorf("unknown watch backend %q", opts.Backend)
+	}
+	switch backend {
+	case BackendPoll:
+		return poll(ctx, path, opts, cb)
+	case BackendFanotify:
+		if w, err := newFanotifyWatcher(ctx, path, opts, cb); err == nil {
+			return w.run()
+		}
+		// fanotify is unavailable, so fall back to inotify (Status.Backend
+		// reports which backend is in use)
+	}
 
 	// Init inotify file descriptor
 	fd, err := unix.InotifyInit()
 	if err != nil {
+		if opts.Backend == "" || opts.Backend == BackendAuto {
+			// inotify may be unavailable (e.g. in some containers)
+			return poll(ctx, path, opts, cb)
+		}
 		return err
 	}
 	defer func() {
@@ -88,6 +196,12 @@ func Watch(ctx context.Context, path string, cb func(WatchEvent) error) (retErr
 		watchedDirs: make(map[string]struct{}),
 		cb:          cb,
 		doneCtx:     ctx,
+		ignore:      opts.Ignore,
+		onStatus:    opts.OnStatus,
+		unwatched:   make(map[string]struct{}),
+	}
+	if opts.GitIgnore {
+		w.gitIgnore = NewGitIgnore(path)
 	}
 	// w.add(path) may call w.cb several times and set up several watches before
 	// we get to run(), but shouldn't call w.cb on 'path'
@@ -98,7 +212,8 @@ func Watch(ctx context.Context, path string, cb func(WatchEvent) error) (retErr
 	}); err != nil {
 		return err
 	}
-	return w.run() // wait for further events
+	w.reportStatus() // report the initial status, if add() hasn't already
+	return w.run()   // wait for further events
 }
 
 // fileWatcher watches a directory. N.B. that watcher is *not* a concurrent data
@@ -137,6 +252,115 @@ type fileWatcher struct {
 	// doneCtx is used to cancel the watch (which is the only way for Watch() to
 	// return without an error)
 	doneCtx context.Context
+
+	// ignore contains the matchers for ignored files (see Options.Ignore)
+	ignore []Matcher
+
+	// gitIgnore contains the patterns of all .gitignore files read so far (nil
+	// if Options.GitIgnore is false)
+	gitIgnore *GitIgnore
+
+	// onStatus is called whenever 'status' changes (see Options.OnStatus)
+	onStatus func(Status)
+
+	// status is the most recently reported Status of the watch, and
+	// statusReported is true once any Status has been reported
+	status         Status
+	statusReported bool
+
+	// unwatched contains the directories that couldn't be watched because the
+	// inotify watch limit was reached, and lastRetry is when watching them was
+	// last retried
+	unwatched map[string]struct{}
+	lastRetry time.Time
+}
+
+// reportStatus computes w's current Status, and passes it to w.onStatus if
+// it has changed
+func (w *fileWatcher) reportStatus() {
+	status := Status{Unwatched: len(w.unwatched), Backend: BackendInotify}
+	if status.Degraded() {
+		status.Reason = fmt.Sprintf("%d directories could not be watched: inotify "+
+			"watch limit reached (see /proc/sys/fs/inotify/max_user_watches)",
+			status.Unwatched)
+	}
+	if w.statusReported && status == w.status {
+		return
+	}
+	w.status, w.statusReported = status, true
+	if w.onStatus != nil {
+		w.onStatus(status)
+	}
+}
+
+// retryUnwatched tries again to watch the directories that couldn't be
+// watched because the inotify watch limit was reached
+func (w *fileWatcher) retryUnwatched() error {
+	w.lastRetry = time.Now()
+	for dir := range w.unwatched {
+		delete(w.unwatched, dir) // add() re-adds 'dir' if it fails again
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue // dir is gone
+		}
+		if err := w.add(WatchEvent{Type: Create, IsDir: true, Path: dir}); err != nil {
+			return err
+		}
+	}
+	w.reportStatus()
+	return nil
+}
+
+// rescan walks every watched directory and sets up watches on any new
+// subdirectories that weren't watched yet. It's called after the kernel's
+// event queue overflows, as the Create events for such subdirectories may
+// have been lost
+func (w *fileWatcher) rescan() error {
+	// forget watched dirs that no longer exist (their Delete events may also
+	// have been lost)
+	dirs := make([]string, 0, len(w.watchedDirs))
+	for dir := range w.watchedDirs {
+		if _, err := os.Stat(dir); err != nil {
+			delete(w.watchedDirs, dir)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range dirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue // deleted in the interim
+		}
+		childInfos, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		for _, childInfo := range childInfos {
+			childPath := p.Join(dir, childInfo.Name())
+			if !childInfo.IsDir() || w.ignored(childPath, true) {
+				continue
+			}
+			if _, ok := w.unwatched[childPath]; ok {
+				continue // retried below
+			}
+			// applyWatchEvent skips dirs that are already watched
+			if err := w.applyWatchEvent(WatchEvent{
+				Type:  Create,
+				IsDir: true,
+				Path:  childPath,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return w.retryUnwatched()
+}
+
+// ignored returns true if the file at 'path' (an absolute path under
+// w.rootDir) is ignored by any of w's matchers
+func (w *fileWatcher) ignored(path string, isDir bool) bool {
+	return ignored(w.rootDir, w.ignore, w.gitIgnore, path, isDir)
 }
 
 // run add()s any un-scanned directories, and if none are left, reads
@@ -188,6 +412,13 @@ func (w *fileWatcher) run() error {
 				return err
 			}
 		}
+
+		// If the watch is degraded, periodically retry the unwatched dirs
+		if len(w.unwatched) > 0 && time.Since(w.lastRetry) > retryInterval {
+			if err := w.retryUnwatched(); err != nil {
+				return err
+			}
+		}
 	}
 }
 
@@ -209,16 +440,29 @@ func (w *fileWatcher) add(e WatchEvent) (err error) {
 	}
 
 	// Create watch and note the path associated with this watch descriptor
-	wd, err := unix.InotifyAddWatch(w.watchFD, e.Path, watchMask)
+	wd, err := inotifyAddWatch(w.watchFD, e.Path, watchMask)
 	if err != nil {
 		if os.IsNotExist(err) && e.Path != w.rootDir {
 			return nil
 		}
+		if (err == unix.ENOSPC || err == unix.ENOMEM) && e.Path != w.rootDir {
+			// The inotify watch limit has been reached. Keep watching the
+			// directories that are already watched, and retry this one later
+			w.unwatched[e.Path] = struct{}{}
+			w.reportStatus()
+			return nil
+		}
 		return fmt.Errorf("could not add watch: %v", err)
 	}
 	w.wdToPath[wd] = e.Path
 	w.watchedDirs[e.Path] = struct{}{}
 
+	// Read any .gitignore file in 'e.Path' before scanning its children, so
+	// that ignored children aren't watched
+	if w.gitIgnore != nil {
+		w.gitIgnore.Load(e.Path)
+	}
+
 	// Watch is now in place, but children of 'e.Path' may have been added while
 	// watch was being created, so scan the current contents of 'e.Path' and add any
 	// existing subdirs to 'w'
@@ -242,19 +486,11 @@ func (w *fileWatcher) add(e WatchEvent) (err error) {
 		return fmt.Errorf("could not read contents of directory %q: %v", e.Path, err)
 	}
 	for _, childInfo := range childInfos {
-		child := childInfo.Name()
-		// heuristic: avoid .git directories
-		if strings.Contains(child, ".git") {
+		childPath := p.Join(e.Path, childInfo.Name())
+		if w.ignored(childPath, childInfo.IsDir()) {
 			continue
 		}
 
-		// heuristic: avoid golang vendor directories, since I typically use this
-		// with go projects (omits "vendor" as well as "vendor.X")
-		if strings.HasPrefix(child, "vendor") {
-			continue // avoid golang vendor directories
-		}
-		childPath := p.Join(e.Path, child)
-
 		// generate synthetic Create event for child and apply it (calls w.cb)
 		if err := w.applyWatchEvent(WatchEvent{
 			Type:  Create,
@@ -321,8 +557,12 @@ func (w *fileWatcher) forEachEvent(buf []byte, cb func(WatchEvent) error) (end i
 			// ignore other IN_IGNORED events (rely on IN_DELETE from parent)
 			continue
 		}
-		// Heuristic: ignore vim writes to backup files
-		if strings.HasSuffix(we.Path, ".swp") || strings.HasSuffix(we.Path, ".swo") {
+		// If a .gitignore file changed, re-read it (which affects subsequent
+		// events, though not watches that were already set up)
+		if w.gitIgnore != nil && !we.IsDir && p.Base(we.Path) == gitIgnoreFile {
+			w.gitIgnore.Load(p.Dir(we.Path))
+		}
+		if w.ignored(we.Path, we.IsDir) {
 			continue
 		}
 		if err := cb(we); err != nil {
@@ -334,6 +574,15 @@ func (w *fileWatcher) forEachEvent(buf []byte, cb func(WatchEvent) error) (end i
 
 // w.modelMu must be locked before calling this
 func (w *fileWatcher) applyWatchEvent(we WatchEvent) (err error) {
+	// 0. if we.Type == Overflow, events were lost, so rescan the watched tree
+	// before reporting the overflow
+	if we.Type == Overflow {
+		if err := w.rescan(); err != nil {
+			return err
+		}
+		return w.cb(we)
+	}
+
 	// 1a. if we.Type == Modify, just call w.cb immediately, there's no extra
 	// watch handling that needs to be done
 	if we.Type == Modify {
@@ -373,6 +622,10 @@ func (w *fileWatcher) applyWatchEvent(we WatchEvent) (err error) {
 }
 
 func (w *fileWatcher) toWatchEvent(e *unix.InotifyEvent, name string) (WatchEvent, error) {
+	if e.Mask&unix.IN_Q_OVERFLOW > 0 {
+		// overflow events aren't associated with any watch descriptor
+		return WatchEvent{Type: Overflow, IsDir: true, Path: w.rootDir}, nil
+	}
 	result := WatchEvent{
 		IsDir: e.Mask&unix.IN_ISDIR > 0,
 	}
@@ -12,11 +12,13 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/msteffen/golang-time-tracker/pkg/check"
 
 	"github.com/google/uuid"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 )
 
 // set by TestMain
@@ -186,7 +188,6 @@ func TestError(t *testing.T) {
 		default:
 			return fmt.Errorf("unwanted event: %s", e)
 		}
-		return nil
 	})
 	check.T(t,
 		check.NotNil(err),
@@ -491,6 +492,164 @@ func TestFiles(t *testing.T) {
 		check.Eq(actualModifications, expectedModifications))
 }
 
+// TestIgnore checks that files ignored by .gitignore files and by the default
+// ignore patterns don't generate events (and that similarly-named files that
+// aren't ignored do)
+func TestIgnore(t *testing.T) {
+	dir, _ := NewTestDir(t)
+	check.T(t, check.Nil(ioutil.WriteFile(p.Join(dir, ".gitignore"), []byte("build/\n*.log\n"), 0644)))
+	for _, d := range []string{"build", ".git", ".github", "vendor"} {
+		MkdirT(t, p.Join(dir, d), 0755)
+	}
+
+	// Once the initial events have been received, create ignored and
+	// non-ignored files. 'done' is created last, and ends the watch
+	block := make(chan struct{})
+	go func(block chan struct{}) {
+		<-block
+		for _, f := range []string{"build/x", ".git/index", "a.log", "b.swp", "vendorize.go", "done"} {
+			check.T(t, check.Nil(ioutil.WriteFile(p.Join(dir, f), nil, 0644)))
+		}
+	}(block)
+	ctx, cancel := context.WithCancel(context.Background())
+	actual := make(paths)
+	err := Watch(ctx, dir, func(e WatchEvent) error {
+		rel := strings.TrimPrefix(e.Path, dir+"/")
+		if e.Type == Create {
+			actual[rel] = struct{}{}
+		}
+		if len(actual) == 3 && block != nil {
+			// received events for all of child, .gitignore, and .github
+			close(block)
+			block = nil
+		}
+		if e.Path == p.Join(dir, "done") {
+			cancel()
+		}
+		return nil
+	})
+	check.T(t,
+		check.Nil(err),
+		check.Eq(actual, paths{
+			"child":        {},
+			".gitignore":   {},
+			".github":      {},
+			"vendorize.go": {},
+			"done":         {},
+		}))
+}
+
+// newTestWatcher returns a fileWatcher on 'dir' that has set up its initial
+// watches but isn't reading events yet, so that tests can feed it events
+// directly. Events passed to w.cb are appended to 'events'. Callers must
+// close w.watchFD
+func newTestWatcher(t *testing.T, dir string, events *[]WatchEvent, onStatus func(Status)) *fileWatcher {
+	fd, err := unix.InotifyInit()
+	check.T(t, check.Nil(err))
+	w := &fileWatcher{
+		rootDir:     dir,
+		watchFD:     fd,
+		wdToPath:    make(map[int]string),
+		watchedDirs: make(map[string]struct{}),
+		cb: func(e WatchEvent) error {
+			*events = append(*events, e)
+			return nil
+		},
+		doneCtx:   context.Background(),
+		onStatus:  onStatus,
+		unwatched: make(map[string]struct{}),
+	}
+	check.T(t, check.Nil(w.add(WatchEvent{Type: Create, IsDir: true, Path: dir})))
+	return w
+}
+
+// TestOverflow checks that when the kernel's event queue overflows, the
+// watcher rescans the watched tree (picking up directories whose Create events
+// were lost) and emits an Overflow event
+func TestOverflow(t *testing.T) {
+	dir, child := NewTestDir(t)
+	var events []WatchEvent
+	w := newTestWatcher(t, dir, &events, nil)
+	defer unix.Close(w.watchFD)
+	events = nil
+
+	// create 'lost' and 'lost/inner' and then delete 'child' without processing
+	// the events, as if they'd been dropped
+	MkdirT(t, p.Join(dir, "lost"), 0755)
+	MkdirT(t, p.Join(dir, "lost", "inner"), 0755)
+	check.T(t, check.Nil(os.Remove(child)))
+
+	// feed the watcher a single IN_Q_OVERFLOW event
+	buf := make([]byte, unix.SizeofInotifyEvent)
+	event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+	event.Wd = -1
+	event.Mask = unix.IN_Q_OVERFLOW
+	end, err := w.forEachEvent(buf, w.applyWatchEvent)
+	check.T(t, check.Nil(err), check.Eq(end, 0))
+
+	check.T(t,
+		check.Eq(len(events), 3),
+		check.Eq(events[0], WatchEvent{Type: Create, IsDir: true, Path: p.Join(dir, "lost")}),
+		check.Eq(events[1], WatchEvent{Type: Create, IsDir: true, Path: p.Join(dir, "lost", "inner")}),
+		check.Eq(events[2], WatchEvent{Type: Overflow, IsDir: true, Path: dir}),
+		check.Eq(paths(w.watchedDirs), paths{
+			dir:                          {},
+			p.Join(dir, "lost"):          {},
+			p.Join(dir, "lost", "inner"): {},
+		}))
+}
+
+// TestDegraded checks that when the inotify watch limit is reached, the
+// watcher keeps the watches it already has, reports that it's degraded, and
+// recovers once the unwatched directories can be watched again
+func TestDegraded(t *testing.T) {
+	dir, child := NewTestDir(t)
+	MkdirT(t, p.Join(dir, "other"), 0755)
+	defer func() { inotifyAddWatch = unix.InotifyAddWatch }()
+	inotifyAddWatch = func(fd int, path string, mask uint32) (int, error) {
+		if path == child {
+			return -1, unix.ENOSPC
+		}
+		return unix.InotifyAddWatch(fd, path, mask)
+	}
+
+	var events []WatchEvent
+	var statuses []Status
+	w := newTestWatcher(t, dir, &events, func(s Status) {
+		statuses = append(statuses, s)
+	})
+	defer unix.Close(w.watchFD)
+	check.T(t,
+		check.Eq(len(statuses), 1),
+		check.True(statuses[0].Degraded()),
+		check.Eq(statuses[0].Unwatched, 1),
+		check.Eq(paths(w.watchedDirs), paths{
+			dir:                  {},
+			p.Join(dir, "other"): {},
+		}))
+
+	// The root can't be watched either, so the watch fails
+	inotifyAddWatch = func(fd int, path string, mask uint32) (int, error) {
+		return -1, unix.ENOSPC
+	}
+	err := WatchWithOptions(context.Background(), dir, DefaultOptions(),
+		func(WatchEvent) error { return nil })
+	check.T(t, check.NotNil(err))
+
+	// Once watches are available again, retrying recovers the watch
+	inotifyAddWatch = unix.InotifyAddWatch
+	check.T(t,
+		check.Nil(w.retryUnwatched()),
+		check.Eq(len(statuses), 2),
+		check.Eq(statuses[1], Status{Backend: BackendInotify}),
+		check.False(statuses[1].Degraded()),
+		check.Eq(paths(w.watchedDirs), paths{
+			dir:                  {},
+			child:                {},
+			p.Join(dir, "other"): {},
+		}))
+}
+
 // copied from watch_daemon/api_test.go
 func TestMain(m *testing.M) {
 	var errCode int
@@ -2,19 +2,14 @@ package watchd
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"sort"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/msteffen/golang-time-tracker/client"
-	"github.com/msteffen/golang-time-tracker/pkg/escape"
 	"github.com/msteffen/golang-time-tracker/pkg/watcher"
 )
 
@@ -27,15 +22,49 @@ const (
 	s_Day    = 24 * s_Hour
 )
 
+// minWatchBackoff and maxWatchBackoff bound how long a failed watch waits
+// before restarting (the wait doubles after each consecutive failure)
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 5 * time.Minute
+)
+
+// pendingWrites describes the writes that a watch has received for a project
+// but not yet recorded in the database
+type pendingWrites struct {
+	// label is the project's label (for logging)
+	label string
+
+	// subtrees maps each subtree of the watched dir (see subtreeOf) that was
+	// written to the times of its earliest and latest writes, and files maps
+	// each file written (if client.Config.ActivityDetail is set) to the time of
+	// its earliest write. Both are used to retract writes that turn out to be
+	// part of a burst (see isHumanEdit)
+	subtrees map[string]*writeTimes
+	files    map[string]time.Time
+}
+
+// writeTimes holds the times of the earliest and latest writes to a subtree
+type writeTimes struct {
+	first, last time.Time
+}
+
+// last returns the time of the latest write in 'p', which is when the writes
+// are recorded
+func (p *pendingWrites) last() time.Time {
+	var last time.Time
+	for _, t := range p.subtrees {
+		if t.last.After(last) {
+			last = t.last
+		}
+	}
+	return last
+}
+
 // maxTime is the only time t such that for all go time.Time values t',
 // t.After(t') == true
 var /* const */ maxTime = time.Unix(1<<63-62135596801, 999999999)
 
-// maxWatches is the maximum number of watches that may exist concurrently
-const maxWatches = 4
-const tickSyncFrequency = 3 * time.Second
-const watchSyncFrequency = 3 * time.Second
-
 type watch struct {
 	//// Not Owned
 	// [pointer to owner] the server that owns this watch
@@ -45,124 +74,293 @@ type watch struct {
 	// dir is the directory being watched
 	dir string
 
-	// label recorded in the database with every watch event identified with this
-	// watch
-	label string
-
-	// hasPending is > 0 if watch has recieved a write that hasn't been recorded
-	// in the database
-	hasPending int32
+	// projectID identifies the project (in the projects table) recorded in the
+	// database with every watch event identified with this watch, and label is
+	// that project's name. 'rules' override both for parts of 'dir'. All may be
+	// changed by syncWatches (e.g. if the project is renamed or merged into
+	// another project), so they're guarded by projectMu
+	projectMu sync.Mutex
+	projectID int64
+	label     string
+	rules     []*StoredLabelRule
+
+	// pending maps the IDs of projects for which the watch has received a
+	// write that hasn't been recorded in the database to those writes. Guarded
+	// by pendingMu
+	pendingMu sync.Mutex
+	pending   map[int64]*pendingWrites
+
+	// backend is the backend requested for the watch (see
+	// client.WatchRequest.Backend)
+	backend string
+
+	// burstThreshold is the burst threshold requested for the watch (see
+	// client.WatchRequest.BurstThreshold), and maxEvents is the resulting
+	// number of events per burstWindow that a subtree may receive before they
+	// stop counting as human edits (0 if every event counts)
+	burstThreshold int
+	maxEvents      int
+
+	// recent maps each subtree of 'dir' to the times of the events received
+	// from it in the last burstWindow, and bursting contains the subtrees that
+	// are in a burst. Both are only used by handleEvent (i.e. by the goroutine
+	// running the watch), so they're unguarded
+	recent   map[string][]time.Time
+	bursting map[string]bool
+
+	// status is the watch's health (one of the client.Watch* statuses) and
+	// statusReason explains it if the watch isn't healthy. activeBackend is the
+	// backend in use. scanned is false while the watcher is reporting the files
+	// that already exist in 'dir' (i.e. until it first reports its status), so
+	// that they aren't recorded as file activity. All are set by the goroutine
+	// running the watch, so they're guarded by statusMu
+	statusMu      sync.Mutex
+	status        string
+	statusReason  string
+	activeBackend string
+	scanned       bool
 
 	// ctx is the context attached to this watch (cancel, below, cancels this ctx)
 	ctx context.Context
 
 	// cancel causes the corresponding call to Watch() to exit (and cancels 'ctx'
-	// above)
+	// above), and stops recordWritesInDB from being called
 	cancel func()
 
-	// when the watch started
+	// when the watch started (according to server.clock)
 	start time.Time
 }
 
-// dbWatchInfo corresponds to a record in the watches table
-type dbWatchInfo struct {
-	// dir is the directory being watched
-	dir string
+// info returns a description of 'w' suitable for GetWatches
+func (w *watch) info() *client.WatchInfo {
+	w.projectMu.Lock()
+	defer w.projectMu.Unlock()
+	info := &client.WatchInfo{Dir: w.dir, Label: w.label}
+	for _, r := range w.rules {
+		info.Rules = append(info.Rules, &client.LabelRule{Path: r.Path, Label: r.Label})
+	}
+	w.statusMu.Lock()
+	defer w.statusMu.Unlock()
+	info.Status, info.StatusReason = w.status, w.statusReason
+	info.Backend, info.ActiveBackend = w.backend, w.activeBackend
+	info.BurstThreshold = w.burstThreshold
+	return info
+}
 
-	// label recorded in the database with every file event underneath 'dir'
-	label string
+// setStatus changes the status of 'w' (logging and publishing the change)
+func (w *watch) setStatus(status, reason string) {
+	w.statusMu.Lock()
+	if w.status == status && w.statusReason == reason {
+		w.statusMu.Unlock()
+		return
+	}
+	if status == client.WatchHealthy {
+		log.Infof("watch on [%s] is %s", w.dir, status)
+	} else {
+		log.Warnf("watch on [%s] is %s: %s", w.dir, status, reason)
+	}
+	w.status, w.statusReason = status, reason
+	w.statusMu.Unlock()
+	_, label := w.projectFor(w.dir)
+	w.server.publishWatch(w.dir, label)
+}
 
-	// lastWrite indicates the most recent write recieved for this watch
-	lastWrite time.Time
+// onWatcherStatus is called by the watcher whenever its status changes
+func (w *watch) onWatcherStatus(s watcher.Status) {
+	w.statusMu.Lock()
+	w.activeBackend, w.scanned = s.Backend, true
+	w.statusMu.Unlock()
+	if s.Degraded() {
+		w.setStatus(client.WatchDegraded, s.Reason)
+	} else {
+		w.setStatus(client.WatchHealthy, "")
+	}
 }
 
-// recordWritesInDB runs every 5 seconds, and if any writes have been recorded
-// since the last run, it writes a corresponding record into the DB
-func (w *watch) recordWritesInDB() {
-	// tick at most once every 'tickSyncFrequency'seconds (that 'notified' is set)
-	// so that a flood of events (e.g. moving a large dir) doesn't create a flood
-	// of persisted data.
-	// TODO(msteffen) make this adjustable
-	ticker := time.Tick(tickSyncFrequency)
+// run watches w.dir until w.ctx is cancelled. If the watch fails (e.g.
+// because w.dir was deleted or became unreadable), run marks it failed and
+// restarts it with exponential backoff, so that e.g. a watched repo that's
+// deleted and re-cloned is watched again once it reappears
+func (w *watch) run() {
+	backoff := minWatchBackoff
 	for {
-		time.Sleep(tickSyncFrequency)
-
-		// check if w.ctx has been cancelled (e.g. because another watch was added,
-		// exceeding 'maxWatches')
+		start := w.server.clock.Now()
+		w.statusMu.Lock()
+		w.scanned = false // a restarted watch reports all existing files again
+		w.statusMu.Unlock()
+		opts := watcher.DefaultOptions()
+		opts.OnStatus = w.onWatcherStatus
+		opts.Backend = w.backend
+		opts.PollInterval = time.Duration(w.server.config.PollInterval) * time.Second
+		err := w.server.events.Watch(w.ctx, w.dir, opts, w.handleEvent)
+		if w.ctx.Err() != nil {
+			return // watch was removed
+		}
+		if err == nil {
+			err = fmt.Errorf("watch exited unexpectedly")
+		}
+		if w.server.clock.Now().Sub(start) > maxWatchBackoff {
+			backoff = minWatchBackoff // the watch had been running fine
+		}
+		w.setStatus(client.WatchFailed, fmt.Sprintf("%v (retrying in %s)", err, backoff))
 		select {
 		case <-w.ctx.Done():
-			return // ctx has been cancelled
-		case <-ticker:
+			return
+		case <-w.server.clock.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
 		}
+	}
+}
 
-		// Check if a write has been received since the last iteration
-		if atomic.CompareAndSwapInt32(&w.hasPending, 1, 0) {
-			// don't start logging changes until after the watch has been established, to
-			// avoid logging the flood of events corresponding to pre-existing files
-			if time.Now().Sub(w.start).Seconds() > 10 {
-				log.Infof("watch on [%s] (labeled [%s]) registered a change", w.dir, w.label)
-			}
+// setProject changes the project and label rules associated with 'w', and
+// returns true if they changed
+func (w *watch) setProject(id int64, label string, rules []*StoredLabelRule) bool {
+	w.projectMu.Lock()
+	defer w.projectMu.Unlock()
+	changed := w.projectID != id || w.label != label || !rulesEqual(w.rules, rules)
+	w.projectID, w.label, w.rules = id, label, rules
+	return changed
+}
 
-			// can't 'defer dbMu.Unlock()' b/c we're in a loop
-			// w.server.dbMu.Unlock() is at the bottom of 'if ...(w.hasPending)' below
-			w.server.dbMu.Lock()
-			curTime := w.server.clock.Now()
-
-			// update DB with new write
-			// - watches are part of the API package basically because of this write
-			// here; this way, the api package is the only place that writes to the
-			// DB. These two changes are bundled into a transaction because even
-			// though the watch holds a lock on the DB, the transaction avoids issues
-			// where one write succeeds but the other doesn't
-			success := true
-			txn, err := w.server.db.Begin()
-			if err != nil {
-				log.Errorf("error creating txn to record write at %v for %q (will attempt to roll back): %v",
-					curTime, w.dir, err)
-			}
-			for _, cmd := range []string{
-				// On startup, time-tracker will scan all old watches and recreate them,
-				// which creates a flurry of write events. The 'watch'es for all of
-				// these then try to record a write in the DB simultaneously, and all
-				// after the first get an error from SQLite that they've violated the
-				// UNIQUE constraint on the 'ticks' table.
-				//
-				// Rather than trying to separate the write events from all of the
-				// watches to avoid violating the UNIQUE constaint, just use INSERT OR
-				// IGNORE here and ignore all writes after the first.
-				fmt.Sprintf(`INSERT OR IGNORE INTO ticks (time, labels) VALUES (%d, %q);`,
-					curTime.Unix(), escape.Escape(w.label)),
-				fmt.Sprintf(`UPDATE watches SET last_write = %d WHERE dir = %q;`,
-					curTime.Unix(), escape.Escape(w.dir)),
-			} {
-				if _, err := txn.Exec(cmd); err != nil {
-					log.Errorf("error recording write at %v for %q (will attempt to roll back): %v",
-						curTime, w.dir, err)
-					success = false
-					break
-				}
-			}
-			if !success {
-				if err := txn.Rollback(); err != nil {
-					log.Errorf("error rolling back txn: %v", err)
-				}
-			} else if err := txn.Commit(); err != nil {
-				log.Errorf("error committing: %v", err)
+// projectFor returns the ID and name of the project associated with writes to
+// 'p' (a path under 'w.dir'): that of the label rule that applies to 'p', if
+// any, and otherwise that of 'w' itself
+func (w *watch) projectFor(p string) (int64, string) {
+	w.projectMu.Lock()
+	defer w.projectMu.Unlock()
+	if isSubdir(w.dir, p) {
+		if r := matchRule(w.rules, relPath(w.dir, p)); r != nil {
+			return r.ProjectID, r.Label
+		}
+	}
+	return w.projectID, w.label
+}
+
+// takePending returns the IDs of all projects with pending writes (sorted),
+// along with the writes, and clears them
+func (w *watch) takePending() ([]int64, map[int64]*pendingWrites) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	if len(w.pending) == 0 {
+		return nil, nil
+	}
+	pending, ids := w.pending, make([]int64, 0, len(w.pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	w.pending = nil
+	return ids, pending
+}
+
+// recordWritesInDB is called every 'TickSyncFrequency' seconds (see
+// syncWatches), and if any writes have been received since the last call, it
+// writes a corresponding record into the DB. Ticking at most once every
+// 'TickSyncFrequency' seconds means that a flood of events (e.g. moving a large
+// dir) doesn't create a flood of persisted data.
+func (w *watch) recordWritesInDB() {
+	// check if w.ctx has been cancelled (e.g. because another watch was added,
+	// exceeding 'MaxWatches')
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	// Check if a write has been received since the last call (for each project
+	// that it was received for)
+	projectIDs, pending := w.takePending()
+	for _, projectID := range projectIDs {
+		label := pending[projectID].label
+		// don't start logging changes until after the watch has been established, to
+		// avoid logging the flood of events corresponding to pre-existing files
+		if w.server.clock.Now().Sub(w.start).Seconds() > 10 {
+			log.Infof("watch on [%s] (labeled [%s]) registered a change", w.dir, label)
+		}
+
+		// update DB with new write
+		// - watches are part of the API package basically because of this write
+		// here; this way, the api package is the only place that writes to the
+		// DB.
+		// - On startup, time-tracker will scan all old watches and recreate them,
+		// which creates a flurry of write events. The 'watch'es for all of these
+		// then try to record a write in the DB simultaneously. Stores ignore ticks
+		// that are already part of an interval, so all writes after the first
+		// are no-ops.
+		// - The write is recorded at the time it was received, rather than now,
+		// which may be up to 'TickSyncFrequency' seconds later
+		w.server.storeMu.Lock()
+		writeTime := pending[projectID].last()
+		err := w.server.store.RecordWrite(w.dir, projectID, writeTime.Unix(), w.server.config.MaxEventGap)
+		if err == nil && len(pending[projectID].files) > 0 {
+			files := make([]string, 0, len(pending[projectID].files))
+			for f := range pending[projectID].files {
+				files = append(files, f)
 			}
-			w.server.dbMu.Unlock()
+			sort.Strings(files)
+			err = w.server.store.RecordActivity(projectID, writeTime.Unix(), files)
+		}
+		if err == nil {
+			w.server.publishTick(writeTime.Unix(), label)
+		}
+		w.server.storeMu.Unlock()
+		if err != nil {
+			log.Errorf("error recording write at %v for %q: %v", writeTime, w.dir, err)
 		}
 	}
 }
 
-// handleEvent receives WatchEvents from a watcher, and signals to
-// 'recordWritesInDB' that a tick needs to be recorded
+// handleEvent receives WatchEvents from a watcher, and, if they're human edits
+// (see isHumanEdit), signals to 'recordWritesInDB' that a tick needs to be
+// recorded
 func (w *watch) handleEvent(e watcher.WatchEvent) error {
 	// don't start logging changes until after the watch has been established, to
 	// avoid logging the flood of events corresponding to pre-existing files
-	if time.Now().Sub(w.start).Seconds() > 10 {
+	now := w.server.clock.Now()
+	if now.Sub(w.start).Seconds() > 10 {
 		log.Infof("observed %s", e)
 	}
-	atomic.StoreInt32(&w.hasPending, 1)
+	if e.Type == watcher.Overflow {
+		// some events were lost; record a write to the watch as a whole, in case
+		// they were writes (unless bursts are ignored, as an overflow is a burst)
+		log.Warnf("inotify event queue overflowed while watching [%s]", w.dir)
+	}
+	if !w.isHumanEdit(e, now) {
+		return nil
+	}
+	// record which file was written, if activity detail is enabled (but not
+	// the files reported when the watch starts, which already existed)
+	recordFile := w.server.config.ActivityDetail && !e.IsDir &&
+		(e.Type == watcher.Create || e.Type == watcher.Modify)
+	if recordFile {
+		w.statusMu.Lock()
+		recordFile = w.scanned
+		w.statusMu.Unlock()
+	}
+	projectID, label := w.projectFor(e.Path)
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[int64]*pendingWrites)
+	}
+	p, ok := w.pending[projectID]
+	if !ok {
+		p = &pendingWrites{
+			subtrees: make(map[string]*writeTimes),
+			files:    make(map[string]time.Time),
+		}
+		w.pending[projectID] = p
+	}
+	p.label = label
+	subtree := w.subtreeOf(e.Path)
+	if t, ok := p.subtrees[subtree]; ok {
+		t.last = now
+	} else {
+		p.subtrees[subtree] = &writeTimes{first: now, last: now}
+	}
+	if _, ok := p.files[e.Path]; recordFile && !ok {
+		p.files[e.Path] = now
+	}
 	return nil
 }
 
@@ -171,61 +369,89 @@ type server struct {
 	//// Not owned
 	clock Clock
 
+	// events is the source of the filesystem events observed by the server's
+	// watches
+	events EventSource
+
 	//// Owned
-	// maxEventGap is a configuration option that determines how far apart ticks
-	// may be before they're considered part of different intervals
-	maxEventGap int64
+	// config contains the server's settings (e.g. how far apart ticks may be
+	// before they're considered part of different intervals)
+	config *client.Config
 
-	// db is (a client of) a SQLite database that contains all ticks and watches
-	// persisted on disk
-	db *sql.DB
+	// store persists all intervals, projects, and watches
+	store Store
 
-	// dbMu guards 'db'. The sqlite driver does not allow for concurrent writes.
-	// See https://github.com/mattn/go-sqlite3#faq
-	// This allows for safe concurrent use of 'db'
-	dbMu sync.RWMutex
+	// storeMu guards 'store'. Store implementations need not be safe for
+	// concurrent use (e.g. the sqlite driver does not allow for concurrent
+	// writes; see https://github.com/mattn/go-sqlite3#faq), but may be read
+	// concurrently, so this allows for safe concurrent use of 'store'
+	storeMu sync.RWMutex
 
 	// watches maps paths currently watched by 'server' to a cancel() fn that
 	// kills the inotify watch in the kernel
 	watches map[string]*watch
 
-	// watchMu guards 'watches'. Note that if you're planning to lock both dbMu
-	// and watchMu, you must lock dbMu first (currently only syncWatches locks
-	// both, and locks them in that order)
+	// watchMu guards 'watches' and 'closed'. Note that if you're planning to
+	// lock both storeMu and watchMu, you must lock storeMu first (currently only
+	// syncWatches locks both, and locks them in that order)
 	watchMu sync.Mutex
+
+	// closed is set by Close(), after which syncWatches doesn't create watches
+	closed bool
+
+	// stopSync stops the ticker that syncs s.watches with s.store (see
+	// syncWatchesLoop)
+	stopSync func()
+
+	// broker delivers events to the server's subscribers (see Subscribe)
+	broker broker
 }
 
-// NewServer returns an implementation of client.TimeTrackerAPI
-func NewServer(clock Clock, dbPath string) (client.TimeTrackerAPI, error) {
-	// Create DB connection
-	db, err := sql.Open("sqlite3", dbPath)
+// NewServer returns an implementation of client.TimeTrackerAPI that persists
+// its data in the SQLite DB at 'dbPath'. If 'config' is nil, DefaultConfig()
+// is used.
+func NewServer(clock Clock, dbPath string, config *client.Config) (client.TimeTrackerAPI, error) {
+	// The config is needed to migrate the DB (which may fold legacy ticks into
+	// intervals), so validate it before opening the store
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	store, err := NewSQLiteStore(clock, dbPath, config.MaxEventGap)
 	if err != nil {
-		return nil, fmt.Errorf("could not open DB: %v", err)
+		return nil, err
 	}
-	for err = db.Ping(); err != nil; err = db.Ping() {
-		log.Printf("Waiting for DB to start (last ping: %v)", err)
-		time.Sleep(time.Second)
+	return NewServerWithStore(clock, store, config)
+}
+
+// NewServerWithStore returns an implementation of client.TimeTrackerAPI that
+// persists its data in 'store'. If 'config' is nil, DefaultConfig() is used.
+func NewServerWithStore(clock Clock, store Store, config *client.Config) (client.TimeTrackerAPI, error) {
+	return NewServerWithEventSource(clock, store, WatcherEventSource, config)
+}
+
+// NewServerWithEventSource is like NewServerWithStore, but the server's
+// watches observe the events produced by 'events' rather than by
+// WatcherEventSource
+func NewServerWithEventSource(clock Clock, store Store, events EventSource, config *client.Config) (client.TimeTrackerAPI, error) {
+	if config == nil {
+		config = DefaultConfig()
 	}
-	// Take advantage of sqlite INTEGER PRIMARY KEY table for fast range scan of
-	// ticks and watches: https://sqlite.org/lang_createtable.html#rowid
-	// Also, create tables in txn b/c we need both of them
-	if _, err = db.Exec(`
-		BEGIN TRANSACTION;
-	  CREATE TABLE IF NOT EXISTS ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
-	  CREATE TABLE IF NOT EXISTS watches (last_write INTEGER, dir TEXT, label TEXT);
-		COMMIT;
-	`); err != nil {
-		return nil, fmt.Errorf("could not create SQL tables: %v", err)
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
 	}
 
 	// Create new server struct
 	s := &server{
-		watches:     make(map[string]*watch),
-		db:          db,
-		clock:       clock,
-		maxEventGap: 23 * s_Minute,
+		watches: make(map[string]*watch),
+		store:   store,
+		clock:   clock,
+		events:  events,
+		config:  config,
 	}
-	go s.syncWatchesLoop()
+	s.syncWatchesLoop()
 	return s, nil
 }
 
@@ -234,30 +460,31 @@ func NewServer(clock Clock, dbPath string) (client.TimeTrackerAPI, error) {
 // the relevant watch (which happens in a transaction with the new tick)
 func (s *server) Tick(req *client.TickRequest) (*client.TickResponse, error) {
 	// Write tick to DB
-	s.dbMu.Lock()
-	defer s.dbMu.Unlock()
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
 
 	now := s.clock.Now().Unix()
-	var err error
 	if req != nil {
-		_, err = s.db.Exec(fmt.Sprintf(
-			"INSERT INTO ticks (time, labels) VALUES (%d, %q)",
-			now, escape.Escape(req.Label),
-		))
-	}
-	if err != nil {
-		return nil, err
+		if err := s.store.AddTick(now, req.Label, s.config.MaxEventGap); err != nil {
+			return nil, err
+		}
+		s.publishTick(now, req.Label)
 	}
 	return &client.TickResponse{Now: now}, nil
 }
 
 // addWatchToDB is a helper for Watch(), which essentially wraps the part of a
-// Watch() operation that must be done while s.dbMu is held
+// Watch() operation that must be done while s.storeMu is held
 //
 // s.syncWatches, which happens at the end of Watch(), must be done outside this
 // function, which is why it's separate from the main RPC handler
-func (s *server) addWatchToDB(dir, label string) error {
-	// Note: the dbMu prevents a concurrent write elsewhere from adding a
+//
+// If 'dir' is inside an existing watch, then the request fails unless
+// 'override' is set, in which case a label rule for 'dir' is added to the
+// existing watch. If 'dir' contains existing watches, the new watch subsumes
+// them.
+func (s *server) addWatchToDB(dir, label, backend string, burstThreshold int, override bool) error {
+	// Note: the storeMu prevents a concurrent write elsewhere from adding a
 	// redundant watch for req.Dir between this existence check and the write
 	// below.
 	//
@@ -272,36 +499,50 @@ func (s *server) addWatchToDB(dir, label string) error {
 	// (so, above, where we register a tick and update a watch's last write time,
 	// is a sensible use of a transaction, as we need both writes to succeed or
 	// fail for consistency between the tables).
-	s.dbMu.Lock()
-	defer s.dbMu.Unlock()
-	dbWatches, err := s.getDBWatches()
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	dbWatches, err := s.store.GetWatches()
 	if err != nil {
 		return fmt.Errorf("error checking if watch on %q already exists: %v", dir, err)
 	}
+	subsumed := 0 // number of existing watches that the new watch replaces
 	for _, wi := range dbWatches {
-		if strings.HasPrefix(dir, wi.dir) {
-			return &WatchExistsErr{dir: wi.dir}
-		}
-		if strings.HasPrefix(wi.dir, dir) {
-			// TODO(msteffen): instead of erroring, we should remove the old watch and
-			// add the new, higher-level watch
-			return &WatchExistsErr{dir: wi.dir}
+		switch {
+		case dir == wi.Dir:
+			return &WatchExistsErr{dir: wi.Dir}
+		case isSubdir(wi.Dir, dir):
+			if !override {
+				return &WatchExistsErr{dir: wi.Dir}
+			}
+			return s.store.AddLabelRule(wi.Dir, escapeGlob(relPath(wi.Dir, dir)), label)
+		case isSubdir(dir, wi.Dir):
+			subsumed++
 		}
 	}
 
+	// Unless watches are evicted to make room for new ones, don't exceed
+	// MaxWatches
+	max := s.config.MaxWatches
+	if s.config.EvictionPolicy != client.EvictLRU && max > 0 &&
+		len(dbWatches)-subsumed+1 > max {
+		return &TooManyWatchesErr{max: max}
+	}
+	subsumes := subsumed > 0
+
 	// Insert new watch into watches (syncWatchLoop() will eventually pick it up)
-	_, err = s.db.Exec(fmt.Sprintf(
-		"INSERT INTO watches (last_write, dir, label) VALUES (%d, %q, %q);",
-		s.clock.Now().Unix(), escape.Escape(dir), escape.Escape(label)))
-	if err != nil {
-		return fmt.Errorf("error creating new watch in DB: %v", err)
+	if subsumes {
+		return s.store.SubsumeWatches(dir, label, backend, burstThreshold, s.clock.Now().Unix())
 	}
-	return nil
+	return s.store.AddWatch(dir, label, backend, burstThreshold, s.clock.Now().Unix())
 }
 
 // Watch handles the /watch http endpoint
 func (s *server) Watch(req *client.WatchRequest) error {
-	if err := s.addWatchToDB(req.Dir, req.Label); err != nil {
+	backend := req.Backend
+	if backend == "" {
+		backend = client.BackendAuto
+	}
+	if err := s.addWatchToDB(req.Dir, req.Label, backend, req.BurstThreshold, req.Override); err != nil {
 		return err
 	}
 	if err := s.syncWatches(); err != nil {
@@ -310,36 +551,67 @@ func (s *server) Watch(req *client.WatchRequest) error {
 	return nil
 }
 
-// getDBWatches factors out code to read the set of existing watches from the
-// DB, ordered by the watched dir.
-//
-// Note: dbMu must be held by the caller
-func (s *server) getDBWatches() ([]*dbWatchInfo, error) {
-	rows, err := s.db.Query(fmt.Sprintf("SELECT * FROM watches ORDER BY dir ASC"))
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("could not read existing watches: %v", err)
-	}
-	dbWatches := make([]*dbWatchInfo, 0, maxWatches)
-	for rows.Next() {
-		// parse SQL record
-		var lastWrite int64
-		var escapedDir, escapedLabel string
-		if err := rows.Scan(&lastWrite, &escapedDir, &escapedLabel); err != nil {
-			return nil, fmt.Errorf("error scanning watch rows: %v", err)
-		}
-		dbWatches = append(dbWatches, &dbWatchInfo{
-			lastWrite: time.Unix(lastWrite, 0),
-			dir:       escape.Unescape(escapedDir),
-			label:     escape.Unescape(escapedLabel),
-		})
+// Unwatch implements the corresponding method of the client.TimeTrackerAPI
+// interface
+func (s *server) Unwatch(req *client.UnwatchRequest) error {
+	if err := func() error {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		return s.store.RemoveWatch(req.Dir)
+	}(); err != nil {
+		return err
+	}
+	// tear down the watch now, rather than waiting for syncWatchesLoop
+	return s.syncWatches()
+}
+
+// UpdateWatch implements the corresponding method of the client.TimeTrackerAPI
+// interface
+func (s *server) UpdateWatch(req *client.UpdateWatchRequest) error {
+	if err := func() error {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		return s.store.UpdateWatch(req.Dir, req.Label)
+	}(); err != nil {
+		return err
+	}
+	// update the watch's label now, rather than waiting for syncWatchesLoop
+	return s.syncWatches()
+}
+
+// AddLabelRule implements the corresponding method of the
+// client.TimeTrackerAPI interface
+func (s *server) AddLabelRule(req *client.AddLabelRuleRequest) error {
+	if err := func() error {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		return s.store.AddLabelRule(req.Dir, req.Rule.Path, req.Rule.Label)
+	}(); err != nil {
+		return err
+	}
+	// apply the new rule now, rather than waiting for syncWatchesLoop
+	return s.syncWatches()
+}
+
+// RemoveLabelRule implements the corresponding method of the
+// client.TimeTrackerAPI interface
+func (s *server) RemoveLabelRule(req *client.RemoveLabelRuleRequest) error {
+	if err := func() error {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		return s.store.RemoveLabelRule(req.Dir, req.Path)
+	}(); err != nil {
+		return err
 	}
-	// watches are already sorted in ascending order of last write by SQLite
-	return dbWatches, nil
+	// stop applying the rule now, rather than waiting for syncWatchesLoop
+	return s.syncWatches()
 }
 
+// syncWatchesLoop syncs s.watches with s.store, and then arranges for
+// s.clock to sync them again every 'WatchSyncFrequency' seconds
 func (s *server) syncWatchesLoop() {
 	errCount := 0
-	for {
+	sync := func() {
 		err := s.syncWatches()
 		if err != nil {
 			errCount++
@@ -347,8 +619,70 @@ func (s *server) syncWatchesLoop() {
 		if errCount >= 3 {
 			panic("giving up syncing watches: too many errors")
 		}
-		time.Sleep(watchSyncFrequency)
 	}
+	sync()
+	s.stopSync = s.clock.Every(time.Duration(s.config.WatchSyncFrequency)*time.Second, sync)
+}
+
+// Close stops the server's background work: it stops syncing s.watches with
+// s.store, and cancels every watch (which also stops it recording writes). It
+// doesn't close s.store, which the caller may reuse (e.g. in a new server)
+func (s *server) Close() error {
+	s.stopSync()
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.closed = true
+	for dir, w := range s.watches {
+		w.cancel()
+		delete(s.watches, dir)
+	}
+	return nil
+}
+
+// evictWatches evicts watches from s.store according to the server's eviction
+// policy (see client.Config.EvictionPolicy), and records and logs each
+// eviction. s.storeMu must be held by the caller
+func (s *server) evictWatches() error {
+	if s.config.EvictionPolicy == client.EvictNever {
+		return nil
+	}
+	dbWatches, err := s.store.GetWatches()
+	if err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	var evicted []string
+	var reason string
+	switch s.config.EvictionPolicy {
+	case client.EvictLRU:
+		max := s.config.MaxWatches
+		if max == 0 || len(dbWatches) <= max {
+			return nil
+		}
+		// evict the watches with the oldest last writes
+		sort.SliceStable(dbWatches, func(i, j int) bool {
+			return dbWatches[i].LastWrite.Before(dbWatches[j].LastWrite)
+		})
+		for _, w := range dbWatches[:len(dbWatches)-max] {
+			evicted = append(evicted, w.Dir)
+		}
+		reason = fmt.Sprintf("exceeded max watches (%d); least recently written", max)
+	case client.EvictExpire:
+		expiry := time.Duration(s.config.WatchExpiry) * time.Second
+		for _, w := range dbWatches {
+			if now.Sub(w.LastWrite) > expiry {
+				evicted = append(evicted, w.Dir)
+			}
+		}
+		reason = fmt.Sprintf("no writes for %s", expiry)
+	}
+	if len(evicted) == 0 {
+		return nil
+	}
+	for _, dir := range evicted {
+		log.Warnf("evicting watch on [%s]: %s", dir, reason)
+	}
+	return s.store.EvictWatches(evicted, reason, now.Unix())
 }
 
 type op byte
@@ -358,34 +692,38 @@ const (
 	remove
 )
 
-// syncWatches reads the current set of watched directories in s.db (the source
-// of truth), and updates s.watches and the inotify watches that have been set
-// up in the kernel to align with s.db.
+// syncWatches reads the current set of watched directories in s.store (the
+// source of truth), and updates s.watches and the inotify watches that have
+// been set up in the kernel to align with s.store.
 func (s *server) syncWatches() error {
-	s.dbMu.Lock()
-	// (1) delete any watches in excess of the maximum number of watches (by
-	// selecting the first |actualWatches - maxWatches| watches that were written
-	// furthest in the past)
-	_, err := s.db.Exec(fmt.Sprintf(`
-	  DELETE FROM watches WHERE dir IN (
-	    SELECT dir FROM watches
-	    ORDER BY last_write ASC
-	    LIMIT MAX(0, (SELECT COUNT(*) FROM watches) - %d)
-	  );
-	`, maxWatches))
-
-	// (2) Align set of active watches with watch processes
-	// (2.1) get target set of watches from DB
-	dbWatches, err := s.getDBWatches()
+	dbWatches, err := func() ([]*StoredWatch, error) {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		// (1) evict any watches that the eviction policy calls for, and discard
+		// file activity older than the retention period
+		if err := s.evictWatches(); err != nil {
+			return nil, err
+		}
+		retention := time.Duration(s.config.ActivityRetention) * time.Second
+		if err := s.store.TrimActivity(s.clock.Now().Add(-retention).Unix()); err != nil {
+			return nil, err
+		}
+
+		// (2) Align set of active watches with watch processes
+		// (2.1) get target set of watches from DB
+		return s.store.GetWatches()
+	}()
 	if err != nil {
 		return fmt.Errorf("error syncing watches: %v", err)
 	}
-	s.dbMu.Unlock()
 
 	s.watchMu.Lock()
 	defer s.watchMu.Unlock()
+	if s.closed {
+		return nil // don't restart the watches that Close() cancelled
+	}
 	// (2.2) read existing watches into slice, sorted by name (matches sort order
-	// from getDBWatches)
+	// from s.store.GetWatches)
 	existingWatches := make([]string, 0, len(s.watches))
 	for d := range s.watches {
 		existingWatches = append(existingWatches, d)
@@ -404,44 +742,70 @@ func (s *server) syncWatches() error {
 		case j >= len(dbWatches):
 			o = remove
 			i2++
-		case existingWatches[i] > dbWatches[j].dir:
+		case existingWatches[i] > dbWatches[j].Dir:
 			o = create
 			j2++
-		case existingWatches[i] < dbWatches[j].dir:
+		case existingWatches[i] < dbWatches[j].Dir:
 			o = remove
 			i2++
-		case existingWatches[i] == dbWatches[j].dir:
+		case existingWatches[i] == dbWatches[j].Dir:
+			// watch should & does exist. Just make sure its project and label rules
+			// are up to date (e.g. in case the project was merged into another
+			// project)
+			if s.watches[existingWatches[i]].setProject(dbWatches[j].ProjectID,
+				dbWatches[j].Label, dbWatches[j].Rules) {
+				s.publishWatch(dbWatches[j].Dir, dbWatches[j].Label)
+			}
 			i2++
 			j2++
-			continue // nothing to do -- watch should & does exist
+			continue
 		}
 
 		switch o {
 		case create:
-			log.Infof("syncWatches is setting up watch on [%s]", dbWatches[j].dir)
+			log.Infof("syncWatches is setting up watch on [%s]", dbWatches[j].Dir)
 			ctx, cancel := context.WithCancel(context.Background())
+			// the watcher reports the backend it actually uses once the watch is
+			// established, but guess it now so that GetWatches can report it
+			activeBackend := dbWatches[j].Backend
+			if activeBackend == client.BackendAuto {
+				activeBackend, _ = s.events.DetectBackend(dbWatches[j].Dir)
+			}
 			w := &watch{
-				dir:    dbWatches[j].dir,
-				server: s,
-				label:  dbWatches[j].label,
-				ctx:    ctx,
-				cancel: cancel,
-				start:  time.Now(),
+				dir:       dbWatches[j].Dir,
+				server:    s,
+				projectID: dbWatches[j].ProjectID,
+				label:     dbWatches[j].Label,
+				rules:     dbWatches[j].Rules,
+				backend:   dbWatches[j].Backend,
+				ctx:       ctx,
+				start:     s.clock.Now(),
+				status:    client.WatchHealthy,
+
+				activeBackend:  activeBackend,
+				burstThreshold: dbWatches[j].BurstThreshold,
+				maxEvents:      s.maxEvents(dbWatches[j].BurstThreshold),
+			}
+			// make ticks in the DB every 'TickSyncFrequency' seconds
+			stopRecording := s.clock.Every(
+				time.Duration(s.config.TickSyncFrequency)*time.Second, w.recordWritesInDB)
+			w.cancel = func() {
+				stopRecording()
+				cancel()
 			}
-			s.watches[dbWatches[j].dir] = w
-			go w.recordWritesInDB() // start goro that makes ticks in the DB
-			go func(dir string) {   // start watching for writes to shouldExist
-				if err := watcher.Watch(ctx, dir, w.handleEvent); err != nil {
-					log.Warningf("watch on [%s] failed: %v", dir, err)
-				}
-			}(dbWatches[j].dir) // j will increment--pass dir to fix value inside goro
+			s.watches[dbWatches[j].Dir] = w
+			go w.run() // start watching for writes to w.dir
+			s.publishWatch(w.dir, w.label)
 		case remove:
 			log.Infof("syncWatches is removing watch on [%s]", existingWatches[i])
-			// kill existing watch -- doesn't exist in DB
-			s.watches[existingWatches[i]].cancel()
+			// kill existing watch -- doesn't exist in DB. Note that
+			// 'existingWatches' itself must not be modified here, as i2 has already
+			// advanced past this watch
+			w := s.watches[existingWatches[i]]
+			w.cancel()
 			delete(s.watches, existingWatches[i])
-			n := copy(existingWatches[i:], existingWatches[i+1:])
-			existingWatches = existingWatches[:n]
+			_, label := w.projectFor(w.dir)
+			s.publishWatch(w.dir, label)
 		}
 	}
 	return nil
@@ -456,99 +820,175 @@ func (s *server) GetWatches(req *client.GetWatchesRequest) (*client.GetWatchesRe
 	response := &client.GetWatchesResponse{
 		Watches: make([]*client.WatchInfo, 0, len(s.watches)),
 	}
-	for dir, w := range s.watches {
-		response.Watches = append(response.Watches, &client.WatchInfo{
-			Dir:   dir,
-			Label: w.label,
+	for _, w := range s.watches {
+		response.Watches = append(response.Watches, w.info())
+	}
+	return response, nil
+}
+
+// GetEvictions implements the corresponding method of the
+// client.TimeTrackerAPI interface
+func (s *server) GetEvictions(req *client.GetEvictionsRequest) (*client.GetEvictionsResponse, error) {
+	s.storeMu.RLock()
+	defer s.storeMu.RUnlock()
+	stored, err := s.store.GetEvictions()
+	if err != nil {
+		return nil, err
+	}
+	response := &client.GetEvictionsResponse{
+		Evictions: make([]*client.Eviction, 0, len(stored)),
+	}
+	for _, e := range stored {
+		response.Evictions = append(response.Evictions, &client.Eviction{
+			Dir:    e.Dir,
+			Label:  e.Label,
+			Time:   e.Time,
+			Reason: e.Reason,
 		})
 	}
 	return response, nil
 }
 
+// GetIntervals implements the corresponding method of the
+// client.TimeTrackerAPI interface
 func (s *server) GetIntervals(req *client.GetIntervalsRequest) (*client.GetIntervalsResponse, error) {
-	// Get list of times in the 'req' range from DB
-	var rows *sql.Rows
-	var err error
-	func() {
-		s.dbMu.RLock()
-		defer s.dbMu.RUnlock()
-		// check maxEventGap before and after request, to handle the case where a time
-		// interval overlaps with the request interval
-		start := req.Start - s.maxEventGap
-		end := req.End + s.maxEventGap
-		rows, err = s.db.Query(fmt.Sprintf(
-			"SELECT * FROM ticks WHERE time BETWEEN %d AND %d", start, end,
-		))
-	}()
-	if err != nil && err != sql.ErrNoRows {
+	// Get list of stored intervals in the 'req' range from DB
+	var stored []StoredInterval
+	var lastT int64      // time of the most recent tick (unix seconds)
+	var lastLabel string // label of the most recent tick
+	if err := func() (err error) {
+		s.storeMu.RLock()
+		defer s.storeMu.RUnlock()
+		// check maxEventGap before and after request, to handle the case where a
+		// time interval overlaps with the request interval
+		stored, err = s.store.GetIntervals(req.Start-s.config.MaxEventGap, req.End+s.config.MaxEventGap)
+		if err != nil {
+			return err
+		}
+		lastT, lastLabel, _, err = s.store.LastTick()
+		return err
+	}(); err != nil {
 		return nil, err
 	}
 
-	// Iterate through 'times' and break it up into intervals
+	// Pass stored intervals through a collector per label, which merges any
+	// overlapping intervals and truncates them to [req.Start, req.End]
+	now := s.clock.Now().Unix()
 	collector := make(map[string]*Collector) // map label to collector
-	collector[""] = NewCollector(req.Start, req.End, s.maxEventGap, s.clock.Now().Unix())
-	var (
-		prevLabel string // label that no tick will have initially
-		prevT     int64  // prev tick's time (unix seconds)
-	)
-	for rows.Next() {
-		// parse SQL record
-		var escapedLabel string
-		var t int64
-		rows.Scan(&t, &escapedLabel)
-		if err := rows.Scan(&t, &escapedLabel); err != nil {
-			return nil, fmt.Errorf("error scanning tick row: %v", err)
+	collector[""] = NewCollector(req.Start, req.End, s.config.MaxEventGap, now)
+	for _, i := range stored {
+		if collector[i.Label] == nil {
+			collector[i.Label] = NewCollector(req.Start, req.End, s.config.MaxEventGap, now)
+			collector[i.Label].label = i.Label
 		}
-		label := escape.Unescape(escapedLabel)
+		collector[i.Label].AddInterval(i.Start, i.End)
+	}
 
-		// initialize collector for current activity
-		if collector[label] == nil {
-			collector[label] = NewCollector(req.Start, req.End, s.maxEventGap, s.clock.Now().Unix())
-			collector[label].label = label
+	// If we could extend the rightmost interval, proactively extend it and
+	// indicate how much time has elapsed since the past tick to the caller
+	endGap := int64(0)
+	if lastT > 0 && (now-lastT) < s.config.MaxEventGap {
+		if collector[lastLabel] != nil {
+			collector[lastLabel].Add(now)
 		}
+		collector[""].Add(now)
+		endGap = now - lastT
+	}
 
-		if prevLabel != label {
-			// New activity was started--this activity's interval starts at the end
-			// of the previous activity's interval (if there is one)
-			if prevT > 0 {
-				collector[label].Add(prevT)
+	resp := &client.GetIntervalsResponse{
+		Intervals: collector[""].Finish(),
+		EndGap:    endGap,
+	}
+	if req.Labeled {
+		resp.Labeled = make(map[string][]client.Interval)
+		for label, c := range collector {
+			if label == "" {
+				continue // union of all labels--already in resp.Intervals
+			}
+			if intervals := c.Finish(); len(intervals) > 0 {
+				resp.Labeled[label] = intervals
 			}
-			prevLabel = label
 		}
+	}
+	return resp, nil
+}
 
-		// Add timestamp to collectors
-		prevT = t
-		collector[label].Add(t)
-		collector[""].Add(t)
+// GetActivity implements the corresponding method of the
+// client.TimeTrackerAPI interface
+func (s *server) GetActivity(req *client.GetActivityRequest) (*client.GetActivityResponse, error) {
+	s.storeMu.RLock()
+	defer s.storeMu.RUnlock()
+	files, err := s.store.GetActivity(req.Start, req.End)
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		files = make([]*client.FileActivity, 0)
 	}
+	return &client.GetActivityResponse{Files: files}, nil
+}
 
-	// If we could extend the leftmost interval, proactively extend it and
-	// indicate how much time has elapsed since the past tick to the caller
-	now := s.clock.Now().Unix()
-	endGap := int64(0)
-	if (now - prevT) < s.maxEventGap {
-		collector[prevLabel].Add(now)
-		collector[""].Add(now)
-		endGap = now - prevT
+// GetProjects implements the corresponding method of the
+// client.TimeTrackerAPI interface
+func (s *server) GetProjects(req *client.GetProjectsRequest) (*client.GetProjectsResponse, error) {
+	s.storeMu.RLock()
+	defer s.storeMu.RUnlock()
+	projects, err := s.store.GetProjects()
+	if err != nil {
+		return nil, err
 	}
+	return &client.GetProjectsResponse{Projects: projects}, nil
+}
 
-	// TODO include labelled intervals in response
-	return &client.GetIntervalsResponse{
-		Intervals: collector[""].Finish(),
-		EndGap:    endGap,
-	}, nil
+// RenameProject implements the corresponding method of the
+// client.TimeTrackerAPI interface
+func (s *server) RenameProject(req *client.RenameProjectRequest) error {
+	if err := func() error {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		return s.store.RenameProject(req.From, req.To)
+	}(); err != nil {
+		return err
+	}
+	// update the labels of any existing watches
+	return s.syncWatches()
 }
 
-func (s *server) Clear() error {
-	s.dbMu.Lock()
-	defer s.dbMu.Unlock()
-	if _, err := s.db.Exec(`
-	  DROP TABLE ticks;
-	  DROP TABLE watches;
-	  CREATE TABLE IF NOT EXISTS ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
-	  CREATE TABLE IF NOT EXISTS watches (last_write INTEGER PRIMARY KEY ASC, dir TEXT, label TEXT);
-	`); err != nil {
+// MergeProjects implements the corresponding method of the
+// client.TimeTrackerAPI interface. All intervals and watches belonging to
+// req.From are reassigned to req.Into, and req.From is deleted.
+func (s *server) MergeProjects(req *client.MergeProjectsRequest) error {
+	if err := func() error {
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		return s.store.MergeProjects(req.From, req.Into)
+	}(); err != nil {
 		return err
 	}
-	return nil
+	// point any existing watches on req.From at req.Into
+	return s.syncWatches()
+}
+
+// GetConfig implements the corresponding method of the client.TimeTrackerAPI
+// interface
+func (s *server) GetConfig(req *client.GetConfigRequest) (*client.Config, error) {
+	// s.config is never modified, but return a copy so that callers can't
+	// modify it either
+	config := *s.config
+	if s.config.Labels != nil {
+		config.Labels = make(map[string]*client.LabelConfig, len(s.config.Labels))
+		for label, lc := range s.config.Labels {
+			lcCopy := *lc
+			config.Labels[label] = &lcCopy
+		}
+	}
+	return &config, nil
+}
+
+// Clear implements the corresponding method of the client.TimeTrackerAPI
+// interface
+func (s *server) Clear() error {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	return s.store.Clear()
 }
@@ -1,16 +1,24 @@
 package watchd
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/msteffen/golang-time-tracker/client"
 	"github.com/msteffen/golang-time-tracker/pkg/check"
+	"github.com/msteffen/golang-time-tracker/pkg/escape"
+	"github.com/msteffen/golang-time-tracker/pkg/watcher"
 
 	"github.com/google/uuid"
 )
@@ -59,6 +67,705 @@ func TestParsing(t *testing.T) {
 		}))
 }
 
+// TestLabeledIntervals checks that GetIntervals returns the intervals for each
+// label (alongside their union) when the caller requests them
+func TestLabeledIntervals(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		ts := time.Date(
+			/* date */ 2017, 7, 1,
+			/* time */ 12, 0, 0,
+			/* nsec, location */ 0, time.Local)
+		s.Set(ts)
+
+		// "a" at 12:00-12:02, "b" at 12:03-12:04, and "a" again at 12:34-12:35
+		s.TickAt("a", 0, 1, 1)
+		s.TickAt("b", 1, 1)
+		s.TickAt("a", 30, 1)
+		at := func(minutes int) int64 {
+			return ts.Add(time.Duration(minutes) * time.Minute).Unix()
+		}
+
+		morning := time.Date(2017, 7, 1, 0, 0, 0, 0, time.Local)
+		night := morning.Add(24 * time.Hour)
+		actual, err := s.GetLabeledIntervals(morning, night)
+		check.T(t,
+			check.Nil(err),
+			check.Eq(actual, &client.GetIntervalsResponse{
+				Intervals: []client.Interval{
+					{Start: at(0), End: at(4)},
+					{Start: at(34), End: at(35)},
+				},
+				Labeled: map[string][]client.Interval{
+					// the first "a" interval extends to the first tick after "b"'s last tick
+					"a": {
+						{Start: at(0), End: at(4), Label: "a"},
+						{Start: at(34), End: at(35), Label: "a"},
+					},
+					// "b"'s interval starts at the last "a" tick before it
+					"b": {
+						{Start: at(2), End: at(4), Label: "b"},
+					},
+				},
+			}))
+
+		// Labeled intervals are omitted unless they're requested
+		actual, err = s.GetIntervals(morning, night)
+		check.T(t,
+			check.Nil(err),
+			check.Eq(actual.Labeled, map[string][]client.Interval(nil)))
+	})
+}
+
+// TestMigrateTicks checks that ticks stored in the old 'ticks' table are
+// folded into intervals when the server starts
+func TestMigrateTicks(t *testing.T) {
+	s := StartTestServer(t)
+	ts := time.Date(
+		/* date */ 2017, 7, 1,
+		/* time */ 12, 0, 0,
+		/* nsec, location */ 0, time.Local)
+	s.Set(ts.Add(time.Hour))
+	at := func(minutes int) int64 {
+		return ts.Add(time.Duration(minutes) * time.Minute).Unix()
+	}
+
+	// Create a DB with the old schema, containing the same ticks as
+	// TestLabeledIntervals
+	dbFile := path.Join(dbDir, t.Name()+"-old")
+	db, err := sql.Open("sqlite3", dbFile)
+	check.T(t, check.Nil(err))
+	_, err = db.Exec(`
+	  CREATE TABLE ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
+	  CREATE TABLE watches (last_write INTEGER, dir TEXT, label TEXT);
+	`)
+	check.T(t, check.Nil(err))
+	for _, tick := range []struct {
+		minutes int
+		label   string
+	}{{0, "a"}, {1, "a"}, {2, "a"}, {3, "b"}, {4, "b"}, {34, "a"}, {35, "a"}} {
+		_, err = db.Exec(fmt.Sprintf("INSERT INTO ticks (time, labels) VALUES (%d, %q)",
+			at(tick.minutes), tick.label))
+		check.T(t, check.Nil(err))
+	}
+	check.T(t, check.Nil(db.Close()))
+
+	// Start a server on the old DB and check its intervals
+	apiServer, err := NewServer(s.TestingClock, dbFile, nil)
+	check.T(t, check.Nil(err))
+	morning := time.Date(2017, 7, 1, 0, 0, 0, 0, time.Local)
+	actual, err := apiServer.GetIntervals(&client.GetIntervalsRequest{
+		Start:   morning.Unix(),
+		End:     morning.Add(24 * time.Hour).Unix(),
+		Labeled: true,
+	})
+	check.T(t,
+		check.Nil(err),
+		check.Eq(actual, &client.GetIntervalsResponse{
+			Intervals: []client.Interval{
+				{Start: at(0), End: at(4)},
+				{Start: at(34), End: at(35)},
+			},
+			Labeled: map[string][]client.Interval{
+				"a": {
+					{Start: at(0), End: at(4), Label: "a"},
+					{Start: at(34), End: at(35), Label: "a"},
+				},
+				"b": {
+					{Start: at(2), End: at(4), Label: "b"},
+				},
+			},
+		}))
+
+	// The old table should be gone
+	var n int
+	check.T(t, check.Nil(apiServer.(*server).store.(*sqliteStore).db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE name = 'ticks'`).Scan(&n)))
+	check.T(t, check.Eq(n, 0))
+}
+
+// TestMigrateTicksMaxEventGap checks that legacy ticks are folded into
+// intervals with the configured max event gap, rather than the default
+func TestMigrateTicksMaxEventGap(t *testing.T) {
+	s := StartTestServer(t)
+	ts := time.Date(
+		/* date */ 2017, 7, 1,
+		/* time */ 12, 0, 0,
+		/* nsec, location */ 0, time.Local)
+	s.Set(ts.Add(2 * time.Hour)) // not within the max event gap of the last tick
+	at := func(minutes int) int64 {
+		return ts.Add(time.Duration(minutes) * time.Minute).Unix()
+	}
+
+	// Create a DB with the old schema, containing the same ticks as
+	// TestMigrateTicks
+	dbFile := path.Join(dbDir, t.Name()+"-old")
+	db, err := sql.Open("sqlite3", dbFile)
+	check.T(t, check.Nil(err))
+	_, err = db.Exec(`
+	  CREATE TABLE ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
+	  CREATE TABLE watches (last_write INTEGER, dir TEXT, label TEXT);
+	`)
+	check.T(t, check.Nil(err))
+	for _, tick := range []struct {
+		minutes int
+		label   string
+	}{{0, "a"}, {1, "a"}, {2, "a"}, {3, "b"}, {4, "b"}, {34, "a"}, {35, "a"}} {
+		_, err = db.Exec(fmt.Sprintf("INSERT INTO ticks (time, labels) VALUES (%d, %q)",
+			at(tick.minutes), tick.label))
+		check.T(t, check.Nil(err))
+	}
+	check.T(t, check.Nil(db.Close()))
+
+	// With a max event gap of 40 minutes, the 30-minute gap doesn't split "a"
+	config := DefaultConfig()
+	config.MaxEventGap = 40 * s_Minute
+	apiServer, err := NewServer(s.TestingClock, dbFile, config)
+	check.T(t, check.Nil(err))
+	morning := time.Date(2017, 7, 1, 0, 0, 0, 0, time.Local)
+	actual, err := apiServer.GetIntervals(&client.GetIntervalsRequest{
+		Start:   morning.Unix(),
+		End:     morning.Add(24 * time.Hour).Unix(),
+		Labeled: true,
+	})
+	check.T(t,
+		check.Nil(err),
+		check.Eq(actual, &client.GetIntervalsResponse{
+			Intervals: []client.Interval{
+				{Start: at(0), End: at(35)},
+			},
+			Labeled: map[string][]client.Interval{
+				"a": {
+					{Start: at(0), End: at(35), Label: "a"},
+				},
+				"b": {
+					{Start: at(2), End: at(4), Label: "b"},
+				},
+			},
+		}))
+
+	// An invalid config is rejected before the DB is migrated
+	_, err = NewServer(s.TestingClock, path.Join(dbDir, t.Name()+"-invalid"),
+		&client.Config{MaxEventGap: -1})
+	check.T(t, check.NotNil(err))
+	_, err = MigrateDB(dbFile, 0, true)
+	check.T(t, check.NotNil(err))
+}
+
+// TestMigrateEmptyLabelTicks checks that ticks with empty labels, which the
+// original /tick handler stored despite rejecting them, are folded into the
+// union of all projects' intervals, rather than preventing the migration
+func TestMigrateEmptyLabelTicks(t *testing.T) {
+	s := StartTestServer(t)
+	ts := time.Date(
+		/* date */ 2017, 7, 1,
+		/* time */ 12, 0, 0,
+		/* nsec, location */ 0, time.Local)
+	s.Set(ts.Add(time.Hour))
+	at := func(minutes int) int64 {
+		return ts.Add(time.Duration(minutes) * time.Minute).Unix()
+	}
+
+	dbFile := path.Join(dbDir, t.Name()+"-old")
+	db, err := sql.Open("sqlite3", dbFile)
+	check.T(t, check.Nil(err))
+	_, err = db.Exec(`
+	  CREATE TABLE ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
+	  CREATE TABLE watches (last_write INTEGER, dir TEXT, label TEXT);
+	`)
+	check.T(t, check.Nil(err))
+	for _, tick := range []struct {
+		minutes int
+		label   string
+	}{{0, "a"}, {1, "a"}, {2, ""}, {3, ""}, {4, "a"}, {30, ""}, {31, ""}} {
+		_, err = db.Exec(fmt.Sprintf("INSERT INTO ticks (time, labels) VALUES (%d, %q)",
+			at(tick.minutes), tick.label))
+		check.T(t, check.Nil(err))
+	}
+	check.T(t, check.Nil(db.Close()))
+
+	// Both a dry run and a real migration should succeed
+	_, err = MigrateDB(dbFile, defaultMaxEventGap, true)
+	check.T(t, check.Nil(err))
+	apiServer, err := NewServer(s.TestingClock, dbFile, nil)
+	check.T(t, check.Nil(err))
+	morning := time.Date(2017, 7, 1, 0, 0, 0, 0, time.Local)
+	actual, err := apiServer.GetIntervals(&client.GetIntervalsRequest{
+		Start:   morning.Unix(),
+		End:     morning.Add(24 * time.Hour).Unix(),
+		Labeled: true,
+	})
+	check.T(t,
+		check.Nil(err),
+		check.Eq(actual, &client.GetIntervalsResponse{
+			Intervals: []client.Interval{
+				{Start: at(0), End: at(4)},
+				{Start: at(30), End: at(31)},
+			},
+			Labeled: map[string][]client.Interval{
+				"a": {
+					{Start: at(0), End: at(4), Label: "a"},
+				},
+			},
+		}))
+	projects, err := apiServer.GetProjects(&client.GetProjectsRequest{})
+	check.T(t,
+		check.Nil(err),
+		check.Eq(len(projects.Projects), 1))
+}
+
+// TestSchemaVersion checks that the server records the DB's schema version,
+// that dry-run migrations don't modify the DB, and that the server refuses to
+// start on a DB with a newer schema than it knows about
+func TestSchemaVersion(t *testing.T) {
+	s := StartTestServer(t)
+	dbFile := path.Join(dbDir, t.Name()+"-old")
+	db, err := sql.Open("sqlite3", dbFile)
+	check.T(t, check.Nil(err))
+	defer db.Close()
+	_, err = db.Exec(`
+	  CREATE TABLE ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
+	  INSERT INTO ticks (time, labels) VALUES (100, "a");
+	`)
+	check.T(t, check.Nil(err))
+
+	// A dry run reports all steps, but doesn't apply them
+	plan, err := MigrateDB(dbFile, defaultMaxEventGap, true)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(plan.From, 0),
+		check.Eq(plan.To, len(migrations)),
+		check.Eq(len(plan.Steps), len(migrations)))
+	ok, err := hasTable(db, "ticks")
+	check.T(t, check.Nil(err), check.True(ok))
+	version, err := currentSchemaVersion(db)
+	check.T(t, check.Nil(err), check.Eq(version, 0))
+
+	// NewServer applies all steps
+	apiServer, err := NewServer(s.TestingClock, dbFile, nil)
+	check.T(t, check.Nil(err))
+	version, err = currentSchemaVersion(db)
+	check.T(t, check.Nil(err), check.Eq(version, len(migrations)))
+	ok, err = hasTable(db, "ticks")
+	check.T(t, check.Nil(err), check.False(ok))
+
+	// Clear doesn't change the schema
+	check.T(t, check.Nil(apiServer.Clear()))
+	version, err = currentSchemaVersion(db)
+	check.T(t, check.Nil(err), check.Eq(version, len(migrations)))
+
+	// The server won't start on a DB from the future
+	_, err = db.Exec(fmt.Sprintf(
+		"INSERT INTO schema_version (version, description) VALUES (%d, 'future')",
+		len(migrations)+1))
+	check.T(t, check.Nil(err))
+	_, err = NewServer(s.TestingClock, dbFile, nil)
+	check.T(t, check.NotNil(err))
+}
+
+// TestArbitraryLabels checks that labels containing quotes, backslashes, and
+// other characters that are special in SQL or Go are stored and returned as-is
+func TestArbitraryLabels(t *testing.T) {
+	s := StartTestServer(t)
+	ts := time.Date(
+		/* date */ 2017, 7, 1,
+		/* time */ 12, 0, 0,
+		/* nsec, location */ 0, time.Local)
+	s.Set(ts)
+	labels := []string{`a"b`, `c\d`, "e'f; DROP TABLE intervals; --", "g\th\x00é"}
+	for _, l := range labels {
+		s.TickAt(l, 1)
+	}
+	resp, err := s.GetProjects()
+	check.T(t, check.Nil(err), check.Eq(len(resp.Projects), len(labels)))
+	actual := make(map[string]bool)
+	for _, p := range resp.Projects {
+		actual[p.Name] = true
+	}
+	for _, l := range labels {
+		check.T(t, check.True(actual[l]))
+	}
+}
+
+// TestEmptyLabel checks that ticks, watches, and label rules labeled "" (which
+// GetIntervals uses for the union of all projects) are rejected by both stores
+// rather than creating a project, and that no project can be renamed to ""
+func TestEmptyLabel(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		s.Set(time.Date(2017, 7, 1, 12, 0, 0, 0, time.Local))
+		now := s.TestingClock.Now().Unix()
+		_, err := s.PostString("/tick", `{"label":""}`)
+		check.T(t,
+			check.NotNil(err),
+			check.Eq(err.(*client.HTTPError).StatusCode, http.StatusBadRequest),
+			check.NotNil(s.store.AddTick(now, "", s.maxEventGap)))
+
+		check.T(t,
+			check.NotNil(s.store.AddWatch("/tmp/x", "", "auto", 0, now)),
+			check.Nil(s.store.AddWatch("/tmp/y/z", "a", "auto", 0, now)),
+			check.NotNil(s.store.SubsumeWatches("/tmp/y", "", "auto", 0, now)),
+			check.NotNil(s.store.AddLabelRule("/tmp/y/z", "docs", "")),
+			check.NotNil(s.store.UpdateWatch("/tmp/y/z", "")),
+			check.NotNil(s.store.RenameProject("a", "")))
+		// The rejected SubsumeWatches shouldn't have removed /tmp/y/z
+		watches, err := s.store.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(watches), 1),
+			check.Eq(watches[0].Dir, "/tmp/y/z"),
+			check.Eq(watches[0].Label, "a"))
+		resp, err := s.GetProjects()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(resp.Projects), 1),
+			check.Eq(resp.Projects[0].Name, "a"))
+	})
+}
+
+// TestUnescapeLegacyText checks that the migration to raw text decodes labels
+// and dirs written by versions of the server that used fmt.Sprintf and %q (and
+// that unlabeled watches are labeled with the base names of their dirs)
+func TestUnescapeLegacyText(t *testing.T) {
+	s := StartTestServer(t)
+	dbFile := path.Join(dbDir, t.Name()+"-old")
+	db, err := sql.Open("sqlite3", dbFile)
+	check.T(t, check.Nil(err))
+	defer db.Close()
+	_, err = db.Exec(`
+	  CREATE TABLE ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
+	  CREATE TABLE watches (last_write INTEGER, dir TEXT, label TEXT);
+	`)
+	check.T(t, check.Nil(err))
+	// Write data the way that old versions of the server did (note that labels
+	// with '"' could not be written at all)
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO ticks (time, labels) VALUES (100, %q)",
+		escape.Escape(`a\b`)))
+	check.T(t, check.Nil(err))
+	_, err = db.Exec(fmt.Sprintf(
+		"INSERT INTO watches (last_write, dir, label) VALUES (100, %q, %q)",
+		escape.Escape("/tmp/x\ty"), escape.Escape("é\u0001")))
+	check.T(t, check.Nil(err))
+	_, err = db.Exec(`INSERT INTO watches (last_write, dir, label) VALUES (100, "/tmp/unlabeled", "")`)
+	check.T(t, check.Nil(err))
+
+	_, err = NewServer(s.TestingClock, dbFile, nil)
+	check.T(t, check.Nil(err))
+	var names []string
+	rows, err := db.Query("SELECT name FROM projects ORDER BY name")
+	check.T(t, check.Nil(err))
+	for rows.Next() {
+		var name string
+		check.T(t, check.Nil(rows.Scan(&name)))
+		names = append(names, name)
+	}
+	check.T(t, check.Eq(names, []string{`a\b`, "unlabeled", "é\u0001"}))
+	var dirs []string
+	rows, err = db.Query("SELECT dir FROM watches ORDER BY dir")
+	check.T(t, check.Nil(err))
+	for rows.Next() {
+		var dir string
+		check.T(t, check.Nil(rows.Scan(&dir)))
+		dirs = append(dirs, dir)
+	}
+	check.T(t, check.Eq(dirs, []string{"/tmp/unlabeled", "/tmp/x\ty"}))
+}
+
+// TestMigrateLegacyLabels checks the migration of a DB containing the mix of
+// labels that old versions of the server wrote: labels without special
+// characters (which escaping didn't change), escaped labels, and empty labels,
+// in both ticks and watches
+func TestMigrateLegacyLabels(t *testing.T) {
+	s := StartTestServer(t)
+	ts := time.Date(
+		/* date */ 2017, 7, 1,
+		/* time */ 12, 0, 0,
+		/* nsec, location */ 0, time.Local)
+	s.Set(ts.Add(time.Hour))
+	at := func(minutes int) int64 {
+		return ts.Add(time.Duration(minutes) * time.Minute).Unix()
+	}
+
+	dbFile := path.Join(dbDir, t.Name()+"-old")
+	db, err := sql.Open("sqlite3", dbFile)
+	check.T(t, check.Nil(err))
+	defer db.Close()
+	_, err = db.Exec(`
+	  CREATE TABLE ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);
+	  CREATE TABLE watches (last_write INTEGER, dir TEXT, label TEXT);
+	`)
+	check.T(t, check.Nil(err))
+	for _, tick := range []struct {
+		minutes int
+		label   string
+	}{{0, "a"}, {1, `a\b`}, {2, `a\b`}, {3, ""}, {4, "x\ty"}, {5, "a"}} {
+		_, err = db.Exec(fmt.Sprintf("INSERT INTO ticks (time, labels) VALUES (%d, %q)",
+			at(tick.minutes), escape.Escape(tick.label)))
+		check.T(t, check.Nil(err))
+	}
+	for _, w := range []struct{ dir, label string }{
+		{"/tmp/a", "a"}, {"/tmp/a\\b", `a\b`}, {"/tmp/x\ty", "x\ty"},
+	} {
+		_, err = db.Exec(fmt.Sprintf(
+			"INSERT INTO watches (last_write, dir, label) VALUES (100, %q, %q)",
+			escape.Escape(w.dir), escape.Escape(w.label)))
+		check.T(t, check.Nil(err))
+	}
+
+	apiServer, err := NewServer(s.TestingClock, dbFile, nil)
+	check.T(t, check.Nil(err))
+	morning := time.Date(2017, 7, 1, 0, 0, 0, 0, time.Local)
+	actual, err := apiServer.GetIntervals(&client.GetIntervalsRequest{
+		Start:   morning.Unix(),
+		End:     morning.Add(24 * time.Hour).Unix(),
+		Labeled: true,
+	})
+	check.T(t,
+		check.Nil(err),
+		check.Eq(actual, &client.GetIntervalsResponse{
+			Intervals: []client.Interval{
+				{Start: at(0), End: at(5)},
+			},
+			Labeled: map[string][]client.Interval{
+				"a": {
+					{Start: at(0), End: at(5), Label: "a"},
+				},
+				`a\b`: {
+					{Start: at(0), End: at(2), Label: `a\b`},
+				},
+				"x\ty": {
+					{Start: at(2), End: at(4), Label: "x\ty"},
+				},
+			},
+		}))
+
+	// Each watch should refer to the same project as the ticks with its label
+	watches := make(map[string]string)
+	rows, err := db.Query(`
+	  SELECT w.dir, p.name FROM watches w JOIN projects p ON p.id = w.project_id
+	`)
+	check.T(t, check.Nil(err))
+	for rows.Next() {
+		var dir, name string
+		check.T(t, check.Nil(rows.Scan(&dir, &name)))
+		watches[dir] = name
+	}
+	check.T(t, check.Eq(watches, map[string]string{
+		"/tmp/a": "a", "/tmp/a\\b": `a\b`, "/tmp/x\ty": "x\ty",
+	}))
+	var n int
+	check.T(t, check.Nil(db.QueryRow("SELECT COUNT(*) FROM projects").Scan(&n)))
+	check.T(t, check.Eq(n, 3))
+}
+
+// TestRenameAndMergeProjects checks that renaming or merging projects changes
+// the labels of their existing intervals
+func TestRenameAndMergeProjects(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		ts := time.Date(
+			/* date */ 2017, 7, 1,
+			/* time */ 12, 0, 0,
+			/* nsec, location */ 0, time.Local)
+		s.Set(ts)
+		s.TickAt("a", 0, 1, 1)
+		s.TickAt("b", 1, 1)
+		s.TickAt("a", 30, 1)
+		at := func(minutes int) int64 {
+			return ts.Add(time.Duration(minutes) * time.Minute).Unix()
+		}
+		morning := time.Date(2017, 7, 1, 0, 0, 0, 0, time.Local)
+		night := morning.Add(24 * time.Hour)
+
+		// Rename "a" to "c". It should keep its ID and its history
+		before, err := s.GetProjects()
+		check.T(t, check.Nil(err))
+		check.T(t, check.Nil(s.RenameProject("a", "c")))
+		after, err := s.GetProjects()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(after, &client.GetProjectsResponse{
+				Projects: []*client.ProjectInfo{
+					{ID: before.Projects[1].ID, Name: "b"},
+					{ID: before.Projects[0].ID, Name: "c"},
+				},
+			}))
+		actual, err := s.GetLabeledIntervals(morning, night)
+		check.T(t,
+			check.Nil(err),
+			check.Eq(actual.Labeled, map[string][]client.Interval{
+				"b": {
+					{Start: at(2), End: at(4), Label: "b"},
+				},
+				"c": {
+					{Start: at(0), End: at(4), Label: "c"},
+					{Start: at(34), End: at(35), Label: "c"},
+				},
+			}))
+
+		// Renaming onto an existing project or renaming a nonexistent project fails
+		err = s.RenameProject("c", "b")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusConflict))
+		err = s.RenameProject("a", "d")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+
+		// Merge "b" into "c". "b" should be deleted, and its intervals should be
+		// merged with "c"'s
+		check.T(t, check.Nil(s.MergeProjects("b", "c")))
+		after, err = s.GetProjects()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(after, &client.GetProjectsResponse{
+				Projects: []*client.ProjectInfo{
+					{ID: before.Projects[0].ID, Name: "c"},
+				},
+			}))
+		actual, err = s.GetLabeledIntervals(morning, night)
+		check.T(t,
+			check.Nil(err),
+			check.Eq(actual.Labeled, map[string][]client.Interval{
+				"c": {
+					{Start: at(0), End: at(4), Label: "c"},
+					{Start: at(34), End: at(35), Label: "c"},
+				},
+			}))
+	})
+}
+
+// TestConfig checks that the server reports the settings it was started with,
+// and that it uses them to fold ticks into intervals
+func TestConfig(t *testing.T) {
+	config := &client.Config{
+		MaxEventGap:        5 * s_Minute,
+		MinCountedInterval: 30 * s_Minute,
+		Labels: map[string]*client.LabelConfig{
+			"email": {MinCountedInterval: 10 * s_Minute},
+		},
+		MaxWatches:         2,
+		EvictionPolicy:     client.EvictNever,
+		PollInterval:       1,
+		ActivityDetail:     true,
+		ActivityRetention:  s_Day,
+		BurstThreshold:     10,
+		TickSyncFrequency:  1,
+		WatchSyncFrequency: 1,
+	}
+	s := StartMemoryTestServerWithConfig(t, config)
+	actual, err := s.GetConfig()
+	check.T(t,
+		check.Nil(err),
+		check.Eq(actual, config))
+
+	// Ticks 10 minutes apart are in separate intervals (unlike with the default
+	// max event gap)
+	ts := time.Date(
+		/* date */ 2017, 7, 1,
+		/* time */ 12, 0, 0,
+		/* nsec, location */ 0, time.Local)
+	s.Set(ts)
+	s.TickAt("work", 0, 4, 10, 1)
+	resp, err := s.GetIntervals(ts.Add(-time.Hour), ts.Add(time.Hour))
+	check.T(t,
+		check.Nil(err),
+		check.Eq(resp.Intervals, []client.Interval{
+			{Start: ts.Unix(), End: ts.Add(4 * time.Minute).Unix()},
+			{Start: ts.Add(14 * time.Minute).Unix(), End: ts.Add(15 * time.Minute).Unix()},
+		}))
+
+	// Invalid configs are rejected
+	_, err = NewServerWithStore(&TestingClock{}, NewMemoryStore(),
+		&client.Config{MaxEventGap: 0})
+	check.T(t, check.NotNil(err))
+}
+
+// TestPublicEndpoints checks that only /viz, /status and /events are served on
+// the test server's TCP address, and that its control socket is private
+func TestPublicEndpoints(t *testing.T) {
+	s := StartMemoryTestServer(t)
+	_, err := s.Public.Get("/viz")
+	check.T(t, check.Nil(err))
+	// the page refreshes itself with the JSON version of /viz
+	resp, err := s.Public.Get("/viz?format=json")
+	check.T(t, check.Nil(err))
+	var days []map[string]interface{}
+	check.T(t,
+		check.Nil(json.NewDecoder(resp.Body).Decode(&days)),
+		check.Eq(len(days), 5))
+	resp.Body.Close()
+	_, err = s.Public.Tick("work")
+	check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+	_, err = s.Public.Get("/watches")
+	check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+
+	// The same endpoints work on the socket
+	_, err = s.Tick("work")
+	check.T(t, check.Nil(err))
+	info, err := os.Stat(s.socketFile)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(info.Mode().Perm(), os.FileMode(0600)))
+}
+
+// TestAuthentication checks that requests to non-public endpoints without the
+// server's token are rejected
+func TestAuthentication(t *testing.T) {
+	s := StartMemoryTestServer(t)
+	for _, c := range []*client.Client{
+		{Address: s.Address},                       // no token
+		{Address: s.Address, Token: "not-a-token"}, // wrong token
+	} {
+		_, err := c.Tick("work")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusUnauthorized))
+		_, err = c.Get("/tick") // GETs must be authenticated too
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusUnauthorized))
+		err = c.Clear()
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusUnauthorized))
+
+		// public endpoints don't require a token
+		_, err = c.Get("/viz")
+		check.T(t, check.Nil(err))
+		_, err = c.Status()
+		check.T(t, check.Nil(err))
+	}
+	_, err := s.Tick("work")
+	check.T(t, check.Nil(err))
+}
+
+// TestServeCleansUp checks that if one of Serve's servers fails, Serve shuts
+// down the other one and removes its socket before returning
+func TestServeCleansUp(t *testing.T) {
+	api, err := NewServerWithStore(&TestingClock{}, NewMemoryStore(), nil)
+	check.T(t, check.Nil(err))
+	defer api.(*server).Close()
+	socketFile := path.Join(t.TempDir(), "sock")
+	// 'hostport' is invalid, so the public server fails immediately
+	err = Serve(socketFile, "localhost:not-a-port", &TestingClock{}, api, "token")
+	check.T(t, check.NotNil(err))
+	_, err = os.Stat(socketFile)
+	check.T(t, check.True(os.IsNotExist(err)))
+}
+
+func TestLoadOrCreateToken(t *testing.T) {
+	check.T(t, check.Nil(os.MkdirAll(dbDir, 0700)))
+	tokenFile := path.Join(dbDir, t.Name()+".token")
+	os.Remove(tokenFile)
+	defer os.Remove(tokenFile)
+	token, err := LoadOrCreateToken(tokenFile)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(len(token), 2*tokenBytes))
+	info, err := os.Stat(tokenFile)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(info.Mode().Perm(), os.FileMode(0600)))
+
+	// Loading the token again returns the same token
+	again, err := LoadOrCreateToken(tokenFile)
+	check.T(t,
+		check.Nil(err),
+		check.Eq(again, token))
+}
+
 // TestGetIntervalsBoundary checks that GetIntervals only returns intervals
 // within the given time range
 func TestGetIntervalsBoundary(t *testing.T) {
@@ -157,7 +864,7 @@ func testWritesCreateWorkInterval(s *TestServer, dir string) {
 		check.T(s.T,
 			check.Nil(err),
 			check.Nil(f.Close()))
-		time.Sleep(tickSyncFrequency + tEpsilon) // wait for write-batching watcher
+		time.Sleep(tEpsilon) // wait for the watcher (s.Add() then records the write)
 		s.Add(eventGap)
 	}
 
@@ -221,7 +928,7 @@ func TestMaxWatches(t *testing.T) {
 		/* nsec, location */ 0, time.Local)
 	s.Set(ts)
 
-	dirsToWatch := maxWatches + 1
+	dirsToWatch := defaultMaxWatches + 1
 	for i := 0; i < dirsToWatch; i++ {
 		dir := path.Join(testDir, fmt.Sprintf("%s-%d", dirPrefix, i))
 		// create "dir"
@@ -285,7 +992,7 @@ func TestMaxWatches(t *testing.T) {
 		newFilePath := path.Join(dir, fmt.Sprintf("file-%d", getFileNumber()))
 		f, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_RDWR, 0644)
 		check.T(t, check.Nil(err), check.Nil(f.Close()))
-		time.Sleep(tickSyncFrequency + tEpsilon) // wait for write-batching watcher
+		time.Sleep(tEpsilon) // wait for the watcher (s.Add() then records the write)
 		s.Add(eventGap)
 	}
 
@@ -306,8 +1013,8 @@ func TestWatchesPersistOnRestart(t *testing.T) {
 
 	// Create test dirs
 	dirsToWatch := 3
-	if maxWatches < dirsToWatch {
-		dirsToWatch = maxWatches
+	if defaultMaxWatches < dirsToWatch {
+		dirsToWatch = defaultMaxWatches
 	}
 	for i := 0; i < dirsToWatch; i++ {
 		dir := path.Join(testDir, fmt.Sprintf("%s-%d", dirPrefix, i))
@@ -334,8 +1041,7 @@ func TestWatchesPersistOnRestart(t *testing.T) {
 
 	// restart test server
 	s.Restart(t)
-	// TODO replace this sleep with a retry loop around the test below
-	time.Sleep(5 * time.Second)
+	time.Sleep(tEpsilon) // wait for the watches to be established
 
 	for i := 0; i < dirsToWatch; i++ {
 		dir := path.Join(testDir, fmt.Sprintf("%s-%d", dirPrefix, i))
@@ -343,3 +1049,861 @@ func TestWatchesPersistOnRestart(t *testing.T) {
 		testWritesCreateWorkInterval(s, dir)
 	}
 }
+
+func TestUnwatchAndRelabel(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		ts := time.Date(
+			/* date */ 2017, 7, 1,
+			/* time */ 6, 0, 0,
+			/* nsec, location */ 0, time.Local)
+		s.Set(ts)
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		check.T(t, check.Nil(os.MkdirAll(dir, 0755)))
+		installWatch(s, dir)
+
+		// Relabel the watch. The new label should be visible immediately
+		check.T(t, check.Nil(s.UpdateWatch(dir, "relabeled")))
+		watches, err := s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches, []*client.WatchInfo{{
+				Dir:           dir,
+				Label:         "relabeled",
+				Status:        client.WatchHealthy,
+				Backend:       client.BackendAuto,
+				ActiveBackend: client.BackendInotify,
+			}}))
+
+		// Unwatch the dir. It should be gone immediately
+		check.T(t, check.Nil(s.Unwatch(dir)))
+		watches, err = s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(watches.Watches), 0))
+
+		// Unwatching or relabeling a dir that isn't watched fails
+		err = s.Unwatch(dir)
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+		err = s.UpdateWatch(dir, "other")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+
+		// The dir can be watched again
+		installWatch(s, dir)
+		watches, err = s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(watches.Watches), 1))
+	})
+}
+
+func TestMergeWatches(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		ts := time.Date(
+			/* date */ 2017, 7, 1,
+			/* time */ 6, 0, 0,
+			/* nsec, location */ 0, time.Local)
+		s.Set(ts)
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		for _, sub := range []string{"a", "b/c", "d"} {
+			check.T(t, check.Nil(os.MkdirAll(path.Join(dir, sub), 0755)))
+		}
+		check.T(t,
+			check.Nil(s.Watch(path.Join(dir, "a"), "a")),
+			check.Nil(s.Watch(path.Join(dir, "b/c"), "c")))
+
+		// Watching 'dir' subsumes the existing watches, which become label rules
+		check.T(t, check.Nil(s.Watch(dir, "parent")))
+		watches, err := s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches, []*client.WatchInfo{{
+				Dir:           dir,
+				Label:         "parent",
+				Status:        client.WatchHealthy,
+				Backend:       client.BackendAuto,
+				ActiveBackend: client.BackendInotify,
+				Rules: []*client.LabelRule{
+					{Path: "a", Label: "a"},
+					{Path: "b/c", Label: "c"},
+				},
+			}}))
+
+		// Watching a subdirectory of 'dir' is a no-op, unless it overrides the
+		// label of the subdirectory
+		check.T(t,
+			check.Nil(s.Watch(path.Join(dir, "d"), "d")),
+			check.Nil(s.WatchWithOverride(path.Join(dir, "b"), "b", true)))
+		watches, err = s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches, []*client.WatchInfo{{
+				Dir:           dir,
+				Label:         "parent",
+				Status:        client.WatchHealthy,
+				Backend:       client.BackendAuto,
+				ActiveBackend: client.BackendInotify,
+				Rules: []*client.LabelRule{
+					{Path: "a", Label: "a"},
+					{Path: "b", Label: "b"},
+					{Path: "b/c", Label: "c"},
+				},
+			}}))
+
+		// Writes under b/c are labeled with the most specific rule
+		s.Add(time.Duration(s.maxEventGap+1) * time.Second)
+		start := s.TestingClock.Now()
+		for i := 0; i < 2; i++ {
+			f, err := os.Create(path.Join(dir, "b/c", fmt.Sprintf("file-%d", getFileNumber())))
+			check.T(t,
+				check.Nil(err),
+				check.Nil(f.Close()))
+			time.Sleep(tEpsilon) // wait for the watcher (s.Add() then records the write)
+			s.Add(time.Minute)
+		}
+		resp, err := s.GetLabeledIntervals(start, start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(resp.Labeled["c"], []client.Interval{{
+				Start: start.Unix(),
+				End:   start.Add(2 * time.Minute).Unix(),
+				Label: "c",
+			}}))
+
+		// Unwatching 'dir' removes its rules too
+		check.T(t, check.Nil(s.Unwatch(dir)))
+		check.T(t, check.Nil(s.Watch(dir, "parent")))
+		watches, err = s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches, []*client.WatchInfo{{
+				Dir:           dir,
+				Label:         "parent",
+				Status:        client.WatchHealthy,
+				Backend:       client.BackendAuto,
+				ActiveBackend: client.BackendInotify,
+			}}))
+	})
+}
+
+func TestMatchRule(t *testing.T) {
+	rules := []*StoredLabelRule{
+		{Path: "**/*.md", Label: "docs"},
+		{Path: "a", Label: "a"},
+		{Path: "a/b", Label: "b"},
+		{Path: "ab", Label: "ab"},
+		{Path: "services/*/api", Label: "api"},
+		{Path: "services/billing/**", Label: "billing"},
+		{Path: escapeGlob("x[1]"), Label: "x"},
+	}
+	for p, expected := range map[string]string{
+		"a":                           "a",
+		"a/x":                         "a",
+		"a/b":                         "b",
+		"a/b/c/d":                     "b",
+		"ab/x":                        "ab",
+		"abc":                         "",
+		"x/a/b":                       "",
+		"":                            "",
+		"README.md":                   "docs",
+		"ab/README.md":                "docs",
+		"services/billing/README.md":  "billing",
+		"services/billing/main.go":    "billing",
+		"services/billing/api/api.go": "billing",
+		"services/users/api/api.go":   "api",
+		"services/users/main.go":      "",
+		"x[1]/y":                      "x",
+		"x1/y":                        "",
+	} {
+		var actual string
+		if r := matchRule(rules, p); r != nil {
+			actual = r.Label
+		}
+		t.Logf("checking %q", p)
+		check.T(t, check.Eq(actual, expected))
+	}
+}
+
+func TestValidateRulePath(t *testing.T) {
+	for _, p := range []string{"a", "a/b", "**/*.md", "services/billing/**", `x\[1\]`} {
+		check.T(t, check.Nil(validateRulePath(p)))
+	}
+	for _, p := range []string{"", ".", "/a", "a/", "a//b", "../a", "a/../../b", "x[1"} {
+		check.T(t, check.NotNil(validateRulePath(p)))
+	}
+}
+
+func TestLabelRules(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		ts := time.Date(
+			/* date */ 2017, 7, 1,
+			/* time */ 6, 0, 0,
+			/* nsec, location */ 0, time.Local)
+		s.Set(ts)
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		check.T(t,
+			check.Nil(os.MkdirAll(path.Join(dir, "services/billing/db"), 0755)),
+			check.Nil(s.Watch(dir, "monorepo")),
+			check.Nil(s.AddLabelRule(dir, "services/billing/**", "billing")),
+			check.Nil(s.AddLabelRule(dir, "**/*.md", "docs")))
+		watches, err := s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches, []*client.WatchInfo{{
+				Dir:           dir,
+				Label:         "monorepo",
+				Status:        client.WatchHealthy,
+				Backend:       client.BackendAuto,
+				ActiveBackend: client.BackendInotify,
+				Rules: []*client.LabelRule{
+					{Path: "**/*.md", Label: "docs"},
+					{Path: "services/billing/**", Label: "billing"},
+				},
+			}}))
+
+		// Writes under services/billing are labeled "billing"
+		s.Add(time.Duration(s.maxEventGap+1) * time.Second)
+		start := s.TestingClock.Now()
+		for i := 0; i < 2; i++ {
+			f, err := os.Create(path.Join(dir, "services/billing/db", fmt.Sprintf("file-%d", getFileNumber())))
+			check.T(t,
+				check.Nil(err),
+				check.Nil(f.Close()))
+			time.Sleep(tEpsilon) // wait for the watcher (s.Add() then records the write)
+			s.Add(time.Minute)
+		}
+		resp, err := s.GetLabeledIntervals(start, start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(resp.Labeled["billing"], []client.Interval{{
+				Start: start.Unix(),
+				End:   start.Add(2 * time.Minute).Unix(),
+				Label: "billing",
+			}}))
+
+		// Rules can be removed
+		check.T(t, check.Nil(s.RemoveLabelRule(dir, "**/*.md")))
+		watches, err = s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches[0].Rules, []*client.LabelRule{
+				{Path: "services/billing/**", Label: "billing"},
+			}))
+
+		// Invalid rules, and rules of unwatched dirs, are rejected
+		err = s.AddLabelRule(dir, "../other", "other")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusBadRequest))
+		err = s.AddLabelRule(path.Join(dir, "services"), "billing", "billing")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+		err = s.RemoveLabelRule(dir, "**/*.md")
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusNotFound))
+	})
+}
+
+func TestWatchStatus(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		check.T(t,
+			check.Nil(os.MkdirAll(path.Join(dir, "child"), 0755)),
+			check.Nil(s.Watch(dir, "status")))
+		watches, err := s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches[0].Status, client.WatchHealthy),
+			check.Eq(watches.Watches[0].StatusReason, ""))
+
+		// Deleting the watched dir causes the watch to fail
+		check.T(t, check.Nil(os.RemoveAll(dir)))
+		for i := 0; i < 50; i++ {
+			watches, err = s.GetWatches()
+			check.T(t, check.Nil(err))
+			if watches.Watches[0].Status != client.WatchHealthy {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		check.T(t,
+			check.Eq(watches.Watches[0].Status, client.WatchFailed),
+			check.True(strings.Contains(watches.Watches[0].StatusReason, "deleted")),
+			check.True(strings.Contains(watches.Watches[0].StatusReason, "retrying")))
+
+		// Once the dir reappears, the watch is restarted (after its backoff), and
+		// writes are recorded again
+		check.T(t, check.Nil(os.MkdirAll(path.Join(dir, "child"), 0755)))
+		for i := 0; i < 50; i++ {
+			watches, err = s.GetWatches()
+			check.T(t, check.Nil(err))
+			if watches.Watches[0].Status == client.WatchHealthy {
+				break
+			}
+			s.Add(minWatchBackoff)
+			time.Sleep(100 * time.Millisecond)
+		}
+		check.T(t,
+			check.Eq(watches.Watches[0].Status, client.WatchHealthy),
+			check.Eq(watches.Watches[0].StatusReason, ""))
+		checkWritesRecorded(s, path.Join(dir, "child"), "status", 0)
+	})
+}
+
+func TestPollBackend(t *testing.T) {
+	config := DefaultConfig()
+	config.PollInterval = 1
+	forEachStore(t, config, func(s *TestServer) {
+		t := s.T
+		s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		check.T(t,
+			check.Nil(os.MkdirAll(path.Join(dir, "child"), 0755)),
+			check.Nil(s.WatchWithRequest(&client.WatchRequest{
+				Dir:     dir,
+				Label:   "polled",
+				Backend: client.BackendPoll,
+			})))
+		watches, err := s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches[0].Backend, client.BackendPoll),
+			check.Eq(watches.Watches[0].ActiveBackend, client.BackendPoll))
+
+		// Writes are observed by polling (wait for the next walk after each one)
+		checkWritesRecorded(s, path.Join(dir, "child"), "polled", time.Second)
+
+		// Unknown backends are rejected
+		err = s.WatchWithRequest(&client.WatchRequest{
+			Dir:     path.Join(dir, "other"),
+			Label:   "other",
+			Backend: "carrier-pigeon",
+		})
+		check.T(t, check.Eq(err.(*client.HTTPError).StatusCode, http.StatusBadRequest))
+	})
+}
+
+func TestFanotifyBackend(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		check.T(t,
+			check.Nil(os.MkdirAll(path.Join(dir, "child"), 0755)),
+			check.Nil(s.WatchWithRequest(&client.WatchRequest{
+				Dir:     dir,
+				Label:   "fanotify",
+				Backend: client.BackendFanotify,
+			})))
+
+		// Whether fanotify is available depends on the test environment, but if it
+		// isn't, the watch falls back to inotify. Either way, writes are recorded
+		checkWritesRecorded(s, path.Join(dir, "child"), "fanotify", 0)
+		watches, err := s.GetWatches()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(watches.Watches[0].Backend, client.BackendFanotify),
+			check.Eq(watches.Watches[0].Status, client.WatchHealthy))
+		t.Logf("active backend: %s", watches.Watches[0].ActiveBackend)
+		active := watches.Watches[0].ActiveBackend
+		check.T(t, check.True(active == client.BackendFanotify || active == client.BackendInotify))
+	})
+}
+
+func TestActivity(t *testing.T) {
+	config := DefaultConfig()
+	config.ActivityDetail = true
+	forEachStore(t, config, func(s *TestServer) {
+		t := s.T
+		start := time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local)
+		s.Set(start)
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		check.T(t,
+			check.Nil(os.MkdirAll(path.Join(dir, "docs"), 0755)),
+			check.Nil(ioutil.WriteFile(path.Join(dir, "existing"), nil, 0644)),
+			check.Nil(s.Watch(dir, "activity")),
+			check.Nil(s.AddLabelRule(dir, "docs", "docs")))
+		time.Sleep(tEpsilon) // wait for the watch to be established
+
+		// Write 'a' in two tick windows, and 'b' and 'docs/c' in one each
+		write := func(names ...string) {
+			for _, name := range names {
+				check.T(t, check.Nil(ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644)))
+			}
+			time.Sleep(tEpsilon) // wait for the watcher (s.Add() then records the writes)
+			s.Add(time.Minute)
+		}
+		write("a", "b")
+		write("a", path.Join("docs", "c"))
+
+		// Files are grouped by label and sorted by edits. The file that existed
+		// when the watch started isn't included
+		resp, err := s.GetActivity(start, start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(resp.Files, []*client.FileActivity{
+				{Label: "activity", Path: path.Join(dir, "a"), Edits: 2, LastEdit: start.Add(time.Minute).Unix()},
+				{Label: "activity", Path: path.Join(dir, "b"), Edits: 1, LastEdit: start.Unix()},
+				{Label: "docs", Path: path.Join(dir, "docs", "c"), Edits: 1, LastEdit: start.Add(time.Minute).Unix()},
+			}))
+		resp, err = s.GetActivity(start.Add(time.Second), start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(resp.Files), 2))
+
+		// Activity older than the retention period is discarded
+		s.Add(time.Duration(defaultActivityRetention)*time.Second + time.Minute)
+		resp, err = s.GetActivity(start, start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(resp.Files, []*client.FileActivity{}))
+	})
+}
+
+func TestBurstPolicy(t *testing.T) {
+	forEachStore(t, nil, func(s *TestServer) {
+		t := s.T
+		start := time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local)
+		s.Set(start)
+		dir := path.Join(testDir, randomSuffix(t.Name()))
+		allDir := dir + "-all"
+		for _, d := range []string{dir, allDir} {
+			check.T(t,
+				check.Nil(os.MkdirAll(path.Join(d, "src"), 0755)),
+				check.Nil(os.MkdirAll(path.Join(d, "lib"), 0755)))
+		}
+		check.T(t,
+			check.Nil(s.Watch(dir, "human")),
+			check.Nil(s.WatchWithRequest(&client.WatchRequest{
+				Dir:            allDir,
+				Label:          "all",
+				BurstThreshold: -1,
+			})))
+		time.Sleep(tEpsilon) // wait for the watches to be established
+		watches, err := s.GetWatches()
+		check.T(t, check.Nil(err))
+		for _, wi := range watches.Watches {
+			if wi.Dir == allDir {
+				check.T(t, check.Eq(wi.BurstThreshold, -1))
+			}
+		}
+
+		// Bursts of writes (e.g. from 'git checkout') a minute apart are only
+		// counted by the watch that counts every write
+		s.Add(time.Duration(s.maxEventGap+1) * time.Second)
+		start = s.TestingClock.Now()
+		for burst := 0; burst < 2; burst++ {
+			for _, d := range []string{dir, allDir} {
+				for i := 0; i < 5*defaultBurstThreshold; i++ {
+					name := path.Join(d, "lib", fmt.Sprintf("file-%d", i))
+					check.T(t, check.Nil(ioutil.WriteFile(name, []byte{byte(burst)}, 0644)))
+				}
+			}
+			time.Sleep(tEpsilon) // wait for the watchers (s.Add() then records the writes)
+			s.Add(time.Minute)
+		}
+		resp, err := s.GetLabeledIntervals(start, start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(resp.Labeled["human"]), 0),
+			check.Eq(resp.Labeled["all"], []client.Interval{{
+				Start: start.Unix(),
+				End:   start.Add(2 * time.Minute).Unix(),
+				Label: "all",
+			}}))
+
+		// Human edits, to other subtrees or to the same subtree once the burst is
+		// over, are counted
+		checkWritesRecorded(s, path.Join(dir, "src"), "human", 0)
+		checkWritesRecorded(s, path.Join(dir, "lib"), "human", 0)
+	})
+}
+
+// checkWritesRecorded creates two files in 'dir' (a watched dir, or a
+// subdirectory of one), a minute apart, and checks that they're recorded as an
+// interval labeled 'label'. 'delay' is how long the watch may take to observe
+// each write
+func checkWritesRecorded(s *TestServer, dir, label string, delay time.Duration) {
+	t := s.T
+	s.Add(time.Duration(s.maxEventGap+1) * time.Second)
+	start := s.TestingClock.Now()
+	for i := 0; i < 2; i++ {
+		f, err := os.Create(path.Join(dir, fmt.Sprintf("file-%d", getFileNumber())))
+		check.T(t,
+			check.Nil(err),
+			check.Nil(f.Close()))
+		time.Sleep(delay + tEpsilon) // wait for the watcher (s.Add() then records the write)
+		s.Add(time.Minute)
+	}
+	resp, err := s.GetLabeledIntervals(start, start.Add(time.Hour))
+	check.T(t,
+		check.Nil(err),
+		check.Eq(resp.Labeled[label], []client.Interval{{
+			Start: start.Unix(),
+			End:   start.Add(2 * time.Minute).Unix(),
+			Label: label,
+		}}))
+}
+
+// watchDirs creates and watches a new dir for each of 'labels' (labeled
+// accordingly), advancing the clock between watches so that their last writes
+// are ordered. It returns the dirs, and the error returned by each Watch call
+func watchDirs(s *TestServer, labels ...string) ([]string, []error) {
+	prefix := path.Join(testDir, randomSuffix(s.T.Name()))
+	var dirs []string
+	var errs []error
+	for _, label := range labels {
+		dir := prefix + "-" + label
+		check.T(s.T, check.Nil(os.MkdirAll(dir, 0755)))
+		s.Add(time.Minute)
+		dirs = append(dirs, dir)
+		errs = append(errs, s.Watch(dir, label))
+	}
+	return dirs, errs
+}
+
+// TestEvictionPolicies checks which watches each eviction policy removes (and
+// records as evictions) when a third watch is added to a server that allows
+// two
+func TestEvictionPolicies(t *testing.T) {
+	for _, c := range []struct {
+		policy  string
+		idle    time.Duration     // time between the first two watches and the third
+		status  int               // status of the third Watch call (0 if it succeeds)
+		watches int               // number of watches afterwards
+		evicted map[string]string // label of each evicted watch -> reason
+	}{
+		{
+			// The least recently written watch is evicted
+			policy:  client.EvictLRU,
+			watches: 2,
+			evicted: map[string]string{"a": "exceeded max watches (2); least recently written"},
+		},
+		{
+			// The new watch is rejected instead
+			policy:  client.EvictNever,
+			status:  http.StatusConflict,
+			watches: 2,
+			evicted: map[string]string{},
+		},
+		{
+			// After two days without writes, both watches expire when the next
+			// watch is added
+			policy:  client.EvictExpire,
+			idle:    2 * 24 * time.Hour,
+			watches: 1,
+			evicted: map[string]string{
+				"a": "no writes for 24h0m0s",
+				"b": "no writes for 24h0m0s",
+			},
+		},
+	} {
+		config := DefaultConfig()
+		config.MaxWatches = 2
+		config.EvictionPolicy = c.policy
+		config.WatchExpiry = s_Day
+		t.Run(c.policy, func(t *testing.T) {
+			forEachStore(t, config, func(s *TestServer) {
+				t := s.T
+				s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+				dirs, errs := watchDirs(s, "a", "b")
+				check.T(t, check.Nil(errs[0]), check.Nil(errs[1]))
+				watched := s.TestingClock.Now().Unix()
+				s.Add(c.idle)
+				_, errs = watchDirs(s, "c")
+				if c.status == 0 {
+					check.T(t, check.Nil(errs[0]))
+				} else {
+					check.T(t, check.Eq(errs[0].(*client.HTTPError).StatusCode, c.status))
+				}
+
+				watches, err := s.GetWatches()
+				check.T(t,
+					check.Nil(err),
+					check.Eq(len(watches.Watches), c.watches))
+				evictions, err := s.GetEvictions()
+				check.T(t, check.Nil(err))
+				evicted := map[string]string{}
+				for _, e := range evictions.Evictions {
+					// expired watches are evicted by whichever sync notices first
+					check.T(t, check.True(watched < e.Time && e.Time <= s.TestingClock.Now().Unix()))
+					evicted[e.Label] = e.Reason
+					if e.Label == "a" {
+						check.T(t, check.Eq(e.Dir, dirs[0]))
+					} else {
+						check.T(t, check.Eq(e.Dir, dirs[1]))
+					}
+				}
+				check.T(t, check.Eq(evicted, c.evicted))
+			})
+		})
+	}
+}
+
+// TestSyncWatchesRemovesSeveral checks that syncWatches tears down every watch
+// that has been removed from the store, even if several were removed at once
+func TestSyncWatchesRemovesSeveral(t *testing.T) {
+	config := DefaultConfig()
+	config.WatchSyncFrequency = 3600 // only sync watches explicitly
+	api, err := NewServerWithStore(&TestingClock{}, NewMemoryStore(), config)
+	check.T(t, check.Nil(err))
+	s := api.(*server)
+
+	prefix := path.Join(testDir, randomSuffix(t.Name()))
+	var dirs []string
+	for _, name := range []string{"a", "b", "c"} {
+		dir := prefix + "-" + name
+		check.T(t,
+			check.Nil(os.MkdirAll(dir, 0755)),
+			check.Nil(s.Watch(&client.WatchRequest{Dir: dir, Label: name})))
+		dirs = append(dirs, dir)
+	}
+
+	// Remove two watches without syncing, then sync once
+	s.storeMu.Lock()
+	check.T(t,
+		check.Nil(s.store.RemoveWatch(dirs[0])),
+		check.Nil(s.store.RemoveWatch(dirs[1])))
+	s.storeMu.Unlock()
+	check.T(t, check.Nil(s.syncWatches()))
+
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	check.T(t, check.Eq(len(s.watches), 1))
+	_, ok := s.watches[dirs[2]]
+	check.T(t, check.True(ok))
+}
+
+func TestFakeEventsLabeling(t *testing.T) {
+	s := StartFakeEventsTestServer(t, nil)
+	s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+	dir := "/fake/monorepo"
+	check.T(t,
+		check.Nil(s.Watch(dir, "monorepo")),
+		check.Nil(s.AddLabelRule(dir, "services/billing/**", "billing")),
+		check.Nil(s.AddLabelRule(dir, "**/*.md", "docs")))
+	for _, c := range []struct {
+		path, label string
+	}{
+		{path: "main.go", label: "monorepo"},
+		{path: "services/web/main.go", label: "monorepo"},
+		{path: "services/billing/db/schema.sql", label: "billing"},
+		{path: "README.md", label: "docs"},
+		{path: "services/web/README.md", label: "docs"},
+		{path: "services/", label: "monorepo"},
+	} {
+		s.Add(time.Duration(s.maxEventGap+1) * time.Second)
+		start := s.TestingClock.Now()
+		for i := 0; i < 2; i++ {
+			s.EmitEvent(dir, c.path, watcher.Modify)
+			s.Add(time.Minute) // records the write
+		}
+		resp, err := s.GetLabeledIntervals(start, start.Add(time.Hour))
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(resp.Labeled), 1),
+			check.Eq(resp.Labeled[c.label], []client.Interval{{
+				Start: start.Unix(),
+				End:   start.Add(2 * time.Minute).Unix(),
+				Label: c.label,
+			}}))
+	}
+}
+
+func TestFakeEventsFlushing(t *testing.T) {
+	s := StartFakeEventsTestServer(t, nil)
+	s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+	dir := "/fake/repo"
+	check.T(t, check.Nil(s.Watch(dir, "repo")))
+	gap := s.maxEventGap
+	for _, c := range []struct {
+		name      string
+		writes    []int64    // seconds after the start of the case
+		intervals [][2]int64 // likewise
+	}{
+		{
+			name:      "writes are recorded when they're received, not flushed",
+			writes:    []int64{0, 61},
+			intervals: [][2]int64{{0, 61}},
+		},
+		{
+			name:      "several writes per tick window",
+			writes:    []int64{0, 60, 61, 62},
+			intervals: [][2]int64{{0, 62}},
+		},
+		{
+			name:      "writes at most maxEventGap apart form one interval",
+			writes:    []int64{0, gap, 2 * gap},
+			intervals: [][2]int64{{0, 2 * gap}},
+		},
+		{
+			name:      "longer gaps separate intervals",
+			writes:    []int64{0, 60, 60 + gap + 1, 120 + gap + 1},
+			intervals: [][2]int64{{0, 60}, {60 + gap + 1, 120 + gap + 1}},
+		},
+	} {
+		s.Add(time.Duration(gap+1) * time.Second)
+		start := s.TestingClock.Now()
+		for _, w := range c.writes {
+			s.Set(start.Add(time.Duration(w) * time.Second))
+			s.EmitEvent(dir, "main.go", watcher.Modify)
+		}
+		// end any interval in progress, so that it isn't extended to the present
+		s.Add(time.Duration(gap+1) * time.Second)
+		resp, err := s.GetIntervals(start, s.TestingClock.Now())
+		check.T(t, check.Nil(err))
+		var intervals [][2]int64
+		for _, i := range resp.Intervals {
+			intervals = append(intervals, [2]int64{i.Start - start.Unix(), i.End - start.Unix()})
+		}
+		if err := check.Eq(intervals, c.intervals); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestFakeEventsEviction(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxWatches = 2
+	for _, c := range []struct {
+		writes  []string // labels of the watches written to, in order
+		evicted string
+	}{
+		{writes: nil, evicted: "a"},
+		{writes: []string{"a"}, evicted: "b"},
+		{writes: []string{"b", "a"}, evicted: "b"},
+		{writes: []string{"a", "b"}, evicted: "a"},
+	} {
+		s := StartFakeEventsTestServer(t, config)
+		s.Set(time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local))
+		for _, label := range []string{"a", "b"} {
+			s.Add(time.Minute)
+			check.T(t, check.Nil(s.Watch("/fake/"+label, label)))
+		}
+		for _, label := range c.writes {
+			s.Add(time.Minute)
+			s.EmitEvent("/fake/"+label, "main.go", watcher.Modify)
+		}
+		s.Add(time.Minute) // record the last write
+		check.T(t, check.Nil(s.Watch("/fake/c", "c")))
+		evictions, err := s.GetEvictions()
+		check.T(t,
+			check.Nil(err),
+			check.Eq(len(evictions.Evictions), 1),
+			check.Eq(evictions.Evictions[0].Label, c.evicted))
+	}
+}
+
+// TestFakeEventsRestart checks that restarting the server stops the old
+// server's watches and tickers, so that only the new server syncs watches and
+// records writes
+func TestFakeEventsRestart(t *testing.T) {
+	s := StartFakeEventsTestServer(t, nil)
+	start := time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local)
+	s.Set(start)
+	dir := "/fake/repo"
+	check.T(t, check.Nil(s.Watch(dir, "repo")))
+	old := s.server
+	s.Restart(t)
+
+	// Only the new server's tickers remain: one to sync watches, and one to
+	// record the writes of its only watch
+	s.TestingClock.mu.Lock()
+	timers := len(s.TestingClock.timers)
+	s.TestingClock.mu.Unlock()
+	old.watchMu.Lock()
+	oldWatches := len(old.watches)
+	old.watchMu.Unlock()
+	check.T(t,
+		check.Eq(timers, 2),
+		check.Eq(oldWatches, 0))
+
+	// Writes are recorded by the new server's watch
+	s.Add(time.Minute)
+	s.EmitEvent(dir, "main.go", watcher.Modify)
+	s.Add(time.Minute)
+	s.EmitEvent(dir, "main.go", watcher.Modify)
+	s.Add(time.Minute)
+	resp, err := s.GetIntervals(start, start.Add(time.Hour))
+	check.T(t,
+		check.Nil(err),
+		check.Eq(len(resp.Intervals), 1),
+		check.Eq(resp.Intervals[0].Start, start.Add(time.Minute).Unix()))
+}
+
+// TestSubscribe checks that /events reports ticks, the extension of the
+// in-progress interval, and changes to watches (and that the public endpoint
+// reports neither labels nor watches)
+func TestSubscribe(t *testing.T) {
+	s := StartFakeEventsTestServer(t, nil)
+	start := time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local)
+	s.Set(start)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := s.Client.Subscribe(ctx)
+	check.T(t, check.Nil(err))
+	publicEvents, err := s.Public.Subscribe(ctx)
+	check.T(t, check.Nil(err))
+	next := func(events <-chan *client.Event) *client.Event {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("event stream closed unexpectedly")
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for an event")
+		}
+		return nil
+	}
+
+	// The first tick starts an interval, and the second extends it
+	_, err = s.Tick("a")
+	check.T(t, check.Nil(err))
+	s.Add(time.Minute)
+	_, err = s.Tick("a")
+	check.T(t, check.Nil(err))
+	for _, c := range []struct {
+		events <-chan *client.Event
+		label  string
+	}{
+		{events: events, label: "a"},
+		{events: publicEvents, label: ""},
+	} {
+		e := next(c.events)
+		check.T(t,
+			check.Eq(e.Type, client.EventTick),
+			check.Eq(e.Time, start.Unix()),
+			check.Eq(e.Label, c.label))
+		e = next(c.events)
+		check.T(t,
+			check.Eq(e.Type, client.EventTick),
+			check.Eq(e.Time, start.Add(time.Minute).Unix()))
+		e = next(c.events)
+		check.T(t,
+			check.Eq(e.Type, client.EventInterval),
+			check.Eq(e.Label, c.label),
+			check.Eq(*e.Interval, client.Interval{Start: start.Unix(), End: start.Add(time.Minute).Unix()}))
+	}
+
+	// Watches are only reported on the control endpoint, and writes to them are
+	// reported once they're recorded
+	check.T(t, check.Nil(s.Watch("/fake/repo", "repo")))
+	e := next(events)
+	check.T(t,
+		check.Eq(e.Type, client.EventWatch),
+		check.Eq(e.Dir, "/fake/repo"),
+		check.Eq(e.Label, "repo"))
+	s.Add(time.Minute)
+	s.EmitEvent("/fake/repo", "main.go", watcher.Modify)
+	s.Add(time.Minute) // record the write
+	for _, events := range []<-chan *client.Event{events, publicEvents} {
+		e := next(events)
+		for e.Type == client.EventWatch { // skip any updates to the watch's status
+			e = next(events)
+		}
+		check.T(t,
+			check.Eq(e.Type, client.EventTick),
+			check.Eq(e.Time, start.Add(2*time.Minute).Unix()))
+	}
+}
@@ -0,0 +1,78 @@
+package watchd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// tokenBytes is the number of random bytes in a token generated by
+// LoadOrCreateToken
+const tokenBytes = 32
+
+// NewToken returns a new random token, suitable for authenticating clients of
+// the watch daemon
+func NewToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// LoadOrCreateToken returns the token stored in 'tokenFile', first generating
+// a new token and writing it to 'tokenFile' (readable only by the current
+// user) if the file doesn't exist yet
+func LoadOrCreateToken(tokenFile string) (string, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("token file %q is empty", tokenFile)
+		}
+		return token, nil
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("could not read token file: %v", err)
+	}
+
+	// Create a new token. O_EXCL guarantees that if two daemons start at once,
+	// neither overwrites the other's token
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(tokenFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not create token file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		return "", fmt.Errorf("could not write token file: %v", err)
+	}
+	log.Infof("created new token in %s", tokenFile)
+	return token, nil
+}
+
+// requireToken wraps 'h' in a handler that rejects any request whose
+// Authorization header doesn't contain 'token' (see client.Client.Token)
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	expected := []byte(client.AuthScheme + " " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		actual := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			log.Infof("rejected unauthenticated request for %s", r.URL.Path)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,107 @@
+// burst.go contains the logic that distinguishes human edits from tool
+// activity. Tools like 'git checkout' or a build write many files at once, and
+// counting those writes would e.g. extend the interval of a morning's work
+// through lunch if a branch was switched after lunch. Instead, each watch
+// counts the events it receives from each top-level subdirectory ("subtree")
+// of its dir, and treats more than a few events per second from one subtree
+// as a burst of tool activity, which isn't counted.
+
+package watchd
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/msteffen/golang-time-tracker/pkg/watcher"
+)
+
+// burstWindow is the period in which a watch counts the events from a subtree
+// to detect bursts
+const burstWindow = time.Second
+
+// maxEvents returns the number of events per burstWindow that a subtree of a
+// watch with the burst threshold 'burstThreshold' (see
+// client.WatchRequest.BurstThreshold) may receive before they're considered a
+// burst, or 0 if bursts aren't detected
+func (s *server) maxEvents(burstThreshold int) int {
+	switch {
+	case burstThreshold < 0:
+		return 0
+	case burstThreshold == 0:
+		return s.config.BurstThreshold
+	}
+	return burstThreshold
+}
+
+// subtreeOf returns the top-level subdirectory of w.dir containing 'p', or ""
+// if 'p' is directly inside w.dir
+func (w *watch) subtreeOf(p string) string {
+	if !isSubdir(w.dir, p) {
+		return ""
+	}
+	rel := relPath(w.dir, p)
+	if i := strings.IndexByte(rel, '/'); i >= 0 {
+		return rel[:i]
+	}
+	return ""
+}
+
+// isHumanEdit returns true if 'e', received at 'now', is a human edit, and
+// false if it's part of a burst of tool activity. When a burst starts, writes
+// already received from the same subtree in the preceding burstWindow are
+// retracted, as they were most likely the start of the burst (though any that
+// recordWritesInDB has already recorded can't be)
+func (w *watch) isHumanEdit(e watcher.WatchEvent, now time.Time) bool {
+	if w.maxEvents == 0 {
+		return true
+	}
+	if e.Type == watcher.Overflow {
+		return false
+	}
+	subtree := w.subtreeOf(e.Path)
+	if w.recent == nil {
+		w.recent, w.bursting = make(map[string][]time.Time), make(map[string]bool)
+	}
+	recent := w.recent[subtree]
+	for len(recent) > 0 && now.Sub(recent[0]) > burstWindow {
+		recent = recent[1:]
+	}
+	recent = append(recent, now)
+	w.recent[subtree] = recent
+	if len(recent) <= w.maxEvents {
+		delete(w.bursting, subtree)
+		return true
+	}
+	if !w.bursting[subtree] {
+		w.bursting[subtree] = true
+		log.Infof("watch on [%s] is ignoring a burst of events under [%s] "+
+			"(tool activity, not human edits)", w.dir, path.Join(w.dir, subtree))
+		w.retract(subtree, now.Add(-burstWindow))
+	}
+	return false
+}
+
+// retract discards the pending writes to 'subtree' that were received after
+// 'since' (the subtree itself stays pending if it was also written before then)
+func (w *watch) retract(subtree string, since time.Time) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	for id, pw := range w.pending {
+		for f, t := range pw.files {
+			if w.subtreeOf(f) == subtree && !t.Before(since) {
+				delete(pw.files, f)
+			}
+		}
+		if t, ok := pw.subtrees[subtree]; ok && !t.first.Before(since) {
+			delete(pw.subtrees, subtree)
+		} else if ok && !t.last.Before(since) {
+			t.last = since // its remaining writes were all received before 'since'
+		}
+		if len(pw.subtrees) == 0 {
+			delete(w.pending, id)
+		}
+	}
+}
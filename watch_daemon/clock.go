@@ -1,11 +1,27 @@
 package watchd
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
-// Clock is an interface wrapping time.Now(), so that clocks can be injected
-// into the TimeTracker server for testing
+// Clock is an interface wrapping time.Now() and Go's timers and tickers, so
+// that clocks can be injected into the TimeTracker server for testing. All of
+// the watch daemon's timing (flushing writes, syncing watches, restarting
+// failed watches) goes through its Clock. Only the watchers themselves (e.g.
+// the polling backend) use the system clock, as they observe the real
+// filesystem.
 type Clock interface {
+	// Now returns the current time
 	Now() time.Time
+
+	// After waits for 'd' to elapse and then sends the current time on the
+	// returned channel (like time.After)
+	After(d time.Duration) <-chan time.Time
+
+	// Every calls 'f' every 'd' (like a time.Ticker, calls that would overlap
+	// are skipped) until the returned function is called
+	Every(d time.Duration, f func()) (stop func())
 }
 
 // SystemClock is the default implementation of the Clock API (in which Now()
@@ -17,24 +33,149 @@ func (s systemClock) Now() time.Time {
 	return time.Now()
 }
 
+// After is SystemClock's implementation of the Clock API (calls time.After())
+func (s systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Every is SystemClock's implementation of the Clock API (calls 'f' from a
+// goroutine driven by a time.Ticker)
+func (s systemClock) Every(d time.Duration, f func()) func() {
+	ticker := time.NewTicker(d)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				f()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
 var SystemClock Clock = systemClock{} // really a const
 
-// TestingClock is an implementation of the Clock API that's useful for testing
+// maxDuration is the largest time.Duration (which time.Time.Sub returns if the
+// difference between two times is larger)
+const maxDuration = time.Duration(1<<63 - 1)
+
+// testTimer is a timer or ticker created by a TestingClock
+type testTimer struct {
+	deadline time.Time
+	period   time.Duration  // 0 for timers created by After()
+	c        chan time.Time // set for timers created by After()
+	f        func()         // set for tickers created by Every()
+}
+
+// TestingClock is an implementation of the Clock API that's useful for
+// testing. Its time only changes when Add() or Set() is called, which fire any
+// timers and tickers that come due, in order. Callbacks registered with Every()
+// run synchronously, so once Add() or Set() returns, e.g. all writes that the
+// server's watches had received have been flushed
 type TestingClock struct {
-	time.Time
+	mu     sync.Mutex
+	now    time.Time
+	timers []*testTimer
 }
 
 // Now returns the current time according to 't'
 func (t *TestingClock) Now() time.Time {
-	return t.Time
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.now
+}
+
+// After implements the corresponding method of the Clock interface. The
+// returned channel receives a value once 't' is advanced by 'd'
+func (t *TestingClock) After(d time.Duration) <-chan time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timer := &testTimer{deadline: t.now.Add(d), c: make(chan time.Time, 1)}
+	t.timers = append(t.timers, timer)
+	return timer.c
+}
+
+// Every implements the corresponding method of the Clock interface. 'f' is
+// called by Add() or Set() (at most once per call, as with a time.Ticker whose
+// receiver has fallen behind)
+func (t *TestingClock) Every(d time.Duration, f func()) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timer := &testTimer{deadline: t.now.Add(d), period: d, f: f}
+	t.timers = append(t.timers, timer)
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.remove(timer)
+	}
+}
+
+// remove deletes 'timer' from t.timers. t.mu must be held by the caller
+func (t *TestingClock) remove(timer *testTimer) {
+	for i, tt := range t.timers {
+		if tt == timer {
+			t.timers = append(t.timers[:i], t.timers[i+1:]...)
+			return
+		}
+	}
 }
 
 // Add advances 't' by the duration 'd'
 func (t *TestingClock) Add(d time.Duration) {
-	t.Time = t.Time.Add(d)
+	t.Set(t.Now().Add(d))
 }
 
-// Set sets the current time in 't' to 'to'
+// Set sets the current time in 't' to 'to', firing all timers and tickers
+// that come due in the meantime. If 'to' is before the current time, no timers
+// fire, and all timers keep their remaining durations
 func (t *TestingClock) Set(to time.Time) {
-	t.Time = to
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if to.Before(t.now) {
+		for _, timer := range t.timers {
+			timer.deadline = timer.deadline.Add(to.Sub(t.now))
+		}
+		t.now = to
+		return
+	}
+	for {
+		// Find the timer that fires first. Tickers that are due more than once
+		// only fire at their last deadline before 'to'
+		var next *testTimer
+		var nextFire time.Time
+		for _, timer := range t.timers {
+			if timer.deadline.After(to) {
+				continue
+			}
+			fire := timer.deadline
+			if d := to.Sub(fire); timer.period > 0 && d == maxDuration {
+				fire = to // 'to' is centuries away (e.g. 't' was just initialized)
+			} else if timer.period > 0 {
+				fire = fire.Add(d / timer.period * timer.period)
+			}
+			if next == nil || fire.Before(nextFire) {
+				next, nextFire = timer, fire
+			}
+		}
+		if next == nil {
+			break
+		}
+		t.now = nextFire
+		if next.period == 0 {
+			t.remove(next)
+			next.c <- nextFire
+			continue
+		}
+		next.deadline = nextFire.Add(next.period)
+		// release t.mu while 'f' runs, as it may read or use 't'
+		t.mu.Unlock()
+		next.f()
+		t.mu.Lock()
+	}
+	t.now = to
 }
@@ -0,0 +1,45 @@
+package watchd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/msteffen/golang-time-tracker/pkg/check"
+)
+
+func TestTestingClock(t *testing.T) {
+	start := time.Date(2017, 7, 1, 6, 0, 0, 0, time.Local)
+	c := &TestingClock{}
+	c.Set(start)
+
+	// Callbacks see the time at which they fire, and tickers that come due
+	// several times in one Add() only fire once
+	var fired []int64
+	stop := c.Every(10*time.Second, func() { fired = append(fired, c.Now().Unix()) })
+	timer := c.After(15 * time.Second)
+	c.Add(5 * time.Second)
+	check.T(t, check.Eq(len(fired), 0))
+	c.Add(10 * time.Second)
+	check.T(t, check.Eq(fired, []int64{start.Add(10 * time.Second).Unix()}))
+	select {
+	case tm := <-timer:
+		check.T(t, check.Eq(tm.Unix(), start.Add(15*time.Second).Unix()))
+	default:
+		t.Fatalf("timer didn't fire")
+	}
+	c.Add(time.Minute)
+	check.T(t,
+		check.Eq(len(fired), 2),
+		check.Eq(fired[1], start.Add(70*time.Second).Unix()),
+		check.Eq(c.Now().Unix(), start.Add(75*time.Second).Unix()))
+
+	// Moving the clock backwards doesn't fire anything, and stopped tickers
+	// don't fire at all
+	c.Add(-time.Hour)
+	check.T(t, check.Eq(len(fired), 2))
+	c.Add(time.Hour)
+	check.T(t, check.Eq(len(fired), 3))
+	stop()
+	c.Add(time.Hour)
+	check.T(t, check.Eq(len(fired), 3))
+}
@@ -0,0 +1,108 @@
+package watchd
+
+import (
+	"fmt"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// defaultMaxEventGap is the default value of client.Config.MaxEventGap
+const defaultMaxEventGap = 23 * s_Minute
+
+// defaultMinCountedInterval is the default value of
+// client.Config.MinCountedInterval
+const defaultMinCountedInterval = s_Hour
+
+// defaultMaxWatches is the default value of client.Config.MaxWatches
+const defaultMaxWatches = 4
+
+// defaultWatchExpiry is the default value of client.Config.WatchExpiry
+const defaultWatchExpiry = 30 * s_Day
+
+// defaultPollInterval is the default value of client.Config.PollInterval
+const defaultPollInterval = 10 // seconds
+
+// defaultActivityRetention is the default value of
+// client.Config.ActivityRetention
+const defaultActivityRetention = 14 * s_Day
+
+// defaultBurstThreshold is the default value of client.Config.BurstThreshold
+const defaultBurstThreshold = 20
+
+// defaultTickSyncFrequency and defaultWatchSyncFrequency are the default values
+// of client.Config.TickSyncFrequency and client.Config.WatchSyncFrequency
+const (
+	defaultTickSyncFrequency  = 3 // seconds
+	defaultWatchSyncFrequency = 3 // seconds
+)
+
+// DefaultConfig returns the settings used by the watch daemon if none are
+// provided
+func DefaultConfig() *client.Config {
+	return &client.Config{
+		MaxEventGap:        defaultMaxEventGap,
+		MinCountedInterval: defaultMinCountedInterval,
+		MaxWatches:         defaultMaxWatches,
+		EvictionPolicy:     client.EvictLRU,
+		WatchExpiry:        defaultWatchExpiry,
+		PollInterval:       defaultPollInterval,
+		ActivityRetention:  defaultActivityRetention,
+		BurstThreshold:     defaultBurstThreshold,
+		TickSyncFrequency:  defaultTickSyncFrequency,
+		WatchSyncFrequency: defaultWatchSyncFrequency,
+	}
+}
+
+// validateConfig returns an error if any of the settings in 'c' are invalid
+func validateConfig(c *client.Config) error {
+	if c.MaxEventGap <= 0 {
+		return fmt.Errorf("max event gap must be positive, but was %ds", c.MaxEventGap)
+	}
+	if c.MinCountedInterval < 0 {
+		return fmt.Errorf("min counted interval must be non-negative, but was %ds",
+			c.MinCountedInterval)
+	}
+	if c.MaxWatches < 0 {
+		return fmt.Errorf("max watches must be non-negative, but was %d", c.MaxWatches)
+	}
+	switch c.EvictionPolicy {
+	case client.EvictLRU, client.EvictNever:
+	case client.EvictExpire:
+		if c.WatchExpiry <= 0 {
+			return fmt.Errorf("watch expiry must be positive with eviction policy "+
+				"%q, but was %ds", c.EvictionPolicy, c.WatchExpiry)
+		}
+	default:
+		return fmt.Errorf("unknown eviction policy %q (must be %q, %q, or %q)",
+			c.EvictionPolicy, client.EvictLRU, client.EvictNever, client.EvictExpire)
+	}
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("poll interval must be positive, but was %ds", c.PollInterval)
+	}
+	if c.ActivityRetention <= 0 {
+		return fmt.Errorf("activity retention must be positive, but was %ds",
+			c.ActivityRetention)
+	}
+	if c.BurstThreshold < 0 {
+		return fmt.Errorf("burst threshold must be non-negative, but was %d",
+			c.BurstThreshold)
+	}
+	if c.TickSyncFrequency <= 0 {
+		return fmt.Errorf("tick sync frequency must be positive, but was %ds",
+			c.TickSyncFrequency)
+	}
+	if c.WatchSyncFrequency <= 0 {
+		return fmt.Errorf("watch sync frequency must be positive, but was %ds",
+			c.WatchSyncFrequency)
+	}
+	for label, lc := range c.Labels {
+		if lc == nil {
+			return fmt.Errorf("settings for label %q are empty", label)
+		}
+		if lc.MinCountedInterval < 0 {
+			return fmt.Errorf("min counted interval for label %q must be "+
+				"non-negative, but was %ds", label, lc.MinCountedInterval)
+		}
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package watchd
 
+import "fmt"
+
 // WatchExistsErr is an error returned by Watch indicating that a requested
-// directory or one of its parents is already watched
+// directory or one of its parents is already watched (and the request doesn't
+// override the parent's label; see client.WatchRequest.Override)
 type WatchExistsErr struct {
 	dir string
 }
@@ -10,3 +13,54 @@ func (e *WatchExistsErr) Error() string {
 	return "watch already exists for " + e.dir
 }
 
+// TooManyWatchesErr is an error returned by Watch indicating that the
+// requested watch would exceed client.Config.MaxWatches, and the eviction
+// policy doesn't allow existing watches to be evicted to make room for it
+type TooManyWatchesErr struct {
+	max int
+}
+
+func (e *TooManyWatchesErr) Error() string {
+	return fmt.Sprintf("cannot add watch: %d watches (the maximum) already exist "+
+		"(unwatch a directory or raise max-watches)", e.max)
+}
+
+// NoSuchWatchErr is an error returned by Unwatch and UpdateWatch indicating
+// that the requested directory isn't watched
+type NoSuchWatchErr struct {
+	dir string
+}
+
+func (e *NoSuchWatchErr) Error() string {
+	return "no watch exists for " + e.dir
+}
+
+// NoSuchLabelRuleErr is an error returned by RemoveLabelRule indicating that
+// the requested watch has no label rule with the requested path
+type NoSuchLabelRuleErr struct {
+	dir, path string
+}
+
+func (e *NoSuchLabelRuleErr) Error() string {
+	return "watch on " + e.dir + " has no label rule for " + e.path
+}
+
+// NoSuchProjectErr is an error returned by RenameProject and MergeProjects
+// indicating that a named project doesn't exist
+type NoSuchProjectErr struct {
+	name string
+}
+
+func (e *NoSuchProjectErr) Error() string {
+	return "no project named " + e.name
+}
+
+// ProjectExistsErr is an error returned by RenameProject indicating that the
+// requested new name already belongs to a different project
+type ProjectExistsErr struct {
+	name string
+}
+
+func (e *ProjectExistsErr) Error() string {
+	return "project already exists: " + e.name
+}
@@ -0,0 +1,38 @@
+package watchd
+
+import (
+	"context"
+
+	"github.com/msteffen/golang-time-tracker/pkg/watcher"
+)
+
+// EventSource is an interface wrapping the watcher package, so that the
+// filesystem events observed by the TimeTracker server's watches can be
+// scripted in tests (see TestServer.EmitEvent)
+type EventSource interface {
+	// Watch calls 'cb' with every event in the tree under 'dir' until 'ctx' is
+	// cancelled or the watch fails (like watcher.WatchWithOptions)
+	Watch(ctx context.Context, dir string, opts watcher.Options, cb func(watcher.WatchEvent) error) error
+
+	// DetectBackend returns the backend that watcher.BackendAuto uses for 'dir'
+	// (like watcher.DetectBackend)
+	DetectBackend(dir string) (string, error)
+}
+
+// watcherEventSource is the default implementation of the EventSource API,
+// which watches the real filesystem
+type watcherEventSource struct{}
+
+// Watch is watcherEventSource's implementation of the EventSource API (calls
+// watcher.WatchWithOptions())
+func (watcherEventSource) Watch(ctx context.Context, dir string, opts watcher.Options, cb func(watcher.WatchEvent) error) error {
+	return watcher.WatchWithOptions(ctx, dir, opts, cb)
+}
+
+// DetectBackend is watcherEventSource's implementation of the EventSource API
+// (calls watcher.DetectBackend())
+func (watcherEventSource) DetectBackend(dir string) (string, error) {
+	return watcher.DetectBackend(dir)
+}
+
+var WatcherEventSource EventSource = watcherEventSource{} // really a const
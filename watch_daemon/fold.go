@@ -0,0 +1,140 @@
+// fold.go contains sqliteStore's logic for folding ticks into the 'intervals'
+// table as they arrive. Rather than storing every tick, the DB stores, for each
+// project (and for the union of all projects, under the project ID 0), the
+// intervals formed by that project's ticks, and each new tick either extends
+// the most recent interval for its project or starts a new one. This keeps the
+// DB small and makes GetIntervals a range scan over a few intervals rather than
+// over every tick in the requested range.
+//
+// Projects (i.e. labels) are stored in the 'projects' table, which assigns
+// each label a stable ID. Intervals and watches refer to projects by ID, so
+// that a project can be renamed without rewriting its history.
+
+package watchd
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// unionProjectID is the project ID of intervals that are part of the union of
+// all projects' intervals. There is no corresponding row in 'projects'
+const unionProjectID = 0
+
+// dbExecQuerier is the subset of the *sql.DB and *sql.Tx APIs used by the
+// functions in this file, so that they can be used inside or outside of a
+// transaction
+type dbExecQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// validateLabel returns an error if 'label' can't be the name of a project.
+// In particular, "" is reserved for the union of all projects' intervals (e.g.
+// in GetIntervals)
+func validateLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("label must not be empty (\"\" is used for the union of all projects)")
+	}
+	return nil
+}
+
+// projectID returns the ID of the project named 'label', creating it if it
+// doesn't exist yet
+func projectID(db dbExecQuerier, label string) (int64, error) {
+	if err := validateLabel(label); err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(
+		"INSERT OR IGNORE INTO projects (name) VALUES (?);", label,
+	); err != nil {
+		return 0, fmt.Errorf("could not create project %q: %v", label, err)
+	}
+	var id int64
+	if err := db.QueryRow(
+		"SELECT id FROM projects WHERE name = ?;", label,
+	).Scan(&id); err != nil {
+		return 0, fmt.Errorf("could not read ID of project %q: %v", label, err)
+	}
+	return id, nil
+}
+
+// lastTick returns the time and project ID of the most recent tick folded into
+// the intervals table (or ok == false if there are no intervals yet)
+func lastTick(db dbExecQuerier) (t int64, project int64, ok bool, err error) {
+	err = db.QueryRow(`
+	  SELECT end_time, project_id FROM intervals WHERE project_id != ?
+	  ORDER BY end_time DESC LIMIT 1;
+	`, unionProjectID).Scan(&t, &project)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, fmt.Errorf("could not read most recent tick: %v", err)
+	}
+	return t, project, true, nil
+}
+
+// extendInterval adds the tick at time 't' to the most recent interval of the
+// project 'project', or, if 't' is more than 'maxEventGap' seconds after that
+// interval, starts a new interval containing only 't'
+func extendInterval(db dbExecQuerier, maxEventGap int64, project int64, t int64) error {
+	var rowID, start, end int64
+	err := db.QueryRow(`
+	  SELECT rowid, start_time, end_time FROM intervals WHERE project_id = ?
+	  ORDER BY end_time DESC LIMIT 1;
+	`, project).Scan(&rowID, &start, &end)
+	switch {
+	case err != nil && err != sql.ErrNoRows:
+		return fmt.Errorf("could not read latest interval for project %d: %v", project, err)
+	case err == nil && start <= t && t <= end:
+		return nil // 't' is already in the latest interval (e.g. duplicate tick)
+	case err == nil && end < t && t-end <= maxEventGap:
+		_, err = db.Exec("UPDATE intervals SET end_time = ? WHERE rowid = ?;", t, rowID)
+	default:
+		// no interval for 'project', 't' is too far from the latest interval, or
+		// 't' arrived out of order. Start a new interval (GetIntervals merges
+		// overlapping intervals, so out-of-order ticks are fine)
+		_, err = db.Exec(
+			"INSERT INTO intervals (start_time, end_time, project_id) VALUES (?, ?, ?);",
+			t, t, project)
+	}
+	if err != nil {
+		return fmt.Errorf("could not add tick at %d to intervals for project %d: %v", t, project, err)
+	}
+	return nil
+}
+
+// foldTick adds a tick at time 't' with the label 'label' (which must not be
+// "") to the intervals table (creating a project for 'label' if necessary)
+func foldTick(db dbExecQuerier, maxEventGap int64, t int64, label string) error {
+	project, err := projectID(db, label)
+	if err != nil {
+		return err
+	}
+	return foldProjectTick(db, maxEventGap, t, project)
+}
+
+// foldProjectTick adds a tick at time 't' for the project 'project' to the
+// intervals table, extending (or creating) both the union interval and the
+// project's interval. This produces the same intervals that a Collector would
+// if it were given every tick: in particular, when work switches from one
+// project to another, the new project's interval starts at the previous
+// project's last tick
+func foldProjectTick(db dbExecQuerier, maxEventGap int64, t int64, project int64) error {
+	prevT, prevProject, ok, err := lastTick(db)
+	if err != nil {
+		return err
+	}
+	if err := extendInterval(db, maxEventGap, unionProjectID, t); err != nil {
+		return err
+	}
+	if ok && prevProject != project && prevT <= t {
+		// New activity was started--this activity's interval starts at the end of
+		// the previous activity's interval
+		if err := extendInterval(db, maxEventGap, project, prevT); err != nil {
+			return err
+		}
+	}
+	return extendInterval(db, maxEventGap, project, t)
+}
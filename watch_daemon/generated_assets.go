@@ -182,7 +182,7 @@ func assetsTimesJs() (*asset, error) {
 	return a, nil
 }
 
-var _assetsVizHtml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xbc\x54\x5d\x4f\xdc\x3a\x10\x7d\xcf\xaf\x18\x2c\xdd\x4b\x72\x61\x9d\x20\x04\xba\x12\x49\x24\x04\x7d\x2b\x6a\x1f\xfa\x56\x55\xc8\x1b\xcf\x26\x06\xc7\x8e\xec\xd9\x2c\x5b\xb4\xff\xbd\x72\xb2\x1f\xd9\x02\x52\x9f\xfa\xb2\x1b\xcd\x39\x73\x7c\x66\x3c\xe3\xbc\xa1\x56\x97\x51\xde\xa0\x90\x65\x94\x9f\xcc\x66\xd1\xb7\x46\x79\xa8\xac\x44\x10\x5a\xdb\x95\x87\x85\x75\xe0\x50\x78\x6b\xc4\x5c\x23\x78\xf5\x53\x99\x1a\x56\x0d\x1a\xa0\x06\x23\xb3\x6c\xe7\xe8\xc0\x2e\x80\x54\x8b\xce\x83\xf2\x70\x52\xc0\x55\x34\x9b\x95\x51\xee\x2b\xa7\x3a\x02\xef\xaa\x82\xc9\x4b\xde\x5f\xf1\x56\x19\xfe\xe4\x59\x99\xa7\x23\xf6\x86\x54\x69\x5b\x3d\x7f\x40\xa1\x75\x87\x05\x23\x7c\xa1\xf4\x49\xf4\x62\x8c\xb2\x32\x02\x90\x62\xed\xa1\x80\xd7\x57\xbe\xd9\x44\x00\x69\x0a\x5f\x1d\x56\xb6\xed\x96\x84\xd0\x39\xdb\xa1\x23\x85\x3e\xf8\x44\x51\x35\x81\x0f\xff\x82\x47\x02\xe1\x61\xa1\x50\xcb\x08\x86\x52\x63\x8d\x04\x32\xf0\x82\x64\x02\xaf\x11\x00\x40\x08\x92\x25\xa1\x1f\x43\x95\x45\x76\x33\x44\x3f\xe6\x4f\x30\x35\x60\x5c\x19\x42\xd7\x0b\x3d\xa1\xc0\x44\x12\xce\x0a\x50\x1c\x8d\x84\x19\x28\xee\x49\x38\xba\xd9\xd2\x36\xd1\xe1\x37\x08\xb6\xca\x2c\x09\x43\xb5\x0f\x82\x1a\xbe\xd0\xd6\xba\xf8\xa0\x94\xc6\xd7\xd9\x7f\x17\x59\x96\x25\xc9\xa8\x20\xf9\x21\x63\xfb\xf5\xcf\x75\xb6\xc3\x1a\xbb\x74\xbf\x69\xed\x13\xd2\xeb\x6c\xd0\x08\x67\xaf\x94\x91\x76\xc5\x85\x94\x9f\x7a\x34\xf4\x59\x79\x42\x83\x2e\x3e\xbd\xff\xf2\x70\x67\x0d\x85\x98\x15\x12\xe5\xe9\x39\xc4\x18\x28\x09\x14\xe5\xb6\xd6\x34\x85\x7b\x27\x56\x30\x57\x35\x0c\xf7\x3b\xb4\x87\xac\x14\xeb\x7d\x59\x73\x55\x0f\xfe\x1d\x14\x20\x2f\xb9\x47\x8d\x15\xdd\x6a\x1d\x33\xdf\xd7\x7c\x8f\xb2\x84\x4b\x41\xcb\x36\x0e\xed\xfe\x9e\xfd\x48\x06\x81\xdb\xae\x43\x23\xef\x82\x74\xbc\xa7\x26\xd1\xd1\xe1\x42\xeb\x30\xb1\xa0\x15\x91\xc6\xd1\xc7\x38\xde\xc3\xf0\xcc\x71\x61\x1d\x4e\x4c\x6d\xe7\xf9\x3d\x37\x13\x27\x62\x30\xc2\xbd\x56\x15\xc6\x17\x49\x32\x49\xe5\x18\xee\x3c\x4e\xb8\x18\xdc\x0d\xa9\x2c\xe1\x95\x16\xde\xa3\x8c\xd9\xa8\x72\x0e\xe4\x96\x78\x9c\xf7\xa2\x28\x4e\xb8\xc3\xd6\xf6\x18\x27\xfb\x16\xb9\xe3\x7b\xfa\x3f\x4b\xc7\xc3\x35\x9a\x9a\x9a\xd9\xc5\xee\xc6\xb7\x32\x9e\xd6\x1a\x63\xb6\x52\x92\x1a\x76\x0e\x0e\xce\x80\xf5\x2b\x96\xec\x80\x06\x55\xdd\xd0\x14\x79\xd3\xcb\x51\x29\xc4\x37\x49\x34\xd9\x47\xad\xcc\x33\x38\xd4\x05\x1b\xb4\x7c\x83\x48\x6c\xba\x9e\x95\xf7\x0c\x1a\x87\x8b\x82\x8d\x0b\x1d\x02\x65\x9e\x86\xc4\x32\xca\xd3\xed\x8b\x33\xb7\x72\x5d\x46\xb9\x54\x3d\x0c\x6d\x29\xc6\xa6\x3c\x76\x42\x4a\x65\x6a\xf6\x1e\x36\xb7\x2f\xc3\xca\xe7\xbe\xaf\x77\xc8\x61\x3c\xc2\xab\xd1\xd7\xe1\x08\xa9\xfa\x3f\x4d\x3f\x4e\xfd\xdb\xd8\xce\xea\xee\x6f\xdb\x94\x74\x7c\x9c\x7f\x05\x00\x00\xff\xff\xb8\xee\x53\x9e\xa4\x05\x00\x00")
+var _assetsVizHtml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xbc\x55\x4f\x8f\xdb\xb6\x13\xbd\xeb\x53\xbc\xf0\xb2\xd4\xef\xb7\x96\x13\x04\x01\x0a\xac\xe5\x22\x48\x7a\x6b\x50\x20\xed\xad\x28\x02\x5a\x1c\x99\xdc\xa5\x48\x83\xa4\xa4\x75\x16\xfb\xdd\x0b\x52\xb2\x2d\x6f\x52\x34\xa7\x9e\x04\xcd\xbc\x99\x79\xf3\x97\x1b\x15\x3b\xb3\x2d\x36\x8a\x84\xdc\x16\x9b\x57\xab\x55\xf1\x87\xd2\x01\x8d\x93\x04\x61\x8c\x1b\x03\x5a\xe7\xe1\x49\x04\x67\xc5\xce\x10\x82\xfe\xaa\xed\x1e\xa3\x22\x8b\xa8\xa8\xb0\x7d\xb7\x23\x0f\xd7\x22\xea\x8e\x7c\x80\x0e\x78\x55\xe3\x5d\xb1\x5a\x6d\x8b\x4d\x68\xbc\x3e\x44\x04\xdf\xd4\x4c\xbe\xad\x86\x77\x55\xa7\x6d\x75\x1f\xd8\x76\xb3\x9e\x74\xdf\x80\x1a\xe3\x9a\x87\x7f\x80\xc4\xe3\x81\x6a\x16\xe9\x31\xae\xef\xc5\x20\x26\x29\xdb\x16\x80\x14\xc7\x80\x1a\x4f\x4f\xd5\xf3\x73\x01\xac\xd7\xf8\xe8\xc5\x98\x18\x22\x3b\x9c\xf2\xb8\x49\xb0\x1b\xf0\x24\x56\xae\xf7\x01\xc2\x4a\x74\xda\xf6\x91\x02\x82\x72\xa3\x45\x6f\x25\x79\x90\x68\xd4\x64\x39\x79\x13\x9e\xd0\xb8\xee\xd0\x47\x92\xd8\x1d\xb3\xe3\x40\x7e\x20\x5f\x16\x40\xdb\xdb\x26\x6a\x67\x21\xbd\x18\x79\x89\xa7\x02\xb8\x90\xd8\xe9\xfd\xe4\x2a\x73\x88\x4e\x8a\x63\xd6\x1b\x8a\xd8\xe9\xfd\x97\x5c\x38\xd4\x90\x6f\xab\x40\x86\x9a\xf8\xde\x18\xce\xc2\xb0\xaf\xce\x5a\x56\x56\x52\xc4\xbe\xe3\x29\x81\x3f\x5f\xff\x95\x82\xe2\x62\xbc\xb4\xfb\x1f\x2b\x2b\x4f\x9d\x1b\x88\x4f\xa8\xf7\x87\x03\x59\xf9\x21\x11\xe0\x67\x8b\xb2\xb8\xa2\x28\x8c\xc9\x29\x19\x1d\xa3\xb9\x2a\x59\x0a\x88\x1d\xb5\xce\xd3\x82\xfa\xdc\xeb\xef\x71\x5e\xf0\x15\x99\x6e\x15\x8c\x6e\x88\xbf\x29\xcb\x85\x69\x45\x36\x92\xe7\x65\x25\x32\xbb\x6c\xca\xca\xaa\x31\x22\x04\x92\x9c\x65\x14\xbb\x45\xf4\x3d\x5d\xdb\x3d\xea\xc8\x5f\x64\x98\x0a\xe9\x51\xe3\x93\x88\xaa\x6a\x8d\x73\x9e\xff\xf4\x7a\x3d\x05\x37\x64\xf7\x51\xad\xde\x94\xe5\xdd\xd2\x4d\x88\x47\x43\x9c\x8d\x5a\x46\xc5\x6e\xe1\xf1\x7f\xb0\x61\x64\xe5\x49\xa1\x48\xef\x55\x5c\x6a\xae\xac\x7f\xb0\xdc\x13\xe7\xc4\xff\x39\xd5\x7b\xbd\xc6\x67\x5a\xb5\x14\x1b\x75\x1a\xc5\x34\x7f\x9e\xe4\xf5\xac\x56\xf8\x65\x20\x1b\x03\xa2\x12\x11\xc2\x7b\x3d\x10\x46\xa5\x0d\x41\xc0\x53\xeb\x29\xa8\xc9\x9d\x0e\xd0\x16\xad\x49\x64\xd1\x88\x3e\x10\x9c\x25\x74\xa9\x5b\x33\x10\xce\x36\x04\x1d\xd1\x6a\xab\x83\xa2\x50\xcc\x05\x9b\xd4\x69\x99\x6b\xb4\xc2\x04\xba\x45\x88\xc2\xd0\xe9\xf7\x6e\x39\xd8\xb3\xb3\xf3\x6c\xeb\x16\x7c\x96\x69\xbb\x3f\x49\x71\xf6\x90\xfa\x76\x97\xfb\x06\x78\x8a\xbd\xb7\xd3\x5f\x5a\x4e\x5c\xc7\xbe\x40\x73\x65\x38\x1b\xf4\xd7\x9f\x5b\xe7\x3b\x11\xeb\xfb\xe0\xec\x5c\x7a\xa0\x8a\x8a\x2c\xf7\x14\x0e\xa8\xb7\x48\xdf\x2a\xe9\x79\x79\x0d\x90\x49\xfb\x74\xba\x08\xf2\x6e\x5e\xca\x3b\x3c\x9f\x71\xad\xb6\xc2\x98\x23\xe7\x65\xc6\xce\xe2\x17\xbc\xce\x45\xc8\xaa\x9c\x71\xce\xee\x92\xec\x32\xe1\x17\xe8\xb3\x2f\x3e\xcf\xdd\x25\x79\x4c\x44\xf2\x44\x8c\xda\x4a\x37\x56\x42\xca\xdc\xf1\x5f\x75\x88\x64\xc9\xf3\x9b\x8f\xbf\x7d\xfa\xe0\x6c\x4c\x32\x27\x24\xc9\x9b\x5b\x70\x4a\x90\x05\xe3\x29\xaf\xd3\x1e\x7f\x9e\xa6\x28\x1d\x66\x1a\xc8\x2f\x2e\x14\x3c\x35\xce\xcb\x00\x81\xa8\x9b\x07\x38\x0f\x7a\x8c\x64\x93\xc4\x42\xa7\x45\x1c\x84\x39\x6f\x52\x0e\x93\x4a\x67\x69\x9c\x06\xf1\x77\xd7\xfb\x86\x38\x9b\x34\x73\x3f\xa6\x9f\x6f\xa9\xb3\x14\x23\x2d\xce\x34\x1d\xff\x02\x3e\x45\xbf\x36\x78\x2e\x8b\xc5\xf1\x37\xda\x3e\xc0\x93\xa9\x59\x5e\xce\xa0\x88\x22\x5b\xbe\x05\x4d\x08\x0c\xca\x53\x5b\xb3\x7c\xb9\xaa\x24\xd8\x6e\xd6\xc9\x70\x5b\x6c\xd6\xf3\xf3\xb6\x73\xf2\xb8\x2d\x36\x52\x0f\xc8\x77\xa6\x9e\xae\xcc\x97\x83\x90\x52\xdb\x3d\xfb\x9e\x6e\xe7\x1e\xf3\xfb\xb2\x09\xc3\xfe\xa4\x39\x1f\xd1\xfc\x8a\x0d\xfb\x14\x42\xea\xe1\x47\xcd\xaf\x4d\xff\x6b\xdd\x89\xea\xe9\x33\x17\x65\xad\x62\x67\xb6\xc5\xdf\x03\x00\x51\x09\x2b\x1d\x11\x08\x00\x00")
 
 func assetsVizHtmlBytes() ([]byte, error) {
 	return bindataRead(
@@ -197,7 +197,7 @@ func assetsVizHtml() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "assets/viz.html", size: 1444, mode: os.FileMode(420), modTime: time.Unix(1585261115, 0)}
+	info := bindataFileInfo{name: "assets/viz.html", size: 2065, mode: os.FileMode(420), modTime: time.Unix(1792179012, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
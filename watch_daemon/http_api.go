@@ -1,14 +1,18 @@
 package watchd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net"
 	"net/http"
+	"os"
 	p "path"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/msteffen/golang-time-tracker/client"
@@ -26,6 +30,11 @@ type httpServer struct {
 	// Owned
 	apiServer client.TimeTrackerAPI
 	startTime time.Time
+
+	// shutdown is closed when the HTTP servers shut down, which ends any
+	// /events streams (which otherwise never end, and would block shutdown)
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 func (d *httpServer) watch(w http.ResponseWriter, r *http.Request) {
@@ -44,10 +53,21 @@ func (d *httpServer) watch(w http.ResponseWriter, r *http.Request) {
 	if !p.IsAbs(req.Dir) {
 		msg := fmt.Sprintf("must provide absolute path to /watch: %q", req.Dir)
 		http.Error(w, msg, http.StatusBadRequest)
+		return
 	}
 	if req.Label == "" {
 		req.Label = p.Base(req.Dir)
 	}
+	switch req.Backend {
+	case "", client.BackendAuto, client.BackendInotify, client.BackendPoll,
+		client.BackendFanotify:
+	default:
+		msg := fmt.Sprintf("unknown watch backend %q (must be %q, %q, %q, or %q)",
+			req.Backend, client.BackendAuto, client.BackendInotify, client.BackendPoll,
+			client.BackendFanotify)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
 
 	// apply request
 	var err error
@@ -57,12 +77,146 @@ func (d *httpServer) watch(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(err.Error())) // just indicate that this call was a no-op w/ no err
 			return
 		}
+		if _, ok := err.(*TooManyWatchesErr); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+func (d *httpServer) unwatch(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "POST" {
+		http.Error(w, "must use POST to access /unwatch", http.StatusMethodNotAllowed)
+		return
+	}
+	var req client.UnwatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("request did not match expected type: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	req.Dir = p.Clean(req.Dir)
+	if !p.IsAbs(req.Dir) {
+		msg := fmt.Sprintf("must provide absolute path to /unwatch: %q", req.Dir)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Process request
+	if err := d.apiServer.Unwatch(&req); err != nil {
+		http.Error(w, err.Error(), watchErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *httpServer) updateWatch(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "POST" {
+		http.Error(w, "must use POST to access /watch/update", http.StatusMethodNotAllowed)
+		return
+	}
+	var req client.UpdateWatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("request did not match expected type: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	req.Dir = p.Clean(req.Dir)
+	if !p.IsAbs(req.Dir) {
+		msg := fmt.Sprintf("must provide absolute path to /watch/update: %q", req.Dir)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if req.Label == "" {
+		http.Error(w, "must provide a new \"label\" to /watch/update", http.StatusBadRequest)
+		return
+	}
+
+	// Process request
+	if err := d.apiServer.UpdateWatch(&req); err != nil {
+		http.Error(w, err.Error(), watchErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *httpServer) addLabelRule(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "POST" {
+		http.Error(w, "must use POST to access /watch/rules/add", http.StatusMethodNotAllowed)
+		return
+	}
+	var req client.AddLabelRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("request did not match expected type: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	req.Dir = p.Clean(req.Dir)
+	if !p.IsAbs(req.Dir) {
+		msg := fmt.Sprintf("must provide absolute path to /watch/rules/add: %q", req.Dir)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if err := validateRulePath(req.Rule.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Rule.Label == "" {
+		http.Error(w, "must provide a \"label\" for the rule to /watch/rules/add", http.StatusBadRequest)
+		return
+	}
+
+	// Process request
+	if err := d.apiServer.AddLabelRule(&req); err != nil {
+		http.Error(w, err.Error(), watchErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *httpServer) removeLabelRule(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "POST" {
+		http.Error(w, "must use POST to access /watch/rules/remove", http.StatusMethodNotAllowed)
+		return
+	}
+	var req client.RemoveLabelRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("request did not match expected type: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	req.Dir = p.Clean(req.Dir)
+	if !p.IsAbs(req.Dir) {
+		msg := fmt.Sprintf("must provide absolute path to /watch/rules/remove: %q", req.Dir)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Process request
+	if err := d.apiServer.RemoveLabelRule(&req); err != nil {
+		http.Error(w, err.Error(), watchErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// watchErrStatus returns the HTTP status code corresponding to an error
+// returned by Unwatch, UpdateWatch, AddLabelRule, or RemoveLabelRule
+func watchErrStatus(err error) int {
+	switch err.(type) {
+	case *NoSuchWatchErr, *NoSuchLabelRuleErr:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
 func (d *httpServer) tick(w http.ResponseWriter, r *http.Request) {
 	// Unmarshal and validate request
 	if r.Method != "POST" && r.Method != "GET" {
@@ -81,6 +235,7 @@ func (d *httpServer) tick(w http.ResponseWriter, r *http.Request) {
 			msg := "tick request must have a label (\"\" is used to " +
 				"indicate intervals formed by the union of all ticks in GetIntervals"
 			http.Error(w, msg, http.StatusBadRequest)
+			return
 		}
 	}
 
@@ -123,6 +278,14 @@ func (d *httpServer) getIntervals(w http.ResponseWriter, r *http.Request) {
 		Start: boundary[0],
 		End:   boundary[1],
 	}
+	if s := r.URL.Query().Get("labeled"); s != "" {
+		req.Labeled, err = strconv.ParseBool(s)
+		if err != nil {
+			msg := fmt.Sprintf("invalid \"labeled\" value: %s", err.Error())
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Process request
 	var result *client.GetIntervalsResponse
@@ -140,6 +303,45 @@ func (d *httpServer) getIntervals(w http.ResponseWriter, r *http.Request) {
 	w.Write(resultJSON)
 }
 
+func (d *httpServer) getActivity(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "GET" {
+		http.Error(w, "must use GET to access /activity", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Trasform GET params into request struct
+	boundary := []int64{0, math.MaxInt32} // start and end
+	var err error
+	for i, param := range []string{"start", "end"} {
+		if s := r.URL.Query().Get(param); s != "" {
+			boundary[i], err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				msg := fmt.Sprintf("invalid \"%s\" value: %s", param, err.Error())
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// Process request
+	result, err := d.apiServer.GetActivity(&client.GetActivityRequest{
+		Start: boundary[0],
+		End:   boundary[1],
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("could not serialize /activity result: %v", err)
+		http.Error(w, "could not serialize result: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultJSON)
+}
+
 func (d *httpServer) getWatches(w http.ResponseWriter, r *http.Request) {
 	// Unmarshal and validate request
 	if r.Method != "GET" {
@@ -164,6 +366,135 @@ func (d *httpServer) getWatches(w http.ResponseWriter, r *http.Request) {
 	w.Write(resultJSON)
 }
 
+func (d *httpServer) getEvictions(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "GET" {
+		http.Error(w, "must use GET to access /watches/evictions", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Process request
+	result, err := d.apiServer.GetEvictions(&client.GetEvictionsRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("could not serialize /watches/evictions result: %v", err)
+		http.Error(w, "could not serialize result: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultJSON)
+}
+
+func (d *httpServer) getProjects(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "GET" {
+		http.Error(w, "must use GET to access /projects", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Process request
+	result, err := d.apiServer.GetProjects(&client.GetProjectsRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("could not serialize /projects result: %v", err)
+		http.Error(w, "could not serialize result: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultJSON)
+}
+
+func (d *httpServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "GET" {
+		http.Error(w, "must use GET to access /config", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Process request
+	result, err := d.apiServer.GetConfig(&client.GetConfigRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("could not serialize /config result: %v", err)
+		http.Error(w, "could not serialize result: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultJSON)
+}
+
+// projectErrStatus returns the HTTP status code corresponding to an error
+// returned by RenameProject or MergeProjects
+func projectErrStatus(err error) int {
+	switch err.(type) {
+	case *NoSuchProjectErr:
+		return http.StatusNotFound
+	case *ProjectExistsErr:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (d *httpServer) renameProject(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "POST" {
+		http.Error(w, "must use POST to access /projects/rename", http.StatusMethodNotAllowed)
+		return
+	}
+	var req client.RenameProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("request did not match expected type: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if req.From == "" || req.To == "" {
+		http.Error(w, "must provide both \"from\" and \"to\" to /projects/rename", http.StatusBadRequest)
+		return
+	}
+
+	// Process request
+	if err := d.apiServer.RenameProject(&req); err != nil {
+		http.Error(w, err.Error(), projectErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *httpServer) mergeProjects(w http.ResponseWriter, r *http.Request) {
+	// Unmarshal and validate request
+	if r.Method != "POST" {
+		http.Error(w, "must use POST to access /projects/merge", http.StatusMethodNotAllowed)
+		return
+	}
+	var req client.MergeProjectsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("request did not match expected type: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if req.From == "" || req.Into == "" {
+		http.Error(w, "must provide both \"from\" and \"into\" to /projects/merge", http.StatusBadRequest)
+		return
+	}
+
+	// Process request
+	if err := d.apiServer.MergeProjects(&req); err != nil {
+		http.Error(w, err.Error(), projectErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (d *httpServer) clear(w http.ResponseWriter, r *http.Request) {
 	// Unmarshal and validate request
 	if r.Method != "POST" {
@@ -224,6 +555,63 @@ func (d *httpServer) status(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(time.Now().Sub(d.startTime).String()))
 }
 
+// events returns a handler for the /events endpoint, which streams the
+// server's events (see client.Event) as server-sent events, until the client
+// disconnects. If 'public' is set, the handler only sends tick and interval
+// events, and leaves out their labels (as the public endpoints don't reveal
+// what's being worked on)
+func (d *httpServer) events(public bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "must use GET to access /events", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		done := make(chan struct{})
+		defer close(done)
+		events, err := d.apiServer.Subscribe(done)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			var e *client.Event
+			select {
+			case e = <-events:
+			case <-r.Context().Done():
+				return
+			case <-d.shutdown:
+				return
+			}
+			if public {
+				if e.Type == client.EventWatch {
+					continue
+				}
+				redacted := *e
+				redacted.Label = ""
+				e = &redacted
+			}
+			eventJSON, err := json.Marshal(e)
+			if err != nil {
+				log.Errorf("could not serialize %s event: %v", e.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, eventJSON); err != nil {
+				return // client disconnected
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 func (d *httpServer) viz(w http.ResponseWriter, r *http.Request) {
 	// Unmarshal and validate request
 	if r.Method != "GET" {
@@ -235,51 +623,137 @@ func (d *httpServer) viz(w http.ResponseWriter, r *http.Request) {
 		Server: d.apiServer,
 		Now:    d.clock.Now(),
 		Writer: w,
+		JSON:   r.URL.Query().Get("format") == "json",
 	}
 	t.Start()
 }
 
-// ToHTTPServer wraps 'server' in a golang http.Server that uses 'server' to
-// serve the TimeTrackerAPI over HTTP on 'hostport'. This function is a helper
-// that returns the HTTP server to the caller so that it can be shut down later
-// (for tests). Non-testing users will likely prefer ServerOverHTTP, which
-// calls, effectively, ToHTTPServer(...).Serve()
-func ToHTTPServer(hostport string, clock Clock, server client.TimeTrackerAPI) *http.Server {
-	h := httpServer{
+// ToHTTPServers wraps 'server' in two golang http.Servers that use 'server' to
+// serve the TimeTrackerAPI over HTTP. 'control' serves every endpoint, and is
+// meant to be served on a unix socket that only the current user can access
+// (see ListenUnix), so that other users can't e.g. add ticks or clear the DB.
+// 'public' serves only /viz, /status, the assets used by /viz, and a redacted
+// /events stream (see httpServer.events) on 'hostport', so that /viz can be
+// viewed in a browser.
+//
+// Those public endpoints are read-only, and don't require authentication.
+// Every other endpoint rejects requests that don't include 'token' (see
+// LoadOrCreateToken), so that e.g. a malicious web page can't use the
+// browser to add ticks.
+//
+// This function is a helper that returns the HTTP servers to the caller so that
+// they can be shut down later (for tests). Non-testing users will likely prefer
+// Serve, which calls, effectively, Serve() on both servers
+func ToHTTPServers(hostport string, clock Clock, server client.TimeTrackerAPI, token string) (control, public *http.Server) {
+	h := &httpServer{
 		clock:     clock,
 		apiServer: &LoggingAPI{inner: server},
 		startTime: time.Now(),
+		shutdown:  make(chan struct{}),
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/viz", h.viz)
-	mux.HandleFunc("/status", h.status)
-	mux.HandleFunc("/watch", h.watch)
-	mux.HandleFunc("/watches", h.getWatches)
-	mux.HandleFunc("/tick", h.tick)
-	mux.HandleFunc("/clear", h.clear)
-	mux.HandleFunc("/intervals", h.getIntervals)
-	mux.HandleFunc("/", h.misc) // Serve all other assets (js files, or just 404)
-	return &http.Server{
+	publicMux := http.NewServeMux()
+	controlMux := http.NewServeMux()
+	for _, mux := range []*http.ServeMux{publicMux, controlMux} {
+		mux.HandleFunc("/viz", h.viz)
+		mux.HandleFunc("/status", h.status)
+		mux.HandleFunc("/", h.misc) // Serve all other assets (js files, or just 404)
+	}
+	controlMux.HandleFunc("/watch", requireToken(token, h.watch))
+	controlMux.HandleFunc("/unwatch", requireToken(token, h.unwatch))
+	controlMux.HandleFunc("/watch/update", requireToken(token, h.updateWatch))
+	controlMux.HandleFunc("/watch/rules/add", requireToken(token, h.addLabelRule))
+	controlMux.HandleFunc("/watch/rules/remove", requireToken(token, h.removeLabelRule))
+	controlMux.HandleFunc("/watches", requireToken(token, h.getWatches))
+	controlMux.HandleFunc("/watches/evictions", requireToken(token, h.getEvictions))
+	controlMux.HandleFunc("/tick", requireToken(token, h.tick))
+	controlMux.HandleFunc("/clear", requireToken(token, h.clear))
+	controlMux.HandleFunc("/intervals", requireToken(token, h.getIntervals))
+	controlMux.HandleFunc("/activity", requireToken(token, h.getActivity))
+	controlMux.HandleFunc("/projects", requireToken(token, h.getProjects))
+	controlMux.HandleFunc("/projects/rename", requireToken(token, h.renameProject))
+	controlMux.HandleFunc("/projects/merge", requireToken(token, h.mergeProjects))
+	controlMux.HandleFunc("/config", requireToken(token, h.getConfig))
+	controlMux.HandleFunc("/events", requireToken(token, h.events(false)))
+	publicMux.HandleFunc("/events", h.events(true))
+	control, public = &http.Server{Handler: controlMux}, &http.Server{
 		Addr:    hostport,
-		Handler: mux,
+		Handler: publicMux,
+	}
+	for _, s := range []*http.Server{control, public} {
+		s.RegisterOnShutdown(func() {
+			h.shutdownOnce.Do(func() { close(h.shutdown) })
+		})
 	}
+	return control, public
 }
 
-// ServeOverHTTP serves the Server API over HTTP, on the interface/port
-// specified by hostport
-func ServeOverHTTP(address string, clock Clock, server client.TimeTrackerAPI) error {
+// ListenUnix listens on a new unix socket at 'socketPath' that only the
+// current user can access (i.e. it has permissions 0600). If a file already
+// exists at 'socketPath' (e.g. the socket of a watch daemon that crashed), it's
+// removed, so callers must check that no other watch daemon is using it first.
+func ListenUnix(socketPath string) (net.Listener, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not remove stale socket %q: %v", socketPath, err)
+	}
+	// Set the umask while creating the socket, so that there's no window in
+	// which other users can connect to it
+	oldMask := syscall.Umask(0177)
+	l, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %q: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("could not set permissions of %q: %v", socketPath, err)
+	}
+	return l, nil
+}
+
+// Serve serves the Server API over HTTP: every endpoint is served on the unix
+// socket at 'socketPath', and /viz (and the endpoints it uses) are also served
+// on 'hostport' (see ToHTTPServers). If 'hostport' is "", /viz is only served
+// on the socket. Requests to any non-public endpoint must include 'token'. If
+// either server fails, both are shut down, the socket is removed, and the
+// failure is returned.
+func Serve(socketPath, hostport string, clock Clock, server client.TimeTrackerAPI, token string) error {
+	if token == "" {
+		return fmt.Errorf("cannot serve without a token")
+	}
+
 	// Check for a running server
-	c := &client.Client{Address: address}
+	c := &client.Client{Address: client.UnixPrefix + socketPath}
 	if _, err := c.Status(); err == nil {
-		_, port, err := net.SplitHostPort(address)
-		advice := fmt.Sprintf("(try 'sudo lsof -i :%s' to find the pid)", port)
-		if err != nil {
-			advice = fmt.Sprintf("(could not split hostport: %v)", err)
-		}
-		return fmt.Errorf("watch daemon is already running on address %q %s", address, advice)
+		return fmt.Errorf("watch daemon is already running on socket %q "+
+			"(try 'sudo lsof %s' to find the pid)", socketPath, socketPath)
 	}
 
-	// Start listening on 'address'
-	s := ToHTTPServer(address, clock, server)
-	return s.ListenAndServe()
+	// Start listening on 'socketPath' and 'hostport'
+	control, public := ToHTTPServers(hostport, clock, server, token)
+	l, err := ListenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- control.Serve(l)
+	}()
+	if hostport != "" {
+		go func() {
+			errCh <- public.ListenAndServe()
+		}()
+	}
+	// Stop serving if either server fails
+	err = <-errCh
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, s := range []*http.Server{control, public} {
+		if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+			log.Errorf("could not shut down server: %v", shutdownErr)
+		}
+	}
+	if rmErr := os.Remove(socketPath); rmErr != nil && !os.IsNotExist(rmErr) {
+		log.Errorf("could not remove socket %q: %v", socketPath, rmErr)
+	}
+	return err
 }
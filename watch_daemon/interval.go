@@ -57,6 +57,18 @@ func (c *Collector) Add(t int64) bool {
 	return true
 }
 
+// AddInterval adds the interval [start, end] (e.g. an interval that was
+// formed from ticks earlier and stored) to 'c', as if every tick in it had
+// been added. Intervals must be added in order of their start time, but may
+// overlap. Like Add(), returns 'false' if no more intervals need to be added
+func (c *Collector) AddInterval(start, end int64) bool {
+	if !c.Add(start) {
+		return false
+	}
+	c.end = max(c.end, end)
+	return true
+}
+
 // Finish indicates that no more ticks will be added. It closes the last
 // interval and returns the complete collectiono
 func (c *Collector) Finish() []client.Interval {
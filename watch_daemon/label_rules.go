@@ -0,0 +1,174 @@
+// label_rules.go contains helpers for label rules, which override the label of
+// file events in part of a watched directory (see client.LabelRule). Rules are
+// added explicitly (via AddLabelRule), when a watch is added inside an
+// existing watch (with WatchRequest.Override), or when a new watch subsumes
+// existing watches on its subdirectories.
+
+package watchd
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/msteffen/golang-time-tracker/pkg/watcher"
+)
+
+// globChars are the characters that have a special meaning in a rule's path
+// (see path.Match)
+const globChars = `*?[\`
+
+// isSubdir returns true if 'child' is a strict subdirectory of 'parent' (both
+// must be clean absolute paths)
+func isSubdir(parent, child string) bool {
+	if parent == "/" {
+		return child != "/"
+	}
+	return strings.HasPrefix(child, parent+"/")
+}
+
+// relPath returns the path of 'child' relative to 'parent', which must be a
+// parent of 'child' (see isSubdir)
+func relPath(parent, child string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(child, parent), "/")
+}
+
+// escapeGlob escapes the characters in 'p' that have a special meaning in a
+// rule's path, so that a rule with the path escapeGlob(p) applies exactly to
+// 'p' and the files under it
+func escapeGlob(p string) string {
+	var b strings.Builder
+	for _, c := range p {
+		if strings.ContainsRune(globChars, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// validateRulePath returns an error if 'p' isn't a valid label rule path: a
+// clean, relative path (which may contain globs) that doesn't leave the watched
+// dir
+func validateRulePath(p string) error {
+	switch {
+	case p == "" || p == ".":
+		return fmt.Errorf("label rule path must not be empty")
+	case path.IsAbs(p):
+		return fmt.Errorf("label rule path must be relative to the watched dir: %q", p)
+	case path.Clean(p) != p:
+		return fmt.Errorf("label rule path must be clean (i.e. %q): %q", path.Clean(p), p)
+	case p == ".." || strings.HasPrefix(p, "../"):
+		return fmt.Errorf("label rule path must be inside the watched dir: %q", p)
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return fmt.Errorf("invalid label rule path %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// ruleApplies returns true if the rule path 'pattern' applies to 'p' (a path
+// relative to the watched dir), i.e. if 'pattern' matches 'p' or one of the
+// directories containing 'p' (see watcher.MatchElems)
+func ruleApplies(pattern, p string) bool {
+	if p == "" {
+		return false // 'p' is the watched dir itself
+	}
+	patternElems, pElems := strings.Split(pattern, "/"), strings.Split(p, "/")
+	for i := len(pElems); i > 0; i-- {
+		if watcher.MatchElems(patternElems, pElems[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// specificity returns the number of non-wildcard characters in the rule path
+// 'pattern'. When several rules apply to a path, the one with the highest
+// specificity wins
+func specificity(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '\\':
+			i++ // escaped character
+			n++
+		case '[':
+			// a character class matches one character, like '?'
+			for i < len(pattern) && pattern[i] != ']' {
+				i++
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// matchRule returns the rule in 'rules' that applies to 'p' (a path relative to
+// the watched dir), i.e. the most specific rule whose path matches 'p' or one
+// of its parents (see client.LabelRule), or nil if no rule applies. Ties are
+// broken in favor of the rule that sorts first.
+func matchRule(rules []*StoredLabelRule, p string) *StoredLabelRule {
+	var result *StoredLabelRule
+	var resultSpecificity int
+	for _, r := range rules {
+		if !ruleApplies(r.Path, p) {
+			continue
+		}
+		if s := specificity(r.Path); result == nil || s > resultSpecificity {
+			result, resultSpecificity = r, s
+		}
+	}
+	return result
+}
+
+// rulesEqual returns true if 'a' and 'b' contain the same rules, in the same
+// order
+func rulesEqual(a, b []*StoredLabelRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// subsumedRules returns the label rules that a new watch on 'dir' has after
+// subsuming 'children' (existing watches on subdirectories of 'dir'): each
+// child's label and label rules become rules of the new watch. The result is
+// sorted by path.
+func subsumedRules(dir string, children []*StoredWatch) []*StoredLabelRule {
+	var result []*StoredLabelRule
+	for _, c := range children {
+		rel := escapeGlob(relPath(dir, c.Dir))
+		result = append(result, &StoredLabelRule{
+			Path:      rel,
+			Label:     c.Label,
+			ProjectID: c.ProjectID,
+		})
+		for _, r := range c.Rules {
+			result = append(result, &StoredLabelRule{
+				Path:      path.Join(rel, r.Path),
+				Label:     r.Label,
+				ProjectID: r.ProjectID,
+			})
+		}
+	}
+	sortRules(result)
+	return result
+}
+
+// sortRules sorts 'rules' by path
+func sortRules(rules []*StoredLabelRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Path < rules[j].Path
+	})
+}
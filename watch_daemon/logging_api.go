@@ -34,22 +34,39 @@ func (a *LoggingAPI) Tick(req *client.TickRequest) (resp *client.TickResponse, r
 // GetIntervals implements the corresponding method of the APIServer interface,
 // passing the call to a.inner and logging the request and response
 func (a *LoggingAPI) GetIntervals(req *client.GetIntervalsRequest) (resp *client.GetIntervalsResponse, retErr error) {
-	log.Infof("/intervals <- [%v, %v]", req.Start, req.End)
+	log.Infof("/intervals <- [%v, %v] (labeled: %t)", req.Start, req.End, req.Labeled)
 	defer func() {
 		endGapStr := ""
-		if resp.EndGap != 0 {
+		if resp != nil && resp.EndGap != 0 {
 			endGapStr = " + end gap"
 		}
-		numIntervals := 0
+		numIntervals, numLabels := 0, 0
 		if resp != nil && resp.Intervals != nil {
 			numIntervals = len(resp.Intervals)
 		}
-		log.Infof("/intervals [%v, %v] -> (%d intervals%s, %v)",
-			req.Start, req.End, numIntervals, endGapStr, retErr)
+		if resp != nil && resp.Labeled != nil {
+			numLabels = len(resp.Labeled)
+		}
+		log.Infof("/intervals [%v, %v] -> (%d intervals%s, %d labels, %v)",
+			req.Start, req.End, numIntervals, endGapStr, numLabels, retErr)
 	}()
 	return a.inner.GetIntervals(req)
 }
 
+// GetActivity implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) GetActivity(req *client.GetActivityRequest) (resp *client.GetActivityResponse, retErr error) {
+	log.Infof("/activity <- [%v, %v]", req.Start, req.End)
+	defer func() {
+		numFiles := 0
+		if resp != nil {
+			numFiles = len(resp.Files)
+		}
+		log.Infof("/activity -> (%d files, %v)", numFiles, retErr)
+	}()
+	return a.inner.GetActivity(req)
+}
+
 // GetWatches implements the corresponding method of the APIServer interface,
 // passing the call to a.inner and logging the request and response
 func (a *LoggingAPI) GetWatches(req *client.GetWatchesRequest) (resp *client.GetWatchesResponse, retErr error) {
@@ -60,6 +77,104 @@ func (a *LoggingAPI) GetWatches(req *client.GetWatchesRequest) (resp *client.Get
 	return a.inner.GetWatches(req)
 }
 
+// GetEvictions implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) GetEvictions(req *client.GetEvictionsRequest) (resp *client.GetEvictionsResponse, retErr error) {
+	log.Infof("/watches/evictions")
+	defer func() {
+		if resp == nil {
+			log.Infof("/watches/evictions -> %v", retErr)
+			return
+		}
+		log.Infof("/watches/evictions -> (%d evictions, %v)", len(resp.Evictions), retErr)
+	}()
+	return a.inner.GetEvictions(req)
+}
+
+// GetProjects implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) GetProjects(req *client.GetProjectsRequest) (resp *client.GetProjectsResponse, retErr error) {
+	log.Infof("/projects")
+	defer func() {
+		numProjects := 0
+		if resp != nil {
+			numProjects = len(resp.Projects)
+		}
+		log.Infof("/projects -> (%d projects, %v)", numProjects, retErr)
+	}()
+	return a.inner.GetProjects(req)
+}
+
+// Unwatch implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) Unwatch(req *client.UnwatchRequest) (retErr error) {
+	log.Infof("/unwatch <- %v", req)
+	defer func() {
+		log.Infof("/unwatch %v -> %v", req, retErr)
+	}()
+	return a.inner.Unwatch(req)
+}
+
+// UpdateWatch implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) UpdateWatch(req *client.UpdateWatchRequest) (retErr error) {
+	log.Infof("/watch/update <- %v", req)
+	defer func() {
+		log.Infof("/watch/update %v -> %v", req, retErr)
+	}()
+	return a.inner.UpdateWatch(req)
+}
+
+// AddLabelRule implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) AddLabelRule(req *client.AddLabelRuleRequest) (retErr error) {
+	log.Infof("/watch/rules/add <- %v", req)
+	defer func() {
+		log.Infof("/watch/rules/add %v -> %v", req, retErr)
+	}()
+	return a.inner.AddLabelRule(req)
+}
+
+// RemoveLabelRule implements the corresponding method of the APIServer
+// interface, passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) RemoveLabelRule(req *client.RemoveLabelRuleRequest) (retErr error) {
+	log.Infof("/watch/rules/remove <- %v", req)
+	defer func() {
+		log.Infof("/watch/rules/remove %v -> %v", req, retErr)
+	}()
+	return a.inner.RemoveLabelRule(req)
+}
+
+// RenameProject implements the corresponding method of the APIServer
+// interface, passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) RenameProject(req *client.RenameProjectRequest) (retErr error) {
+	log.Infof("/projects/rename <- %v", req)
+	defer func() {
+		log.Infof("/projects/rename %v -> %v", req, retErr)
+	}()
+	return a.inner.RenameProject(req)
+}
+
+// MergeProjects implements the corresponding method of the APIServer
+// interface, passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) MergeProjects(req *client.MergeProjectsRequest) (retErr error) {
+	log.Infof("/projects/merge <- %v", req)
+	defer func() {
+		log.Infof("/projects/merge %v -> %v", req, retErr)
+	}()
+	return a.inner.MergeProjects(req)
+}
+
+// GetConfig implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the request and response
+func (a *LoggingAPI) GetConfig(req *client.GetConfigRequest) (resp *client.Config, retErr error) {
+	log.Infof("/config")
+	defer func() {
+		log.Infof("/config -> (%+v, %v)", resp, retErr)
+	}()
+	return a.inner.GetConfig(req)
+}
+
 // Clear implements the corresponding method of the APIServer interface, passing
 // the call to a.inner and logging the request and response
 func (a *LoggingAPI) Clear() (retErr error) {
@@ -69,3 +184,13 @@ func (a *LoggingAPI) Clear() (retErr error) {
 	}()
 	return a.inner.Clear()
 }
+
+// Subscribe implements the corresponding method of the APIServer interface,
+// passing the call to a.inner and logging the subscription (but not each event)
+func (a *LoggingAPI) Subscribe(done <-chan struct{}) (events <-chan *client.Event, retErr error) {
+	log.Infof("/events")
+	defer func() {
+		log.Infof("/events -> %v", retErr)
+	}()
+	return a.inner.Subscribe(done)
+}
@@ -0,0 +1,467 @@
+package watchd
+
+import (
+	"sort"
+	"time"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// memInterval is an interval stored by memoryStore
+type memInterval struct {
+	start, end int64
+	project    int64 // unionProjectID for the union of all projects
+}
+
+// memEviction is an eviction stored by memoryStore
+type memEviction struct {
+	dir     string
+	project int64
+	time    int64
+	reason  string
+}
+
+// memActivity is a write to a file recorded by memoryStore
+type memActivity struct {
+	time    int64
+	project int64
+	path    string
+}
+
+// memoryStore is an implementation of Store that keeps all data in memory. It
+// folds ticks into intervals exactly as sqliteStore does (see fold.go), but
+// all lookups are linear scans, so it's intended for tests and experiments
+// rather than long-lived data.
+type memoryStore struct {
+	// intervals contains all intervals, in the order in which they were created
+	intervals []*memInterval
+
+	// projects maps each project's name to its ID
+	projects map[string]int64
+
+	// nextProjectID is the ID that will be assigned to the next project created
+	nextProjectID int64
+
+	// watches maps each watched dir to its watch
+	watches map[string]*StoredWatch
+
+	// evictions contains all evictions, in the order in which they occurred
+	evictions []*memEviction
+
+	// activity contains all recorded writes to files, in the order in which
+	// they were recorded
+	activity []*memActivity
+}
+
+// NewMemoryStore returns a Store that keeps all data in memory
+func NewMemoryStore() Store {
+	s := &memoryStore{}
+	s.Clear()
+	return s
+}
+
+// projectID returns the ID of the project named 'label', creating it if it
+// doesn't exist yet (like projectID in fold.go, it rejects invalid labels)
+func (s *memoryStore) projectID(label string) (int64, error) {
+	if err := validateLabel(label); err != nil {
+		return 0, err
+	}
+	id, ok := s.projects[label]
+	if !ok {
+		id = s.nextProjectID
+		s.nextProjectID++
+		s.projects[label] = id
+	}
+	return id, nil
+}
+
+// projectName returns the name of the project with the ID 'id' (or "" for
+// unionProjectID)
+func (s *memoryStore) projectName(id int64) string {
+	for name, pid := range s.projects {
+		if pid == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// latest returns the most recent interval of the project 'project' (or, if
+// 'project' is nil, the most recent interval of any project except the union),
+// or nil if there is no such interval
+func (s *memoryStore) latest(project *int64) *memInterval {
+	var result *memInterval
+	for _, i := range s.intervals {
+		if project == nil && i.project == unionProjectID ||
+			project != nil && i.project != *project {
+			continue
+		}
+		if result == nil || i.end >= result.end {
+			result = i
+		}
+	}
+	return result
+}
+
+// extendInterval is memoryStore's equivalent of the SQL-based extendInterval
+// in fold.go
+func (s *memoryStore) extendInterval(maxEventGap int64, project int64, t int64) {
+	l := s.latest(&project)
+	switch {
+	case l != nil && l.start <= t && t <= l.end:
+		return // 't' is already in the latest interval (e.g. duplicate tick)
+	case l != nil && l.end < t && t-l.end <= maxEventGap:
+		l.end = t
+	default:
+		s.intervals = append(s.intervals, &memInterval{start: t, end: t, project: project})
+	}
+}
+
+// foldProjectTick is memoryStore's equivalent of foldProjectTick in fold.go
+func (s *memoryStore) foldProjectTick(maxEventGap int64, t int64, project int64) {
+	prev := s.latest(nil)
+	s.extendInterval(maxEventGap, unionProjectID, t)
+	if prev != nil && prev.project != project && prev.end <= t {
+		// New activity was started--this activity's interval starts at the end of
+		// the previous activity's interval
+		s.extendInterval(maxEventGap, project, prev.end)
+	}
+	s.extendInterval(maxEventGap, project, t)
+}
+
+// AddTick implements the corresponding method of the Store interface
+func (s *memoryStore) AddTick(t int64, label string, maxEventGap int64) error {
+	project, err := s.projectID(label)
+	if err != nil {
+		return err
+	}
+	s.foldProjectTick(maxEventGap, t, project)
+	return nil
+}
+
+// RecordWrite implements the corresponding method of the Store interface
+func (s *memoryStore) RecordWrite(dir string, project int64, t int64, maxEventGap int64) error {
+	s.foldProjectTick(maxEventGap, t, project)
+	if w, ok := s.watches[dir]; ok {
+		w.LastWrite = time.Unix(t, 0)
+	}
+	return nil
+}
+
+// RecordActivity implements the corresponding method of the Store interface
+func (s *memoryStore) RecordActivity(project int64, t int64, paths []string) error {
+	for _, path := range paths {
+		s.activity = append(s.activity, &memActivity{time: t, project: project, path: path})
+	}
+	return nil
+}
+
+// GetActivity implements the corresponding method of the Store interface
+func (s *memoryStore) GetActivity(start, end int64) ([]*client.FileActivity, error) {
+	type key struct{ label, path string }
+	files := make(map[key]*client.FileActivity)
+	var result []*client.FileActivity
+	for _, a := range s.activity {
+		if a.time < start || a.time > end {
+			continue
+		}
+		k := key{label: s.projectName(a.project), path: a.path}
+		f, ok := files[k]
+		if !ok {
+			f = &client.FileActivity{Label: k.label, Path: k.path}
+			files[k] = f
+			result = append(result, f)
+		}
+		f.Edits++
+		if a.time > f.LastEdit {
+			f.LastEdit = a.time
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		switch {
+		case result[i].Label != result[j].Label:
+			return result[i].Label < result[j].Label
+		case result[i].Edits != result[j].Edits:
+			return result[i].Edits > result[j].Edits
+		}
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+// TrimActivity implements the corresponding method of the Store interface
+func (s *memoryStore) TrimActivity(before int64) error {
+	var kept []*memActivity
+	for _, a := range s.activity {
+		if a.time >= before {
+			kept = append(kept, a)
+		}
+	}
+	s.activity = kept
+	return nil
+}
+
+// GetIntervals implements the corresponding method of the Store interface
+func (s *memoryStore) GetIntervals(start, end int64) ([]StoredInterval, error) {
+	var result []StoredInterval
+	for _, i := range s.intervals {
+		if i.end >= start && i.start <= end {
+			result = append(result, StoredInterval{
+				Start: i.start,
+				End:   i.end,
+				Label: s.projectName(i.project),
+			})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Start < result[j].Start
+	})
+	return result, nil
+}
+
+// LastTick implements the corresponding method of the Store interface
+func (s *memoryStore) LastTick() (t int64, label string, ok bool, err error) {
+	l := s.latest(nil)
+	if l == nil {
+		return 0, "", false, nil
+	}
+	return l.end, s.projectName(l.project), true, nil
+}
+
+// AddWatch implements the corresponding method of the Store interface
+func (s *memoryStore) AddWatch(dir, label, backend string, burstThreshold int, lastWrite int64) error {
+	project, err := s.projectID(label)
+	if err != nil {
+		return err
+	}
+	s.watches[dir] = &StoredWatch{
+		Dir:            dir,
+		Label:          label,
+		ProjectID:      project,
+		LastWrite:      time.Unix(lastWrite, 0),
+		Backend:        backend,
+		BurstThreshold: burstThreshold,
+	}
+	return nil
+}
+
+// SubsumeWatches implements the corresponding method of the Store interface
+func (s *memoryStore) SubsumeWatches(dir, label, backend string, burstThreshold int, lastWrite int64) error {
+	// add the new watch first, so that nothing is removed if it's invalid
+	if err := s.AddWatch(dir, label, backend, burstThreshold, lastWrite); err != nil {
+		return err
+	}
+	var children []*StoredWatch
+	for _, w := range s.watches {
+		if isSubdir(dir, w.Dir) {
+			children = append(children, w)
+			delete(s.watches, w.Dir)
+		}
+	}
+	s.watches[dir].Rules = subsumedRules(dir, children)
+	return nil
+}
+
+// AddLabelRule implements the corresponding method of the Store interface
+func (s *memoryStore) AddLabelRule(dir, path, label string) error {
+	w, ok := s.watches[dir]
+	if !ok {
+		return &NoSuchWatchErr{dir: dir}
+	}
+	project, err := s.projectID(label)
+	if err != nil {
+		return err
+	}
+	rule := &StoredLabelRule{Path: path, Label: label, ProjectID: project}
+	for i, r := range w.Rules {
+		if r.Path == path {
+			w.Rules[i] = rule
+			return nil
+		}
+	}
+	w.Rules = append(w.Rules, rule)
+	sortRules(w.Rules)
+	return nil
+}
+
+// RemoveLabelRule implements the corresponding method of the Store interface
+func (s *memoryStore) RemoveLabelRule(dir, path string) error {
+	w, ok := s.watches[dir]
+	if !ok {
+		return &NoSuchWatchErr{dir: dir}
+	}
+	for i, r := range w.Rules {
+		if r.Path == path {
+			w.Rules = append(w.Rules[:i], w.Rules[i+1:]...)
+			return nil
+		}
+	}
+	return &NoSuchLabelRuleErr{dir: dir, path: path}
+}
+
+// RemoveWatch implements the corresponding method of the Store interface
+func (s *memoryStore) RemoveWatch(dir string) error {
+	if _, ok := s.watches[dir]; !ok {
+		return &NoSuchWatchErr{dir: dir}
+	}
+	delete(s.watches, dir)
+	return nil
+}
+
+// UpdateWatch implements the corresponding method of the Store interface
+func (s *memoryStore) UpdateWatch(dir, label string) error {
+	w, ok := s.watches[dir]
+	if !ok {
+		return &NoSuchWatchErr{dir: dir}
+	}
+	project, err := s.projectID(label)
+	if err != nil {
+		return err
+	}
+	w.ProjectID = project
+	w.Label = label
+	return nil
+}
+
+// GetWatches implements the corresponding method of the Store interface
+func (s *memoryStore) GetWatches() ([]*StoredWatch, error) {
+	result := make([]*StoredWatch, 0, len(s.watches))
+	for _, w := range s.watches {
+		wCopy := *w
+		wCopy.Label = s.projectName(w.ProjectID)
+		wCopy.Rules = make([]*StoredLabelRule, 0, len(w.Rules))
+		for _, r := range w.Rules {
+			wCopy.Rules = append(wCopy.Rules, &StoredLabelRule{
+				Path:      r.Path,
+				Label:     s.projectName(r.ProjectID),
+				ProjectID: r.ProjectID,
+			})
+		}
+		result = append(result, &wCopy)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Dir < result[j].Dir
+	})
+	return result, nil
+}
+
+// EvictWatches implements the corresponding method of the Store interface
+func (s *memoryStore) EvictWatches(dirs []string, reason string, t int64) error {
+	for _, dir := range dirs {
+		w, ok := s.watches[dir]
+		if !ok {
+			continue
+		}
+		s.evictions = append(s.evictions, &memEviction{
+			dir:     dir,
+			project: w.ProjectID,
+			time:    t,
+			reason:  reason,
+		})
+		delete(s.watches, dir)
+	}
+	return nil
+}
+
+// GetEvictions implements the corresponding method of the Store interface
+func (s *memoryStore) GetEvictions() ([]*StoredEviction, error) {
+	result := make([]*StoredEviction, 0, len(s.evictions))
+	// iterate backwards, as evictions are stored in the order they occurred
+	for i := len(s.evictions) - 1; i >= 0; i-- {
+		e := s.evictions[i]
+		result = append(result, &StoredEviction{
+			Dir:    e.dir,
+			Label:  s.projectName(e.project),
+			Time:   e.time,
+			Reason: e.reason,
+		})
+	}
+	return result, nil
+}
+
+// GetProjects implements the corresponding method of the Store interface
+func (s *memoryStore) GetProjects() ([]*client.ProjectInfo, error) {
+	result := make([]*client.ProjectInfo, 0, len(s.projects))
+	for name, id := range s.projects {
+		result = append(result, &client.ProjectInfo{ID: id, Name: name})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// RenameProject implements the corresponding method of the Store interface
+func (s *memoryStore) RenameProject(from, to string) error {
+	id, ok := s.projects[from]
+	if !ok {
+		return &NoSuchProjectErr{name: from}
+	}
+	if err := validateLabel(to); err != nil {
+		return err
+	}
+	if _, ok := s.projects[to]; ok {
+		return &ProjectExistsErr{name: to}
+	}
+	delete(s.projects, from)
+	s.projects[to] = id
+	return nil
+}
+
+// MergeProjects implements the corresponding method of the Store interface
+func (s *memoryStore) MergeProjects(from, into string) error {
+	fromID, ok := s.projects[from]
+	if !ok {
+		return &NoSuchProjectErr{name: from}
+	}
+	intoID, ok := s.projects[into]
+	if !ok {
+		return &NoSuchProjectErr{name: into}
+	}
+	if fromID == intoID {
+		return nil // nothing to do
+	}
+	for _, i := range s.intervals {
+		if i.project == fromID {
+			i.project = intoID
+		}
+	}
+	for _, w := range s.watches {
+		if w.ProjectID == fromID {
+			w.ProjectID = intoID
+		}
+		for _, r := range w.Rules {
+			if r.ProjectID == fromID {
+				r.ProjectID = intoID
+			}
+		}
+	}
+	for _, e := range s.evictions {
+		if e.project == fromID {
+			e.project = intoID
+		}
+	}
+	for _, a := range s.activity {
+		if a.project == fromID {
+			a.project = intoID
+		}
+	}
+	delete(s.projects, from)
+	return nil
+}
+
+// Clear implements the corresponding method of the Store interface
+func (s *memoryStore) Clear() error {
+	s.intervals = nil
+	s.projects = make(map[string]int64)
+	s.nextProjectID = unionProjectID + 1
+	s.watches = make(map[string]*StoredWatch)
+	s.evictions = nil
+	s.activity = nil
+	return nil
+}
+
+// Close implements the corresponding method of the Store interface
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,468 @@
+// migrate.go contains the time tracker's schema migrations. Every change to the
+// schema of the time tracker's SQLite DB is a new step at the end of
+// 'migrations'. The index (+1) of the last step applied to a DB is recorded in
+// its 'schema_version' table, and NewServer applies any steps that a DB is
+// missing before serving from it.
+//
+// Steps must never be modified or reordered once they've been released, as
+// existing DBs have already applied them.
+
+package watchd
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/msteffen/golang-time-tracker/pkg/escape"
+)
+
+// migration is a single step in the evolution of the time tracker's schema
+type migration struct {
+	// description is a human-readable summary of the step, displayed by
+	// 't db migrate'
+	description string
+
+	// apply applies the step inside 'txn'. maxEventGap is the server's
+	// configured maxEventGap (needed by steps that fold ticks into intervals)
+	apply func(txn *sql.Tx, maxEventGap int64) error
+}
+
+// migrations is the ordered list of all schema migrations. A DB at version N
+// has had migrations[0:N] applied to it.
+//
+// DBs created before 'schema_version' existed have no version, and are treated
+// as version 0. Steps 1-3 are written so that they can be applied to such DBs,
+// whichever unversioned schema they have.
+var migrations = []migration{
+	{
+		description: "create ticks and watches tables",
+		apply: func(txn *sql.Tx, _ int64) error {
+			return execAll(txn,
+				"CREATE TABLE IF NOT EXISTS ticks (time INTEGER PRIMARY KEY ASC, labels TEXT);",
+				"CREATE TABLE IF NOT EXISTS watches (last_write INTEGER, dir TEXT, label TEXT);",
+			)
+		},
+	},
+	{
+		description: "move labels into projects table and create intervals table",
+		apply: func(txn *sql.Tx, _ int64) error {
+			if err := execAll(txn,
+				"CREATE TABLE IF NOT EXISTS projects (id INTEGER PRIMARY KEY ASC, name TEXT UNIQUE);",
+			); err != nil {
+				return err
+			}
+			if err := migrateLabels(txn); err != nil {
+				return err
+			}
+			// The indexes on 'intervals' allow for fast range scans (by GetIntervals)
+			// and fast lookup of each project's most recent interval (by foldTick)
+			return execAll(txn,
+				"CREATE TABLE IF NOT EXISTS intervals (start_time INTEGER, end_time INTEGER, project_id INTEGER);",
+				"CREATE INDEX IF NOT EXISTS intervals_by_end ON intervals (end_time);",
+				"CREATE INDEX IF NOT EXISTS intervals_by_project ON intervals (project_id, end_time);",
+			)
+		},
+	},
+	{
+		description: "fold ticks into intervals table",
+		apply:       migrateTicks,
+	},
+	{
+		description: "store raw project names and watched dirs",
+		apply: func(txn *sql.Tx, _ int64) error {
+			if err := unescapeLegacyText(txn, "projects", "id", "name"); err != nil {
+				return err
+			}
+			return unescapeLegacyText(txn, "watches", "rowid", "dir")
+		},
+	},
+	{
+		description: "create label_rules table",
+		apply: func(txn *sql.Tx, _ int64) error {
+			return execAll(txn, `
+			  CREATE TABLE IF NOT EXISTS label_rules (
+			    dir TEXT,
+			    path TEXT,
+			    project_id INTEGER,
+			    PRIMARY KEY (dir, path)
+			  );`,
+			)
+		},
+	},
+	{
+		description: "create evictions table",
+		apply: func(txn *sql.Tx, _ int64) error {
+			return execAll(txn,
+				"CREATE TABLE IF NOT EXISTS evictions (dir TEXT, project_id INTEGER, time INTEGER, reason TEXT);",
+			)
+		},
+	},
+	{
+		description: "add backend column to watches",
+		apply: func(txn *sql.Tx, _ int64) error {
+			return execAll(txn,
+				"ALTER TABLE watches ADD COLUMN backend TEXT NOT NULL DEFAULT 'auto';",
+			)
+		},
+	},
+	{
+		description: "create activity table",
+		apply: func(txn *sql.Tx, _ int64) error {
+			// The index on 'activity' allows for fast range scans (by GetActivity
+			// and TrimActivity)
+			return execAll(txn,
+				"CREATE TABLE IF NOT EXISTS activity (time INTEGER, project_id INTEGER, path TEXT);",
+				"CREATE INDEX IF NOT EXISTS activity_by_time ON activity (time);",
+			)
+		},
+	},
+	{
+		description: "add burst_threshold column to watches",
+		apply: func(txn *sql.Tx, _ int64) error {
+			return execAll(txn,
+				"ALTER TABLE watches ADD COLUMN burst_threshold INTEGER NOT NULL DEFAULT 0;",
+			)
+		},
+	},
+}
+
+// schemaVersion is the version of the schema created by this binary
+var schemaVersion = len(migrations)
+
+// MigrationPlan describes the schema migrations that were applied to a DB (or
+// that would be applied to it, in a dry run)
+type MigrationPlan struct {
+	// From is the DB's schema version before migrating
+	From int
+	// To is the DB's schema version after migrating
+	To int
+	// Steps describes each migration applied, in order
+	Steps []string
+}
+
+// execAll executes each statement in 'stmts' in order, stopping at the first
+// error
+func execAll(db dbExecQuerier, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("could not execute %q: %v", stmt, err)
+		}
+	}
+	return nil
+}
+
+// currentSchemaVersion returns the schema version of 'db' (0 if the DB is
+// empty or predates schema_version)
+func currentSchemaVersion(db dbExecQuerier) (int, error) {
+	if err := execAll(db, `
+	  CREATE TABLE IF NOT EXISTS schema_version (
+	    version INTEGER PRIMARY KEY, description TEXT, applied_at INTEGER
+	  );
+	`); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := db.QueryRow(
+		"SELECT COALESCE(MAX(version), 0) FROM schema_version;",
+	).Scan(&version); err != nil {
+		return 0, fmt.Errorf("could not read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// migrate brings the schema of 'db' up to date, applying each missing step in
+// its own transaction (along with the corresponding update to
+// schema_version), so that a failed step leaves the DB at the previous
+// version. If 'dryRun' is true, all steps are applied in a single transaction
+// that is then rolled back, so that migrate validates the steps without
+// modifying the DB.
+func migrate(db *sql.DB, clock Clock, maxEventGap int64, dryRun bool) (plan *MigrationPlan, retErr error) {
+	// All steps happen in 'txn' for dry runs; otherwise each step gets its own
+	var txn *sql.Tx
+	defer func() {
+		if txn != nil && (retErr != nil || dryRun) {
+			txn.Rollback()
+		}
+	}()
+	begin := func() error {
+		if txn != nil {
+			return nil
+		}
+		var err error
+		if txn, err = db.Begin(); err != nil {
+			return fmt.Errorf("could not start migration txn: %v", err)
+		}
+		return nil
+	}
+
+	if err := begin(); err != nil {
+		return nil, err
+	}
+	from, err := currentSchemaVersion(txn)
+	if err != nil {
+		return nil, err
+	}
+	if from > schemaVersion {
+		return nil, fmt.Errorf("DB schema version (%d) is newer than the newest "+
+			"version known to this binary (%d); upgrade time-tracker to use this DB",
+			from, schemaVersion)
+	}
+	plan = &MigrationPlan{From: from, To: schemaVersion}
+	for v := from + 1; v <= schemaVersion; v++ {
+		m := migrations[v-1]
+		if err := begin(); err != nil {
+			return nil, err
+		}
+		if err := m.apply(txn, maxEventGap); err != nil {
+			return nil, fmt.Errorf("could not migrate DB to version %d (%s): %v",
+				v, m.description, err)
+		}
+		if _, err := txn.Exec(
+			"INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?);",
+			v, m.description, clock.Now().Unix(),
+		); err != nil {
+			return nil, fmt.Errorf("could not record schema version %d: %v", v, err)
+		}
+		if !dryRun {
+			if err := txn.Commit(); err != nil {
+				return nil, fmt.Errorf("could not commit migration to version %d: %v", v, err)
+			}
+			txn = nil
+		}
+		plan.Steps = append(plan.Steps, fmt.Sprintf("%d: %s", v, m.description))
+	}
+	if !dryRun && txn != nil {
+		// no steps were applied, but schema_version may have been created
+		if err := txn.Commit(); err != nil {
+			return nil, fmt.Errorf("could not commit schema_version: %v", err)
+		}
+		txn = nil
+	}
+	return plan, nil
+}
+
+// MigrateDB brings the schema of the DB at 'dbPath' up to date (as NewServer
+// does on startup), and returns the steps that were applied. Legacy ticks are
+// folded into intervals with the max event gap 'maxEventGap' (in seconds),
+// which should be the daemon's setting. If 'dryRun' is true, the steps are
+// validated but not committed.
+func MigrateDB(dbPath string, maxEventGap int64, dryRun bool) (*MigrationPlan, error) {
+	if maxEventGap <= 0 {
+		return nil, fmt.Errorf("max event gap must be positive, but was %ds", maxEventGap)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open DB: %v", err)
+	}
+	defer db.Close()
+	return migrate(db, SystemClock, maxEventGap, dryRun)
+}
+
+// migrateTicks folds the ticks in the 'ticks' table, in which the original
+// schema stored every tick in its own row, into the intervals table, and then
+// drops 'ticks'
+func migrateTicks(txn *sql.Tx, maxEventGap int64) error {
+	if ok, err := hasTable(txn, "ticks"); err != nil || !ok {
+		return err // nothing to migrate
+	}
+	rows, err := txn.Query("SELECT time, labels FROM ticks ORDER BY time ASC;")
+	if err != nil {
+		return fmt.Errorf("could not read ticks: %v", err)
+	}
+	// read all ticks before folding them, as foldTick() queries 'txn' too.
+	// Labels are copied as-is; they're decoded along with all other labels by
+	// unescapeLegacyText
+	var ticks []StoredInterval
+	for rows.Next() {
+		var t StoredInterval
+		if err := rows.Scan(&t.Start, &t.Label); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning tick row: %v", err)
+		}
+		ticks = append(ticks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading ticks: %v", err)
+	}
+	for _, t := range ticks {
+		if t.Label == "" {
+			// The original /tick handler didn't stop after rejecting an empty label,
+			// so legacy DBs may contain unlabeled ticks. They can't belong to a
+			// project, but they still count towards the time worked
+			if err := extendInterval(txn, maxEventGap, unionProjectID, t.Start); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := foldTick(txn, maxEventGap, t.Start, t.Label); err != nil {
+			return err
+		}
+	}
+	if _, err := txn.Exec("DROP TABLE ticks;"); err != nil {
+		return fmt.Errorf("could not drop 'ticks' table: %v", err)
+	}
+	return nil
+}
+
+// hasTable returns true if the table 'table' exists
+func hasTable(db dbExecQuerier, table string) (bool, error) {
+	var n int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;", table,
+	).Scan(&n); err != nil {
+		return false, fmt.Errorf("could not check for %q table: %v", table, err)
+	}
+	return n > 0, nil
+}
+
+// hasColumn returns true if the table 'table' exists and has a column named
+// 'column'
+func hasColumn(db dbExecQuerier, table, column string) (bool, error) {
+	var n int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;", table, column,
+	).Scan(&n); err != nil {
+		return false, fmt.Errorf("could not read columns of %q: %v", table, err)
+	}
+	return n > 0, nil
+}
+
+// migrateLabels converts the intervals and watches tables from storing each
+// label as a string to referring to labels by their ID in the 'projects'
+// table, which must already exist. Tables that don't exist or are already
+// converted are skipped.
+func migrateLabels(txn *sql.Tx) error {
+	for _, m := range []struct {
+		table, columns string
+		// prepare, if set, fixes up rows in the old table, 'old_<table>', before
+		// projects are created for their labels
+		prepare func(txn *sql.Tx) error
+		// copy copies rows from the old table to the new table
+		copy string
+	}{
+		{
+			table:   "intervals",
+			columns: "start_time INTEGER, end_time INTEGER, project_id INTEGER",
+			copy: fmt.Sprintf(`
+			  INSERT INTO intervals (start_time, end_time, project_id)
+			  SELECT o.start_time, o.end_time, COALESCE(p.id, %d)
+			  FROM old_intervals o LEFT JOIN projects p ON p.name = o.label;
+			`, unionProjectID),
+		},
+		{
+			table:   "watches",
+			columns: "last_write INTEGER, dir TEXT, project_id INTEGER",
+			prepare: labelUnlabeledWatches,
+			copy: `
+			  INSERT INTO watches (last_write, dir, project_id)
+			  SELECT o.last_write, o.dir, p.id
+			  FROM old_watches o JOIN projects p ON p.name = o.label;
+			`,
+		},
+	} {
+		if ok, err := hasColumn(txn, m.table, "label"); err != nil {
+			return err
+		} else if !ok {
+			continue // already migrated (or table doesn't exist)
+		}
+		if _, err := txn.Exec(fmt.Sprintf(`ALTER TABLE %[1]s RENAME TO old_%[1]s;`, m.table)); err != nil {
+			return fmt.Errorf("could not migrate labels in %q: %v", m.table, err)
+		}
+		if m.prepare != nil {
+			if err := m.prepare(txn); err != nil {
+				return fmt.Errorf("could not migrate labels in %q: %v", m.table, err)
+			}
+		}
+		if err := execAll(txn,
+			fmt.Sprintf(`
+			  INSERT OR IGNORE INTO projects (name)
+			  SELECT DISTINCT label FROM old_%s WHERE label != '';
+			`, m.table),
+			fmt.Sprintf(`CREATE TABLE %s (%s);`, m.table, m.columns),
+			m.copy,
+			fmt.Sprintf(`DROP TABLE old_%s;`, m.table),
+		); err != nil {
+			return fmt.Errorf("could not migrate labels in %q: %v", m.table, err)
+		}
+	}
+	return nil
+}
+
+// labelUnlabeledWatches labels each watch in 'old_watches' that has no label
+// with the base name of its dir. Watches must be in a project, and "" can't be
+// the name of one (see validateLabel), so otherwise migrateLabels would drop
+// these watches
+func labelUnlabeledWatches(txn *sql.Tx) error {
+	rows, err := txn.Query("SELECT rowid, dir FROM old_watches WHERE label = '';")
+	if err != nil {
+		return fmt.Errorf("could not read unlabeled watches: %v", err)
+	}
+	labels := make(map[int64]string)
+	for rows.Next() {
+		var rowID int64
+		var dir string
+		if err := rows.Scan(&rowID, &dir); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not read unlabeled watch: %v", err)
+		}
+		labels[rowID] = path.Base(dir)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read unlabeled watches: %v", err)
+	}
+	for rowID, label := range labels {
+		if _, err := txn.Exec(
+			"UPDATE old_watches SET label = ? WHERE rowid = ?;", label, rowID,
+		); err != nil {
+			return fmt.Errorf("could not label watch %d: %v", rowID, err)
+		}
+	}
+	return nil
+}
+
+// decodeLegacyText decodes a string written to the DB by versions of the time
+// tracker that built SQL statements with fmt.Sprintf: strings were escaped
+// with escape.Escape and then quoted with Go's %q, whose escape sequences
+// SQLite stored verbatim
+func decodeLegacyText(stored string) string {
+	if unquoted, err := strconv.Unquote(`"` + stored + `"`); err == nil {
+		stored = unquoted
+	}
+	return escape.Unescape(stored)
+}
+
+// unescapeLegacyText rewrites every value in 'column' of 'table' (whose rows
+// are identified by 'key') with decodeLegacyText
+func unescapeLegacyText(txn *sql.Tx, table, key, column string) error {
+	rows, err := txn.Query(fmt.Sprintf("SELECT %s, %s FROM %s;", key, column, table))
+	if err != nil {
+		return fmt.Errorf("could not read %s.%s: %v", table, column, err)
+	}
+	// read all values before rewriting them, as 'rows' holds 'txn'
+	updates := make(map[int64]string)
+	for rows.Next() {
+		var k int64
+		var stored string
+		if err := rows.Scan(&k, &stored); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning %s.%s: %v", table, column, err)
+		}
+		if decoded := decodeLegacyText(stored); decoded != stored {
+			updates[k] = decoded
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading %s.%s: %v", table, column, err)
+	}
+	for k, decoded := range updates {
+		if _, err := txn.Exec(fmt.Sprintf(
+			"UPDATE %s SET %s = ? WHERE %s = ?;", table, column, key,
+		), decoded, k); err != nil {
+			return fmt.Errorf("could not update %s.%s: %v", table, column, err)
+		}
+	}
+	return nil
+}
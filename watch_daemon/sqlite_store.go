@@ -0,0 +1,572 @@
+package watchd
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// sqliteStore is the implementation of Store used by 't serve'. It persists
+// all data in a SQLite DB (see fold.go for how intervals are stored, and
+// migrate.go for the DB's schema)
+type sqliteStore struct {
+	// db is (a client of) a SQLite database that contains all intervals and
+	// watches persisted on disk. The sqlite driver does not allow for concurrent
+	// writes (see https://github.com/mattn/go-sqlite3#faq), which is why the
+	// server serializes writes to its Store
+	db *sql.DB
+}
+
+// NewSQLiteStore returns a Store that persists its data in the SQLite DB at
+// 'dbPath', bringing the DB's schema up to date if necessary. 'clock' is used
+// to timestamp any migrations that are applied, and legacy ticks are folded
+// into intervals with the max event gap 'maxEventGap' (see migrateTicks).
+func NewSQLiteStore(clock Clock, dbPath string, maxEventGap int64) (Store, error) {
+	// Create DB connection
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open DB: %v", err)
+	}
+	for err = db.Ping(); err != nil; err = db.Ping() {
+		log.Printf("Waiting for DB to start (last ping: %v)", err)
+		time.Sleep(time.Second)
+	}
+	// Bring the DB's schema up to date
+	plan, err := migrate(db, clock, maxEventGap, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if plan.From != plan.To {
+		log.Infof("migrated DB from schema version %d to %d", plan.From, plan.To)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// inTxn runs 'f' in a new transaction, which is committed if 'f' succeeds and
+// rolled back otherwise
+func (s *sqliteStore) inTxn(f func(txn *sql.Tx) error) error {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not create txn: %v", err)
+	}
+	if err := f(txn); err != nil {
+		if rbErr := txn.Rollback(); rbErr != nil {
+			log.Errorf("error rolling back txn: %v", rbErr)
+		}
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("could not commit txn: %v", err)
+	}
+	return nil
+}
+
+// AddTick implements the corresponding method of the Store interface
+func (s *sqliteStore) AddTick(t int64, label string, maxEventGap int64) error {
+	// foldTick may make several writes--do them in a txn
+	return s.inTxn(func(txn *sql.Tx) error {
+		return foldTick(txn, maxEventGap, t, label)
+	})
+}
+
+// RecordWrite implements the corresponding method of the Store interface
+func (s *sqliteStore) RecordWrite(dir string, project int64, t int64, maxEventGap int64) error {
+	// These two changes are bundled into a transaction because even though the
+	// server serializes writes, the transaction avoids issues where one write
+	// succeeds but the other doesn't
+	return s.inTxn(func(txn *sql.Tx) error {
+		if err := foldProjectTick(txn, maxEventGap, t, project); err != nil {
+			return err
+		}
+		if _, err := txn.Exec(`UPDATE watches SET last_write = ? WHERE dir = ?;`,
+			t, dir); err != nil {
+			return fmt.Errorf("could not update last write of %q: %v", dir, err)
+		}
+		return nil
+	})
+}
+
+// RecordActivity implements the corresponding method of the Store interface
+func (s *sqliteStore) RecordActivity(project int64, t int64, paths []string) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		for _, path := range paths {
+			if _, err := txn.Exec(
+				"INSERT INTO activity (time, project_id, path) VALUES (?, ?, ?);",
+				t, project, path,
+			); err != nil {
+				return fmt.Errorf("could not record write to %q: %v", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetActivity implements the corresponding method of the Store interface
+func (s *sqliteStore) GetActivity(start, end int64) ([]*client.FileActivity, error) {
+	rows, err := s.db.Query(`
+	  SELECT p.name, a.path, COUNT(*) AS edits, MAX(a.time)
+	  FROM activity a JOIN projects p ON a.project_id = p.id
+	  WHERE a.time >= ? AND a.time <= ?
+	  GROUP BY p.name, a.path
+	  ORDER BY p.name ASC, edits DESC, a.path ASC;
+	`, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("could not read activity: %v", err)
+	}
+	defer rows.Close()
+	var result []*client.FileActivity
+	for rows.Next() {
+		f := &client.FileActivity{}
+		if err := rows.Scan(&f.Label, &f.Path, &f.Edits, &f.LastEdit); err != nil {
+			return nil, fmt.Errorf("error scanning activity rows: %v", err)
+		}
+		result = append(result, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading activity rows: %v", err)
+	}
+	return result, nil
+}
+
+// TrimActivity implements the corresponding method of the Store interface
+func (s *sqliteStore) TrimActivity(before int64) error {
+	if _, err := s.db.Exec("DELETE FROM activity WHERE time < ?;", before); err != nil {
+		return fmt.Errorf("could not trim activity: %v", err)
+	}
+	return nil
+}
+
+// GetIntervals implements the corresponding method of the Store interface
+func (s *sqliteStore) GetIntervals(start, end int64) ([]StoredInterval, error) {
+	rows, err := s.db.Query(`
+	  SELECT i.start_time, i.end_time, COALESCE(p.name, '')
+	  FROM intervals i LEFT JOIN projects p ON i.project_id = p.id
+	  WHERE i.end_time >= ? AND i.start_time <= ?
+	  ORDER BY i.start_time ASC;
+	`, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("could not read intervals: %v", err)
+	}
+	defer rows.Close()
+	var result []StoredInterval
+	for rows.Next() {
+		// parse SQL record
+		var i StoredInterval
+		if err := rows.Scan(&i.Start, &i.End, &i.Label); err != nil {
+			return nil, fmt.Errorf("error scanning interval row: %v", err)
+		}
+		result = append(result, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading interval rows: %v", err)
+	}
+	return result, nil
+}
+
+// LastTick implements the corresponding method of the Store interface
+func (s *sqliteStore) LastTick() (t int64, label string, ok bool, err error) {
+	var project int64
+	t, project, ok, err = lastTick(s.db)
+	if err != nil || !ok {
+		return 0, "", false, err
+	}
+	if err := s.db.QueryRow(
+		"SELECT name FROM projects WHERE id = ?;", project,
+	).Scan(&label); err != nil {
+		return 0, "", false, fmt.Errorf("could not read name of project %d: %v", project, err)
+	}
+	return t, label, true, nil
+}
+
+// AddWatch implements the corresponding method of the Store interface
+func (s *sqliteStore) AddWatch(dir, label, backend string, burstThreshold int, lastWrite int64) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		project, err := projectID(txn, label)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Exec(
+			"INSERT INTO watches (last_write, dir, project_id, backend, burst_threshold) VALUES (?, ?, ?, ?, ?);",
+			lastWrite, dir, project, backend, burstThreshold,
+		); err != nil {
+			return fmt.Errorf("error creating new watch in DB: %v", err)
+		}
+		return nil
+	})
+}
+
+// RemoveWatch implements the corresponding method of the Store interface
+func (s *sqliteStore) RemoveWatch(dir string) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		result, err := txn.Exec("DELETE FROM watches WHERE dir = ?;", dir)
+		if err != nil {
+			return fmt.Errorf("could not delete watch on %q: %v", dir, err)
+		}
+		if err := checkWatchUpdated(result, dir); err != nil {
+			return err
+		}
+		if _, err := txn.Exec("DELETE FROM label_rules WHERE dir = ?;", dir); err != nil {
+			return fmt.Errorf("could not delete label rules of watch on %q: %v", dir, err)
+		}
+		return nil
+	})
+}
+
+// UpdateWatch implements the corresponding method of the Store interface
+func (s *sqliteStore) UpdateWatch(dir, label string) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		project, err := projectID(txn, label)
+		if err != nil {
+			return err
+		}
+		result, err := txn.Exec(
+			"UPDATE watches SET project_id = ? WHERE dir = ?;", project, dir)
+		if err != nil {
+			return fmt.Errorf("could not update watch on %q: %v", dir, err)
+		}
+		return checkWatchUpdated(result, dir)
+	})
+}
+
+// checkWatchUpdated returns NoSuchWatchErr if 'result' (the result of a
+// statement modifying the watch on 'dir') didn't affect any rows
+func checkWatchUpdated(result sql.Result, dir string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not check whether watch on %q exists: %v", dir, err)
+	}
+	if n == 0 {
+		return &NoSuchWatchErr{dir: dir}
+	}
+	return nil
+}
+
+// checkWatchExists returns NoSuchWatchErr if 'dir' isn't watched
+func checkWatchExists(db dbExecQuerier, dir string) error {
+	var n int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM watches WHERE dir = ?;", dir,
+	).Scan(&n); err != nil {
+		return fmt.Errorf("could not look up watch on %q: %v", dir, err)
+	}
+	if n == 0 {
+		return &NoSuchWatchErr{dir: dir}
+	}
+	return nil
+}
+
+// GetWatches implements the corresponding method of the Store interface
+func (s *sqliteStore) GetWatches() ([]*StoredWatch, error) {
+	return getWatches(s.db)
+}
+
+// getWatches reads all watches and their label rules from 'db' (see
+// Store.GetWatches)
+func getWatches(db dbExecQuerier) ([]*StoredWatch, error) {
+	rows, err := db.Query(`
+	  SELECT w.last_write, w.dir, w.project_id, p.name, w.backend, w.burst_threshold
+	  FROM watches w JOIN projects p ON w.project_id = p.id
+	  ORDER BY w.dir ASC;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("could not read existing watches: %v", err)
+	}
+	defer rows.Close()
+	var result []*StoredWatch
+	byDir := make(map[string]*StoredWatch)
+	for rows.Next() {
+		// parse SQL record
+		var lastWrite int64
+		w := &StoredWatch{}
+		if err := rows.Scan(&lastWrite, &w.Dir, &w.ProjectID, &w.Label, &w.Backend,
+			&w.BurstThreshold); err != nil {
+			return nil, fmt.Errorf("error scanning watch rows: %v", err)
+		}
+		w.LastWrite = time.Unix(lastWrite, 0)
+		result = append(result, w)
+		byDir[w.Dir] = w
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading watch rows: %v", err)
+	}
+	rows.Close()
+
+	// Attach each watch's label rules
+	rows, err = db.Query(`
+	  SELECT r.dir, r.path, r.project_id, p.name
+	  FROM label_rules r JOIN projects p ON r.project_id = p.id
+	  ORDER BY r.dir ASC, r.path ASC;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("could not read label rules: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dir string
+		r := &StoredLabelRule{}
+		if err := rows.Scan(&dir, &r.Path, &r.ProjectID, &r.Label); err != nil {
+			return nil, fmt.Errorf("error scanning label rule rows: %v", err)
+		}
+		if w, ok := byDir[dir]; ok {
+			w.Rules = append(w.Rules, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading label rule rows: %v", err)
+	}
+	return result, nil
+}
+
+// SubsumeWatches implements the corresponding method of the Store interface
+func (s *sqliteStore) SubsumeWatches(dir, label, backend string, burstThreshold int, lastWrite int64) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		watches, err := getWatches(txn)
+		if err != nil {
+			return err
+		}
+		var children []*StoredWatch
+		for _, w := range watches {
+			if !isSubdir(dir, w.Dir) {
+				continue
+			}
+			children = append(children, w)
+			for _, stmt := range []string{
+				"DELETE FROM watches WHERE dir = ?;",
+				"DELETE FROM label_rules WHERE dir = ?;",
+			} {
+				if _, err := txn.Exec(stmt, w.Dir); err != nil {
+					return fmt.Errorf("could not remove subsumed watch on %q: %v", w.Dir, err)
+				}
+			}
+		}
+		project, err := projectID(txn, label)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Exec(
+			"INSERT INTO watches (last_write, dir, project_id, backend, burst_threshold) VALUES (?, ?, ?, ?, ?);",
+			lastWrite, dir, project, backend, burstThreshold,
+		); err != nil {
+			return fmt.Errorf("error creating new watch in DB: %v", err)
+		}
+		for _, r := range subsumedRules(dir, children) {
+			if _, err := txn.Exec(
+				"INSERT OR REPLACE INTO label_rules (dir, path, project_id) VALUES (?, ?, ?);",
+				dir, r.Path, r.ProjectID,
+			); err != nil {
+				return fmt.Errorf("could not create label rule for %q: %v", r.Path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// AddLabelRule implements the corresponding method of the Store interface
+func (s *sqliteStore) AddLabelRule(dir, path, label string) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		if err := checkWatchExists(txn, dir); err != nil {
+			return err
+		}
+		project, err := projectID(txn, label)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Exec(
+			"INSERT OR REPLACE INTO label_rules (dir, path, project_id) VALUES (?, ?, ?);",
+			dir, path, project,
+		); err != nil {
+			return fmt.Errorf("could not create label rule for %q: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// RemoveLabelRule implements the corresponding method of the Store interface
+func (s *sqliteStore) RemoveLabelRule(dir, path string) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		if err := checkWatchExists(txn, dir); err != nil {
+			return err
+		}
+		result, err := txn.Exec(
+			"DELETE FROM label_rules WHERE dir = ? AND path = ?;", dir, path)
+		if err != nil {
+			return fmt.Errorf("could not delete label rule for %q: %v", path, err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("could not delete label rule for %q: %v", path, err)
+		} else if n == 0 {
+			return &NoSuchLabelRuleErr{dir: dir, path: path}
+		}
+		return nil
+	})
+}
+
+// EvictWatches implements the corresponding method of the Store interface
+func (s *sqliteStore) EvictWatches(dirs []string, reason string, t int64) error {
+	return s.inTxn(func(txn *sql.Tx) error {
+		for _, dir := range dirs {
+			// record the eviction first, as it reads the watch's project
+			if _, err := txn.Exec(`
+			  INSERT INTO evictions (dir, project_id, time, reason)
+			  SELECT dir, project_id, ?, ? FROM watches WHERE dir = ?;
+			`, t, reason, dir); err != nil {
+				return fmt.Errorf("could not record eviction of watch on %q: %v", dir, err)
+			}
+			for _, stmt := range []string{
+				"DELETE FROM watches WHERE dir = ?;",
+				"DELETE FROM label_rules WHERE dir = ?;",
+			} {
+				if _, err := txn.Exec(stmt, dir); err != nil {
+					return fmt.Errorf("could not evict watch on %q: %v", dir, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetEvictions implements the corresponding method of the Store interface
+func (s *sqliteStore) GetEvictions() ([]*StoredEviction, error) {
+	rows, err := s.db.Query(`
+	  SELECT e.dir, p.name, e.time, e.reason
+	  FROM evictions e JOIN projects p ON e.project_id = p.id
+	  ORDER BY e.time DESC, e.rowid DESC;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("could not read evictions: %v", err)
+	}
+	defer rows.Close()
+	var result []*StoredEviction
+	for rows.Next() {
+		e := &StoredEviction{}
+		if err := rows.Scan(&e.Dir, &e.Label, &e.Time, &e.Reason); err != nil {
+			return nil, fmt.Errorf("error scanning eviction rows: %v", err)
+		}
+		result = append(result, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading eviction rows: %v", err)
+	}
+	return result, nil
+}
+
+// lookupProject returns the ID of the project named 'name', or
+// NoSuchProjectErr if no such project exists
+func lookupProject(db dbExecQuerier, name string) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM projects WHERE name = ?;", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, &NoSuchProjectErr{name: name}
+	} else if err != nil {
+		return 0, fmt.Errorf("could not look up project %q: %v", name, err)
+	}
+	return id, nil
+}
+
+// GetProjects implements the corresponding method of the Store interface
+func (s *sqliteStore) GetProjects() ([]*client.ProjectInfo, error) {
+	rows, err := s.db.Query("SELECT id, name FROM projects ORDER BY name ASC;")
+	if err != nil {
+		return nil, fmt.Errorf("could not read projects: %v", err)
+	}
+	defer rows.Close()
+	result := make([]*client.ProjectInfo, 0)
+	for rows.Next() {
+		pi := &client.ProjectInfo{}
+		if err := rows.Scan(&pi.ID, &pi.Name); err != nil {
+			return nil, fmt.Errorf("error scanning project rows: %v", err)
+		}
+		result = append(result, pi)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading projects: %v", err)
+	}
+	return result, nil
+}
+
+// RenameProject implements the corresponding method of the Store interface.
+// Because intervals and watches refer to projects by ID, only the project's
+// row in 'projects' is modified
+func (s *sqliteStore) RenameProject(from, to string) error {
+	id, err := lookupProject(s.db, from)
+	if err != nil {
+		return err
+	}
+	if err := validateLabel(to); err != nil {
+		return err
+	}
+	if _, err := lookupProject(s.db, to); err == nil {
+		return &ProjectExistsErr{name: to}
+	} else if _, ok := err.(*NoSuchProjectErr); !ok {
+		return err
+	}
+	if _, err := s.db.Exec(
+		"UPDATE projects SET name = ? WHERE id = ?;", to, id,
+	); err != nil {
+		return fmt.Errorf("could not rename project %q: %v", from, err)
+	}
+	return nil
+}
+
+// MergeProjects implements the corresponding method of the Store interface.
+//
+// Note that this doesn't merge overlapping intervals of the two projects;
+// the server merges overlapping intervals when it reads them.
+func (s *sqliteStore) MergeProjects(from, into string) error {
+	fromID, err := lookupProject(s.db, from)
+	if err != nil {
+		return err
+	}
+	intoID, err := lookupProject(s.db, into)
+	if err != nil {
+		return err
+	}
+	if fromID == intoID {
+		return nil // nothing to do
+	}
+	return s.inTxn(func(txn *sql.Tx) error {
+		for _, stmt := range []struct {
+			query string
+			args  []interface{}
+		}{
+			{"UPDATE intervals SET project_id = ? WHERE project_id = ?;", []interface{}{intoID, fromID}},
+			{"UPDATE watches SET project_id = ? WHERE project_id = ?;", []interface{}{intoID, fromID}},
+			{"UPDATE label_rules SET project_id = ? WHERE project_id = ?;", []interface{}{intoID, fromID}},
+			{"UPDATE evictions SET project_id = ? WHERE project_id = ?;", []interface{}{intoID, fromID}},
+			{"UPDATE activity SET project_id = ? WHERE project_id = ?;", []interface{}{intoID, fromID}},
+			{"DELETE FROM projects WHERE id = ?;", []interface{}{fromID}},
+		} {
+			if _, err := txn.Exec(stmt.query, stmt.args...); err != nil {
+				return fmt.Errorf("could not merge project %q into %q: %v", from, into, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Clear implements the corresponding method of the Store interface
+func (s *sqliteStore) Clear() error {
+	// Delete all rows rather than dropping and recreating the tables, so that
+	// the schema (which is owned by migrate()) is unchanged
+	return s.inTxn(func(txn *sql.Tx) error {
+		return execAll(txn,
+			"DELETE FROM intervals;",
+			"DELETE FROM watches;",
+			"DELETE FROM label_rules;",
+			"DELETE FROM evictions;",
+			"DELETE FROM activity;",
+			"DELETE FROM projects;",
+		)
+	})
+}
+
+// Close implements the corresponding method of the Store interface
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,178 @@
+// store.go defines Store, the interface between the time tracker server and
+// the backend that persists its intervals, projects, and watches. The server
+// is constructed with a Store (see NewServerWithStore); sqlite_store.go
+// contains the SQLite implementation used by 't serve', and memory_store.go
+// contains an in-memory implementation.
+
+package watchd
+
+import (
+	"time"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// StoredInterval is an interval of activity persisted by a Store
+type StoredInterval struct {
+	// Start and End are the first and last tick in the interval, as unix times
+	// (seconds since epoch)
+	Start, End int64
+
+	// Label is the label of all ticks in the interval, or "" if the interval is
+	// part of the union of all labels' intervals
+	Label string
+}
+
+// StoredLabelRule is a label rule (see client.LabelRule) of a watch persisted
+// by a Store
+type StoredLabelRule struct {
+	// Path is the subtree of the watched dir to which the rule applies,
+	// relative to the watched dir
+	Path string
+
+	// Label is recorded with every file event under 'Path', and ProjectID is
+	// the ID of the corresponding project
+	Label     string
+	ProjectID int64
+}
+
+// StoredWatch is a watch persisted by a Store
+type StoredWatch struct {
+	// Dir is the directory being watched
+	Dir string
+
+	// Label is recorded with every file event underneath 'Dir', and ProjectID is
+	// the ID of the corresponding project
+	Label     string
+	ProjectID int64
+
+	// LastWrite indicates the most recent write recieved for this watch
+	LastWrite time.Time
+
+	// Backend is the backend requested for the watch (see
+	// client.WatchRequest.Backend)
+	Backend string
+
+	// BurstThreshold is the burst threshold requested for the watch (see
+	// client.WatchRequest.BurstThreshold)
+	BurstThreshold int
+
+	// Rules override 'Label' for parts of 'Dir', sorted by path
+	Rules []*StoredLabelRule
+}
+
+// StoredEviction records the eviction of a watch (see client.Eviction)
+type StoredEviction struct {
+	Dir    string
+	Label  string
+	Time   int64
+	Reason string
+}
+
+// Store persists the time tracker's data. Ticks aren't stored individually;
+// instead, a Store folds each tick into the intervals of its project (and into
+// the union of all projects' intervals) as it arrives, producing the same
+// intervals that a Collector would if it were given every tick. When work
+// switches from one project to another, the new project's interval starts at
+// the previous project's last tick.
+//
+// Store implementations need not be safe for concurrent use: the server
+// serializes writes, though it may call read-only methods (GetIntervals,
+// LastTick, GetWatches, GetProjects, GetActivity) concurrently.
+//
+// Every method that creates or renames a project returns an error if the new
+// project's name is "" (see validateLabel), as "" is the label of the union
+// of all projects' intervals.
+type Store interface {
+	// AddTick folds a tick at time 't' with the label 'label' into the stored
+	// intervals, creating a project for 'label' if necessary. Ticks more than
+	// 'maxEventGap' seconds apart are in different intervals
+	AddTick(t int64, label string, maxEventGap int64) error
+
+	// RecordWrite folds a tick at time 't' for the project 'project' into the
+	// stored intervals (as AddTick does), and sets the last write time of the
+	// watch on 'dir' to 't'. Both changes are made atomically
+	RecordWrite(dir string, project int64, t int64, maxEventGap int64) error
+
+	// RecordActivity records that each file in 'paths' was written (as part of
+	// the project 'project') at time 't'
+	RecordActivity(project int64, t int64, paths []string) error
+
+	// GetActivity returns, for each file whose writes were recorded (by
+	// RecordActivity) in [start, end], the number of times they were recorded
+	// and the most recent time. Files are sorted by label, then by number of
+	// edits (descending), then by path
+	GetActivity(start, end int64) ([]*client.FileActivity, error)
+
+	// TrimActivity deletes all writes recorded by RecordActivity before 'before'
+	TrimActivity(before int64) error
+
+	// GetIntervals returns all stored intervals (labeled, and the union of all
+	// labels, which has the label "") that overlap [start, end], sorted by
+	// start time
+	GetIntervals(start, end int64) ([]StoredInterval, error)
+
+	// LastTick returns the time and label of the most recent tick (or
+	// ok == false if there are no ticks)
+	LastTick() (t int64, label string, ok bool, err error)
+
+	// AddWatch adds a watch on 'dir' with the label 'label' (creating a project
+	// for 'label' if necessary), the backend 'backend', and the burst threshold
+	// 'burstThreshold', whose last write is 'lastWrite'
+	AddWatch(dir, label, backend string, burstThreshold int, lastWrite int64) error
+
+	// SubsumeWatches adds a watch on 'dir' (as AddWatch does) that replaces
+	// all existing watches on subdirectories of 'dir'. Each replaced watch's
+	// label, and each of its label rules, becomes a label rule of the new watch
+	SubsumeWatches(dir, label, backend string, burstThreshold int, lastWrite int64) error
+
+	// AddLabelRule adds a label rule to the watch on 'dir', so that file events
+	// matching 'path' (relative to 'dir'; see client.LabelRule.Path) are
+	// labeled 'label' (replacing any existing rule for 'path'). It returns
+	// NoSuchWatchErr if 'dir' isn't watched
+	AddLabelRule(dir, path, label string) error
+
+	// RemoveLabelRule deletes the label rule for 'path' from the watch on
+	// 'dir'. It returns NoSuchWatchErr if 'dir' isn't watched, and
+	// NoSuchLabelRuleErr if the watch has no rule for 'path'
+	RemoveLabelRule(dir, path string) error
+
+	// RemoveWatch deletes the watch on 'dir' (and its label rules). It returns
+	// NoSuchWatchErr if 'dir' isn't watched
+	RemoveWatch(dir string) error
+
+	// UpdateWatch changes the label of the watch on 'dir' to 'label' (creating a
+	// project for 'label' if necessary). It returns NoSuchWatchErr if 'dir'
+	// isn't watched
+	UpdateWatch(dir, label string) error
+
+	// GetWatches returns all stored watches, sorted by dir
+	GetWatches() ([]*StoredWatch, error)
+
+	// EvictWatches deletes the watches on 'dirs' (and their label rules), and
+	// records an eviction of each one at time 't' (in seconds since epoch) for
+	// 'reason'. Dirs that aren't watched are ignored
+	EvictWatches(dirs []string, reason string, t int64) error
+
+	// GetEvictions returns all recorded evictions, most recent first
+	GetEvictions() ([]*StoredEviction, error)
+
+	// GetProjects returns all projects, sorted by name
+	GetProjects() ([]*client.ProjectInfo, error)
+
+	// RenameProject changes the name of the project 'from' to 'to'. It returns
+	// NoSuchProjectErr if 'from' doesn't exist, and ProjectExistsErr if 'to'
+	// does
+	RenameProject(from, to string) error
+
+	// MergeProjects reassigns all intervals and watches of the project 'from'
+	// to the project 'into', and deletes 'from'. It returns NoSuchProjectErr if
+	// either project doesn't exist
+	MergeProjects(from, into string) error
+
+	// Clear deletes all data in the store
+	Clear() error
+
+	// Close releases any resources held by the store
+	Close() error
+}
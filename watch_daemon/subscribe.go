@@ -0,0 +1,108 @@
+package watchd
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/msteffen/golang-time-tracker/client"
+)
+
+// subscriberBufSize is the number of events that may be queued for a
+// subscriber (see server.Subscribe) before further events are dropped for it
+const subscriberBufSize = 64
+
+// broker delivers client.Events to the server's subscribers. Its zero value is
+// ready to use
+type broker struct {
+	// mu guards 'subscribers'
+	mu sync.Mutex
+
+	// subscribers contains the channel of each subscriber
+	subscribers map[chan *client.Event]struct{}
+}
+
+// subscribe returns a channel that receives every event published by 'b'
+// until 'done' is closed
+func (b *broker) subscribe(done <-chan struct{}) <-chan *client.Event {
+	events := make(chan *client.Event, subscriberBufSize)
+	b.mu.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan *client.Event]struct{})
+	}
+	b.subscribers[events] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		<-done
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, events)
+		close(events)
+	}()
+	return events
+}
+
+// empty returns true if 'b' has no subscribers (in which case there's no need
+// to build events for it)
+func (b *broker) empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) == 0
+}
+
+// publish sends 'e' to every subscriber. Subscribers that have fallen behind
+// (i.e. whose channels are full) miss 'e', rather than blocking the server.
+// Every subscriber receives the same *Event, so it must not be modified
+func (b *broker) publish(e *client.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- e:
+		default:
+			log.Warnf("dropping %s event for a subscriber that has fallen behind", e.Type)
+		}
+	}
+}
+
+// Subscribe implements the corresponding method of the client.TimeTrackerAPI
+// interface
+func (s *server) Subscribe(done <-chan struct{}) (<-chan *client.Event, error) {
+	return s.broker.subscribe(done), nil
+}
+
+// publishTick publishes an EventTick for a tick recorded at 't' with the label
+// 'label', and an EventInterval if the tick extended the in-progress interval.
+// s.storeMu must be held by the caller
+func (s *server) publishTick(t int64, label string) {
+	if s.broker.empty() {
+		return // don't read the in-progress interval if nobody will see it
+	}
+	s.broker.publish(&client.Event{Type: client.EventTick, Time: t, Label: label})
+	intervals, err := s.store.GetIntervals(t, t)
+	if err != nil {
+		log.Errorf("could not read the interval containing the tick at %d: %v", t, err)
+		return
+	}
+	for _, i := range intervals {
+		if i.Label == "" && i.Start < t && t <= i.End {
+			s.broker.publish(&client.Event{
+				Type:     client.EventInterval,
+				Time:     t,
+				Label:    label,
+				Interval: &client.Interval{Start: i.Start, End: i.End},
+			})
+			return
+		}
+	}
+}
+
+// publishWatch publishes an EventWatch for the watch on 'dir'
+func (s *server) publishWatch(dir, label string) {
+	s.broker.publish(&client.Event{
+		Type:  client.EventWatch,
+		Time:  s.clock.Now().Unix(),
+		Label: label,
+		Dir:   dir,
+	})
+}
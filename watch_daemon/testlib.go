@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 
 	"github.com/msteffen/golang-time-tracker/client"
 	"github.com/msteffen/golang-time-tracker/pkg/check"
+	"github.com/msteffen/golang-time-tracker/pkg/watcher"
 )
 
 var (
@@ -28,11 +31,11 @@ var (
 	// default on most linux distros (incl. ubuntu on my laptop)
 	dbDir = "/dev/shm/time-tracker-test"
 
-	// lastHTTPServer stores the most recent httpServer returned by
-	// StartTestServer. It will be shut down by any subsequent call to
+	// lastHTTPServers stores the most recent http.Servers created by
+	// StartTestServer. They will be shut down by any subsequent call to
 	// StartTestServer() (to guarantee that only one goro is listening on
 	// 'address' at a time
-	lastHTTPServer *http.Server
+	lastHTTPServers []*http.Server
 )
 
 // ReadBody is a helper function that reads resp.Body into a buffer and returns
@@ -51,16 +54,35 @@ type TestServer struct {
 	*client.Client
 	*TestingClock
 
-	socketFile  string
-	dbFile      string
+	// Public is a client of the test server's public endpoints (served on
+	// 'address'), whereas the embedded Client talks to its unix socket
+	Public *client.Client
+
+	// socketFile is the unix socket on which the test server serves its control
+	// endpoints (see ToHTTPServers). It's in a temporary directory belonging to
+	// the test, so that concurrent test runs don't share it
+	socketFile string
+
+	server      *server
+	dbFile      string // "" if the server uses an in-memory store
+	store       Store
+	events      *fakeEventSource // nil if the server watches the filesystem
+	config      *client.Config   // nil if the server uses DefaultConfig()
 	maxEventGap int64
+	token       string
 
-	httpServer *http.Server
+	controlServer, publicServer *http.Server
 }
 
 // StartTestServer brings up an in-process watch daemon, for the tests to talk
 // to
 func StartTestServer(t *testing.T) *TestServer {
+	return StartTestServerWithConfig(t, nil)
+}
+
+// StartTestServerWithConfig is like StartTestServer, but the watch daemon uses
+// the settings in 'config' rather than DefaultConfig()
+func StartTestServerWithConfig(t *testing.T, config *client.Config) *TestServer {
 	// 'dbDir' is shared by all tests currently running. If we don't remove the
 	// existing tmp directory for invocation of StartTestServer, then go test ...
 	// -count=N won't work, as all runs of a given test will share the same DB
@@ -70,7 +92,8 @@ func StartTestServer(t *testing.T) *TestServer {
 	if err := os.Mkdir(dbDir, 0700); err != nil {
 		t.Fatalf("couldn't create dir %q: %v", dbDir, err)
 	}
-	dbFile := path.Join(dbDir, t.Name())
+	// subtests' names contain '/' (see forEachStore)
+	dbFile := path.Join(dbDir, strings.Replace(t.Name(), "/", "_", -1))
 	t.Logf("dbFile: %s", dbFile)
 
 	// Create request handling struct
@@ -80,47 +103,135 @@ func StartTestServer(t *testing.T) *TestServer {
 	// persisted data) but with different tests storing the DB at different paths,
 	// and thus avoiding races.
 	testClock := &TestingClock{}
-	ttAPI, err := NewServer(testClock, dbFile)
+	maxEventGap := int64(defaultMaxEventGap)
+	if config != nil {
+		maxEventGap = config.MaxEventGap
+	}
+	store, err := NewSQLiteStore(testClock, dbFile, maxEventGap)
+	if err != nil {
+		t.Fatalf("could not create SQLite store: %v", err)
+	}
+	return startTestServer(t, testClock, store, dbFile, config)
+}
+
+// StartMemoryTestServer is like StartTestServer, but the watch daemon stores
+// all data in memory (via NewMemoryStore) rather than in a SQLite DB
+func StartMemoryTestServer(t *testing.T) *TestServer {
+	return startTestServer(t, &TestingClock{}, NewMemoryStore(), "", nil)
+}
+
+// StartMemoryTestServerWithConfig is like StartMemoryTestServer, but the watch
+// daemon uses the settings in 'config' rather than DefaultConfig()
+func StartMemoryTestServerWithConfig(t *testing.T, config *client.Config) *TestServer {
+	return startTestServer(t, &TestingClock{}, NewMemoryStore(), "", config)
+}
+
+// testServerConstructors contains a constructor for a test server backed by
+// each Store implementation (see forEachStore)
+var testServerConstructors = []struct {
+	name  string
+	start func(t *testing.T, config *client.Config) *TestServer
+}{
+	{name: "SQLite", start: StartTestServerWithConfig},
+	{name: "InMemory", start: StartMemoryTestServerWithConfig},
+}
+
+// forEachStore runs 'test' in a subtest once per Store implementation, each
+// time against a new test server that uses that store and the settings in
+// 'config' (or DefaultConfig(), if 'config' is nil)
+func forEachStore(t *testing.T, config *client.Config, test func(s *TestServer)) {
+	for _, c := range testServerConstructors {
+		start := c.start
+		t.Run(c.name, func(t *testing.T) {
+			test(start(t, config))
+		})
+	}
+}
+
+// StartFakeEventsTestServer is like StartMemoryTestServerWithConfig, but the
+// watch daemon's watches don't observe the filesystem. Instead, the only
+// events they receive are those passed to EmitEvent (so watched dirs needn't
+// exist)
+func StartFakeEventsTestServer(t *testing.T, config *client.Config) *TestServer {
+	events := &fakeEventSource{watches: make(map[string]*fakeWatch)}
+	s := startTestServerWithEvents(t, &TestingClock{}, NewMemoryStore(), events, "", config)
+	s.events = events
+	return s
+}
+
+// startTestServer contains the logic shared by StartTestServer and
+// StartMemoryTestServer
+func startTestServer(t *testing.T, testClock *TestingClock, store Store, dbFile string, config *client.Config) *TestServer {
+	return startTestServerWithEvents(t, testClock, store, WatcherEventSource, dbFile, config)
+}
+
+// startTestServerWithEvents is like startTestServer, but the watch daemon
+// observes the events produced by 'events'
+func startTestServerWithEvents(t *testing.T, testClock *TestingClock, store Store, events EventSource, dbFile string, config *client.Config) *TestServer {
+	ttAPI, err := NewServerWithEventSource(testClock, store, events, config)
 	if err != nil {
 		t.Fatalf("could not create API Server: %v", err)
 	}
-	maxEventGap := ttAPI.(*server).maxEventGap
+	maxEventGap := ttAPI.(*server).config.MaxEventGap
+	token, err := NewToken()
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
 
 	// Start listening for HTTP requests
+	socketFile := path.Join(t.TempDir(), "sock")
 	testServer := &TestServer{
 		T:            t,
-		Client:       &client.Client{Address: address},
+		server:       ttAPI.(*server),
+		Client:       &client.Client{Address: client.UnixPrefix + socketFile, Token: token},
+		socketFile:   socketFile,
 		TestingClock: testClock,
+		Public:       &client.Client{Address: address},
 		dbFile:       dbFile,
+		store:        store,
+		config:       config,
 		maxEventGap:  maxEventGap,
-		httpServer:   ToHTTPServer(address, testClock, ttAPI),
+		token:        token,
 	}
+	testServer.controlServer, testServer.publicServer =
+		ToHTTPServers(address, testClock, ttAPI, token)
 	testServer.StartServing(t)
 	return testServer
 }
 
 func (ts *TestServer) StartServing(t *testing.T) {
-	// Shut down any prior HTTP server
-	if lastHTTPServer != nil {
-		if err := lastHTTPServer.Shutdown(context.Background()); err != nil {
+	// Shut down any prior HTTP servers
+	for _, s := range lastHTTPServers {
+		if err := s.Shutdown(context.Background()); err != nil {
 			t.Fatalf("couldn't shut down existing server: %v", err)
 		}
 	}
-	lastHTTPServer = ts.httpServer
+	lastHTTPServers = []*http.Server{ts.controlServer, ts.publicServer}
+	l, err := ListenUnix(ts.socketFile)
+	if err != nil {
+		t.Fatalf("couldn't listen on test socket: %v", err)
+	}
 	go func() {
-		err := ts.httpServer.ListenAndServe()
+		err := ts.controlServer.Serve(l)
 		if err != nil && err != http.ErrServerClosed {
 			// panic vs t.Fatalf() as this may run after the test has finished
-			panic(fmt.Sprintf("error from ts.ListenAndServe(): %v", err))
+			panic(fmt.Sprintf("error from ts.controlServer.Serve(): %v", err))
+		}
+	}()
+	go func() {
+		err := ts.publicServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			panic(fmt.Sprintf("error from ts.publicServer.ListenAndServe(): %v", err))
 		}
 	}()
 
-	// Wait until the server is up before proceeding
+	// Wait until the servers are up before proceeding
 	secs := 60
 	for i := 0; i < secs; i++ {
 		log.Infof("waiting until server is up to continue (%d/%d)", i, secs)
-		_, err := ts.Client.Status()
-		if err == nil {
+		_, controlErr := ts.Client.Status()
+		_, publicErr := ts.Public.Status()
+		if controlErr == nil && publicErr == nil {
 			return // success
 		}
 		time.Sleep(time.Second)
@@ -146,14 +257,111 @@ func (s *TestServer) TickAt(label string, intervals ...int64) {
 func (s *TestServer) Restart(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	ttAPI, err := NewServer(s.TestingClock, s.dbFile)
+	// Stop the old server's watches and tickers first, so that it doesn't keep
+	// syncing watches and recording writes (to the same store) alongside the
+	// new server whenever the clock advances
+	if err := s.server.Close(); err != nil {
+		log.Fatalf("couldn't close old API server: %v", err)
+	}
+	// Servers with an in-memory store reuse the same store, as it's the only
+	// copy of their data
+	var ttAPI client.TimeTrackerAPI
+	var err error
+	switch {
+	case s.events != nil:
+		ttAPI, err = NewServerWithEventSource(s.TestingClock, s.store, s.events, s.config)
+	case s.dbFile != "":
+		ttAPI, err = NewServer(s.TestingClock, s.dbFile, s.config)
+	default:
+		ttAPI, err = NewServerWithStore(s.TestingClock, s.store, s.config)
+	}
 	if err != nil {
 		log.Fatalf("could not create API Server: %v", err)
 	}
-	if err := s.httpServer.Shutdown(ctx); err != nil {
-		log.Fatalf("couldn't shut down old test server: %v", err)
+	s.server = ttAPI.(*server)
+	for _, server := range []*http.Server{s.controlServer, s.publicServer} {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Fatalf("couldn't shut down old test server: %v", err)
+		}
 	}
-	s.httpServer = ToHTTPServer(address, s.TestingClock, ttAPI)
+	s.controlServer, s.publicServer = ToHTTPServers(address, s.TestingClock, ttAPI, s.token)
 	// Start serving requests
 	s.StartServing(t)
 }
+
+// fakeWatch is a watch established with a fakeEventSource
+type fakeWatch struct {
+	ctx context.Context
+	cb  func(watcher.WatchEvent) error
+}
+
+// fakeEventSource is an implementation of the EventSource API whose events
+// are scripted by tests (see TestServer.EmitEvent) rather than observed in the
+// filesystem
+type fakeEventSource struct {
+	// mu guards 'watches', and serializes calls to watches' callbacks (as a
+	// watcher would)
+	mu sync.Mutex
+
+	// watches maps each watched dir to its watch
+	watches map[string]*fakeWatch
+}
+
+// Watch implements the corresponding method of the EventSource interface. The
+// watch is established (and reported healthy) immediately, and runs until
+// 'ctx' is cancelled
+func (f *fakeEventSource) Watch(ctx context.Context, dir string, opts watcher.Options, cb func(watcher.WatchEvent) error) error {
+	if opts.OnStatus != nil {
+		opts.OnStatus(watcher.Status{Backend: watcher.BackendInotify})
+	}
+	w := &fakeWatch{ctx: ctx, cb: cb}
+	f.mu.Lock()
+	f.watches[dir] = w
+	f.mu.Unlock()
+	<-ctx.Done()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watches[dir] == w {
+		delete(f.watches, dir)
+	}
+	return ctx.Err()
+}
+
+// DetectBackend implements the corresponding method of the EventSource
+// interface (every dir is watched with inotify)
+func (f *fakeEventSource) DetectBackend(dir string) (string, error) {
+	return watcher.BackendInotify, nil
+}
+
+// EmitEvent delivers an event of type 'eventType' for 'p' (a path relative to
+// the watched dir 'dir', or a directory if it ends in "/") to the test
+// server's watch on 'dir', as if a watcher had observed it. It waits for the
+// watch to be established, and returns once the event has been handled (so
+// advancing the clock then records it). The server must have been started by
+// StartFakeEventsTestServer
+func (s *TestServer) EmitEvent(dir, p string, eventType watcher.WatchEventType) {
+	s.T.Helper()
+	if s.events == nil {
+		s.T.Fatalf("EmitEvent requires a server started by StartFakeEventsTestServer")
+	}
+	e := watcher.WatchEvent{
+		Type:  eventType,
+		IsDir: strings.HasSuffix(p, "/"),
+		Path:  path.Join(dir, p),
+	}
+	for i := 0; i < 500; i++ {
+		s.events.mu.Lock()
+		w, ok := s.events.watches[dir]
+		// skip watches that have been cancelled (e.g. by Restart) but haven't
+		// exited yet, as they no longer record writes
+		if ok && w.ctx.Err() == nil {
+			err := w.cb(e)
+			s.events.mu.Unlock()
+			check.T(s.T, check.Nil(err))
+			return
+		}
+		s.events.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.T.Fatalf("no watch on %q to receive %s", dir, e)
+}
@@ -1,7 +1,5 @@
 package watchd
 
-import "fmt"
-
 import (
 	"encoding/json"
 	"html/template"
@@ -17,6 +15,10 @@ type day struct {
 
 	// the set of intervals we request from 'server' and must render
 	Intervals []client.Interval `json:"intervals"`
+
+	// counted is the total length (in seconds) of the intervals in 'Intervals'
+	// that are long enough to count as work
+	counted int64
 }
 
 func (d *day) MarshalJSON() ([]byte, error) {
@@ -24,12 +26,8 @@ func (d *day) MarshalJSON() ([]byte, error) {
 	result["date"] = d.Date
 	if d.Intervals != nil {
 		result["intervals"] = d.Intervals
-		var totalTime int64
-		for _, i := range d.Intervals {
-			totalTime += (i.End - i.Start)
-		}
-		result["minutes"] = (totalTime / 60) % 60
-		result["hours"] = (totalTime / 3600)
+		result["minutes"] = (d.counted / 60) % 60
+		result["hours"] = (d.counted / 3600)
 	} else {
 		result["intervals"] = []struct{}{} // just needs to be a non-nil empty slice
 		result["minutes"] = 0
@@ -50,6 +48,9 @@ type TodayOp struct {
 	Now time.Time
 	// The http response writer that must receive the result of /today
 	Writer http.ResponseWriter
+	// If set, the days being rendered are written to 'Writer' as JSON, rather
+	// than as an HTML page (the page uses this to refresh itself)
+	JSON bool
 
 	//// Owned
 	// time representing 0:00 today. Computed from 'Now'
@@ -61,7 +62,12 @@ type TodayOp struct {
 
 // Start begins rendering the "today" page
 func (t *TodayOp) Start() {
-	fmt.Printf(">>> Now: %v\n", t.Now)
+	// Get the server's config, to determine which intervals count as work
+	config, err := t.Server.GetConfig(&client.GetConfigRequest{})
+	if err != nil {
+		http.Error(t.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	for i := 0; i < 5; i++ {
 		t.days[i] = &day{
 			Date: time.Date(t.Now.Year(), t.Now.Month(), t.Now.Day()-4+i,
@@ -71,15 +77,30 @@ func (t *TodayOp) Start() {
 
 		// getIntervals generates 'div' structs indicating where "work" divs should be
 		// placed (which indicate time when I was working)
+		// (per-label settings require labeled intervals)
 		result, err := t.Server.GetIntervals(&client.GetIntervalsRequest{
-			Start: t.days[i].Date.Unix(),
-			End:   t.days[i].Date.Add(24 * time.Hour).Unix(),
+			Start:   t.days[i].Date.Unix(),
+			End:     t.days[i].Date.Add(24 * time.Hour).Unix(),
+			Labeled: len(config.Labels) > 0,
 		})
 		if err != nil {
 			http.Error(t.Writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		t.days[i].Intervals = result.Intervals
+		for _, interval := range result.Intervals {
+			if config.Counts(interval, result.Labeled) {
+				t.days[i].counted += interval.End - interval.Start
+			}
+		}
+	}
+
+	if t.JSON {
+		t.Writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(t.Writer).Encode(t.days); err != nil {
+			http.Error(t.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
 	}
 
 	// Compute divs and place generated divs into HTML template